@@ -0,0 +1,213 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health provides the liveness and readiness of the location module
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// Status is the health of the module
+type Status struct {
+	// Live is false once the nats connection or the connection to gpsd is lost for good, or if gpsd
+	// sent no report within the maximum idle time
+	Live bool `json:"live"`
+	// Ready is true if the connections to the nats server and gpsd are established
+	Ready         bool `json:"ready"`
+	NatsConnected bool `json:"natsConnected"`
+	GpsdConnected bool `json:"gpsdConnected"`
+	// SinceLastMessage in milliseconds, -1 if no message was processed yet
+	SinceLastMessage int64 `json:"sinceLastMessage"`
+}
+
+// natsConn is the part of the nats connection used by the monitor
+type natsConn interface {
+	IsConnected() bool
+	IsClosed() bool
+	Subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error)
+}
+
+// Monitor derives the health from the nats and gpsd connections and the reports received from gpsd
+type Monitor struct {
+	nats  natsConn
+	codec *goavro.Codec
+	// maxIdle limits the time between two reports of gpsd, 0 means no limit
+	maxIdle time.Duration
+	started time.Time
+
+	mutex sync.Mutex
+	// gpsdConnected is nil while the module still connects to gpsd
+	gpsdConnected func() bool
+	lastMessage   time.Time
+}
+
+// NewMonitor creates a monitor for the given nats connection
+func NewMonitor(natsConn *nats.Conn, maxIdle time.Duration) (*Monitor, error) {
+	return newMonitor(natsConn, maxIdle)
+}
+
+func newMonitor(natsConn natsConn, maxIdle time.Duration) (*Monitor, error) {
+	codec, err := goavro.NewCodec(`
+	{
+		"type": "record",
+		"name": "service.location.health",
+		"doc": "health of the module",
+		"fields" : [
+		{
+			"name": "live",
+			"type": "boolean"
+		},
+		{
+			"name": "ready",
+			"type": "boolean"
+		},
+		{
+			"name": "natsConnected",
+			"type": "boolean"
+		},
+		{
+			"name": "gpsdConnected",
+			"type": "boolean"
+		},
+		{
+			"name": "sinceLastMessage",
+			"doc": "milliseconds since the last message of gpsd was processed, -1 if none was processed yet",
+			"type": "long"
+		}
+		]
+	}`)
+	if err != nil {
+		return nil, err
+	}
+	return &Monitor{
+		nats:    natsConn,
+		codec:   codec,
+		maxIdle: maxIdle,
+		started: time.Now(),
+	}, nil
+}
+
+// SetGpsdConnected is called once the gpsd client exists. f reports whether its connection is still up.
+func (m *Monitor) SetGpsdConnected(f func() bool) {
+	m.mutex.Lock()
+	m.gpsdConnected = f
+	m.mutex.Unlock()
+}
+
+// MessageProcessed is called for each report received from gpsd
+func (m *Monitor) MessageProcessed() {
+	m.mutex.Lock()
+	m.lastMessage = time.Now()
+	m.mutex.Unlock()
+}
+
+// Status evaluates the connections and the time since the last report of gpsd
+func (m *Monitor) Status() Status {
+	m.mutex.Lock()
+	lastMessage := m.lastMessage
+	gpsdConnected := m.gpsdConnected
+	m.mutex.Unlock()
+
+	now := time.Now()
+	status := Status{
+		NatsConnected:    m.nats.IsConnected(),
+		GpsdConnected:    gpsdConnected != nil && gpsdConnected(),
+		SinceLastMessage: -1,
+	}
+	idleSince := m.started
+	if !lastMessage.IsZero() {
+		status.SinceLastMessage = int64(now.Sub(lastMessage) / time.Millisecond)
+		idleSince = lastMessage
+	}
+	// the gpsd client does not reconnect, so a lost connection needs a restart just like a closed nats connection
+	gpsdLost := gpsdConnected != nil && !status.GpsdConnected
+	status.Live = !m.nats.IsClosed() && !gpsdLost && (m.maxIdle == 0 || now.Sub(idleSince) <= m.maxIdle)
+	status.Ready = status.NatsConnected && status.GpsdConnected
+	return status
+}
+
+// Handle serves the status as JSON on `/healthz` and `/readyz`. A module that is not live
+// respectively not ready gets 503 Service Unavailable.
+func (m *Monitor) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := m.Status()
+		writeStatus(w, status, status.Live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := m.Status()
+		writeStatus(w, status, status.Ready)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, status Status, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to write health status: %s", err)
+	}
+}
+
+// HandleRequests responds to requests on `<basename>.health` with the avro encoded status
+func (m *Monitor) HandleRequests(basename string) error {
+	_, err := m.nats.Subscribe(fmt.Sprintf("%s.health", basename), m.handler)
+	return err
+}
+
+func (m *Monitor) handler(msg *nats.Msg) {
+	data, err := m.encode(m.Status())
+	if err != nil {
+		log.Printf("Failed to create health response: %s", err)
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to respond to request on '%s': %s", msg.Subject, err)
+	}
+}
+
+// encode returns the status as avro object container file
+func (m *Monitor) encode(status Status) ([]byte, error) {
+	bin := new(bytes.Buffer)
+	ocfw, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:     bin,
+		Codec: m.codec,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ocfw.Append([]interface{}{map[string]interface{}{
+		"live":             status.Live,
+		"ready":            status.Ready,
+		"natsConnected":    status.NatsConnected,
+		"gpsdConnected":    status.GpsdConnected,
+		"sinceLastMessage": status.SinceLastMessage,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return bin.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/nats-io/nats.go"
+)
+
+type fakeNats struct {
+	connected, closed bool
+}
+
+func (n *fakeNats) IsConnected() bool { return n.connected }
+func (n *fakeNats) IsClosed() bool    { return n.closed }
+func (n *fakeNats) Subscribe(string, nats.MsgHandler) (*nats.Subscription, error) {
+	return &nats.Subscription{}, nil
+}
+
+func TestHealth(t *testing.T) {
+	nc := &fakeNats{connected: true}
+	m, err := newMonitor(nc, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	m.Handle(mux)
+	get := func(path string) (int, Status) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var status Status
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, status
+	}
+
+	// live but not ready while connecting to gpsd
+	if code, status := get("/readyz"); code != http.StatusServiceUnavailable || status.GpsdConnected || !status.NatsConnected {
+		t.Errorf("unexpected readiness %d %+v", code, status)
+	}
+	if code, status := get("/healthz"); code != http.StatusOK || status.SinceLastMessage != -1 {
+		t.Errorf("unexpected liveness %d %+v", code, status)
+	}
+
+	gpsdConnected := true
+	m.SetGpsdConnected(func() bool { return gpsdConnected })
+	m.MessageProcessed()
+	if code, status := get("/readyz"); code != http.StatusOK || !status.Live || status.SinceLastMessage < 0 {
+		t.Errorf("unexpected readiness %d %+v", code, status)
+	}
+
+	// the gpsd client does not reconnect
+	gpsdConnected = false
+	if code, status := get("/healthz"); code != http.StatusServiceUnavailable || status.Live {
+		t.Errorf("unexpected liveness after gpsd was lost %d %+v", code, status)
+	}
+	gpsdConnected = true
+
+	// no report of gpsd within the maximum idle time
+	m.maxIdle = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected liveness after idle time %d", code)
+	}
+	m.maxIdle = 0
+
+	nc.closed = true
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected liveness with closed nats connection %d", code)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	m, err := newMonitor(&fakeNats{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.encode(Status{Live: true, GpsdConnected: true, SinceLastMessage: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := goavro.NewOCFReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Scan() {
+		t.Fatal("no record")
+	}
+	record, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := record.(map[string]interface{})
+	if fields["live"] != true || fields["ready"] != false || fields["gpsdConnected"] != true || fields["sinceLastMessage"] != int64(42) {
+		t.Errorf("unexpected record %v", fields)
+	}
+}
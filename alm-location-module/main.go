@@ -17,11 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"alm-location-module/internal/health"
 	"alm-location-module/internal/version"
 	"alm-location-module/pkg/gpsd"
 	"bytes"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -87,6 +89,24 @@ func main() {
 	nc := <-ncChan
 	defer nc.Close()
 
+	var maxIdle time.Duration
+	if env := os.Getenv("HEALTH_MAX_IDLE"); len(env) > 0 {
+		var err error
+		if maxIdle, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("Invalid HEALTH_MAX_IDLE '%s': %s", env, err)
+		}
+	}
+	healthMonitor, err := health.NewMonitor(nc, maxIdle)
+	if err != nil {
+		log.Fatalf("Failed to create health monitor: %s", err)
+	}
+	if err := healthMonitor.HandleRequests("alm-location-module"); err != nil {
+		log.Fatalf("Failed to handle health requests: %s", err)
+	}
+	if env := os.Getenv("HTTP_ADDRESS"); len(env) > 0 {
+		serveHTTP(env, healthMonitor)
+	}
+
 	// avro schema defintion
 	codec, err := goavro.NewCodec(`
 	{
@@ -145,7 +165,9 @@ func main() {
 	}()
 
 	gpsClient := <-gpsChan
+	healthMonitor.SetGpsdConnected(gpsClient.Connected)
 	gpsClient.RegisterTpv(func(r interface{}) {
+		defer healthMonitor.MessageProcessed()
 		tpv := r.(*gpsd.Tpv)
 		t, err := iso8601.Parse([]byte(tpv.Time))
 		if err != nil {
@@ -236,6 +258,18 @@ func main() {
 	}
 }
 
+// serveHTTP starts the HTTP server providing the health endpoints
+func serveHTTP(address string, healthMonitor *health.Monitor) {
+	mux := http.NewServeMux()
+	healthMonitor.Handle(mux)
+	go func() {
+		log.Printf("Serving health on '%s'\n", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Fatalf("HTTP server failed: %s", err)
+		}
+	}()
+}
+
 func setupConnOptions(opts []nats.Option) []nats.Option {
 	totalWait := 10 * time.Minute
 	reconnectDelay := time.Second
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
 )
 
 // The API is based on this: https://gpsd.gitlab.io/gpsd/client-howto.html#_interfacing_from_the_client_side
@@ -18,6 +19,9 @@ type Connection struct {
 	filters map[string]FilterHandler
 	reader  *bufio.Reader
 	close   chan bool
+
+	mutex     sync.Mutex
+	connected bool
 }
 
 // NewClient creates a new gpsd client
@@ -36,13 +40,21 @@ func NewClient(addr string) (*Connection, error) {
 	filters := make(map[string]FilterHandler)
 
 	return &Connection{
-		socket:  socket,
-		reader:  reader,
-		filters: filters,
-		close:   make(chan bool),
+		socket:    socket,
+		reader:    reader,
+		filters:   filters,
+		close:     make(chan bool),
+		connected: true,
 	}, nil
 }
 
+// Connected reports whether the connection to gpsd is established. It turns false once reading from gpsd failed.
+func (c *Connection) Connected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
 // Close closes the client connection
 func (c *Connection) Close() {
 	c.close <- true
@@ -149,6 +161,9 @@ func (c *Connection) watchLoop() {
 				}
 			} else {
 				fmt.Println("Error: cannot read from gpsd")
+				c.mutex.Lock()
+				c.connected = false
+				c.mutex.Unlock()
 				return
 			}
 		}
@@ -17,7 +17,6 @@ limitations under the License.
 package main
 
 import (
-	"alm-mqtt-module/pkg/avro"
 	"alm-mqtt-module/pkg/client"
 	"fmt"
 	"log"
@@ -33,39 +32,23 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	client := client.NewClient("alm-mqtt-module", natsClient)
-	res, err := client.RegisterMqttTopic("climate/temperature")
+	c := client.NewClient("alm-mqtt-module", natsClient)
+	subscription, err := c.Subscribe("climate/temperature", func(msg client.Message) {
+		fmt.Printf("%s: %s\n", msg.Topic, string(msg.Payload))
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	fmt.Printf("Subscribed to nats subject '%s'\n", subscription.Subject())
 
 	cleanup := func() {
-		err := client.UnregisterNatsSubject(res.Subject)
+		err := subscription.Unsubscribe()
 		if err != nil {
 			log.Fatal(err)
 		}
 		natsClient.Close()
 	}
 
-	fmt.Printf("Subscribing to nats subject '%s'\n", res.Subject)
-	_, err = natsClient.Subscribe(res.Subject, func(msg *nats.Msg) {
-		avro, err := avro.NewReader(msg.Data)
-		if err != nil {
-			log.Fatal(err)
-		}
-		j, err := avro.ByteString()
-		if err != nil {
-			log.Fatal(err)
-		}
-		if err := msg.Respond([]byte{}); err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("%s\n", string(j))
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	counter := 0
 	for {
 		time.Sleep(time.Second)
@@ -0,0 +1,236 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"alm-mqtt-module/pkg/avro"
+	schema "alm-mqtt-module/pkg/schema"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// deliveryStats counts the messages forwarded by a registration
+type deliveryStats struct {
+	mutex        sync.Mutex
+	delivered    int64
+	failed       int64
+	lastDelivery time.Time
+}
+
+// add counts a message that was forwarded successfully if err is nil and a failed message otherwise
+func (s *deliveryStats) add(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.delivered++
+	s.lastDelivery = time.Now()
+}
+
+// get returns the counters and the time of the last delivery as unix timestamp in milliseconds
+func (s *deliveryStats) get() (delivered int64, failed int64, lastDelivery int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.delivered, s.failed, unixMillis(s.lastDelivery)
+}
+
+// unixMillis converts t to a unix timestamp in milliseconds, the zero time to 0
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// GetRegistrationInfos returns all registrations forwarding MQTT topics and nats subjects sorted by subject and id
+func (c *Config) GetRegistrationInfos() ([]schema.RegistrationInfoType, []schema.NatsRegistrationInfoType) {
+	c.MessageChannelsMutex.Lock()
+	infos := make([]schema.RegistrationInfoType, 0)
+	for topic, mappings := range c.MessageChannels {
+		for _, mapping := range mappings {
+			info := schema.RegistrationInfoType{
+				Subject:   mapping.subject,
+				Topic:     topic,
+				QoS:       int32(mapping.options.QoS),
+				QueueSize: int32(mapping.queue.size),
+				Overflow:  mapping.queue.overflow,
+			}
+			info.Delivered, info.Failed, info.LastDelivery = mapping.stats.get()
+			info.Queued, info.Dropped = mapping.queue.stats()
+			infos = append(infos, info)
+		}
+	}
+	c.MessageChannelsMutex.Unlock()
+
+	c.registrationsMutex.Lock()
+	for i := range infos {
+		if r, ok := c.registrations[infos[i].Subject]; ok {
+			infos[i].Delivery = r.Delivery
+			infos[i].Lease = r.Lease
+		}
+	}
+	c.registrationsMutex.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Subject < infos[j].Subject })
+
+	c.natsRegistrationsMutex.Lock()
+	natsInfos := make([]schema.NatsRegistrationInfoType, 0, len(c.natsRegistrations))
+	for id, r := range c.natsRegistrations {
+		info := schema.NatsRegistrationInfoType{
+			ID:      id,
+			Subject: r.req.Subject,
+			Topic:   r.req.Topic,
+			Lease:   r.req.Lease,
+			QoS:     r.req.QoS,
+		}
+		info.Delivered, info.Failed, info.LastDelivery = r.stats.get()
+		natsInfos = append(natsInfos, info)
+	}
+	c.natsRegistrationsMutex.Unlock()
+	sort.Slice(natsInfos, func(i, j int) bool { return natsInfos[i].ID < natsInfos[j].ID })
+	return infos, natsInfos
+}
+
+// GetTopicInfos returns the MQTT topic filters needed by registrations and pending requests sorted by topic
+func (c *Config) GetTopicInfos() []schema.TopicInfoType {
+	subscriptions := c.GetSubscriptions()
+	infos := make([]schema.TopicInfoType, 0, len(subscriptions))
+	c.MessageChannelsMutex.Lock()
+	for topic, options := range subscriptions {
+		info := schema.TopicInfoType{
+			Topic:    topic,
+			QoS:      int32(options.QoS),
+			Subjects: make([]string, 0),
+		}
+		for _, mapping := range c.MessageChannels[topic] {
+			info.Subjects = append(info.Subjects, mapping.subject)
+		}
+		sort.Strings(info.Subjects)
+		infos = append(infos, info)
+	}
+	c.MessageChannelsMutex.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Topic < infos[j].Topic })
+	return infos
+}
+
+// GetPendingRequests returns all request-reply correlations waiting for responses sorted by start
+func (c *Config) GetPendingRequests() []schema.PendingRequestInfoType {
+	c.requestsMutex.Lock()
+	infos := make([]schema.PendingRequestInfoType, 0, len(c.requests))
+	for id, pending := range c.requests {
+		infos = append(infos, schema.PendingRequestInfoType{
+			ID:            id,
+			Topic:         pending.topic,
+			Mode:          pending.mode,
+			ResponseTopic: pending.responseTopic,
+			Started:       unixMillis(pending.started),
+		})
+	}
+	c.requestsMutex.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started < infos[j].Started })
+	return infos
+}
+
+func (c *Config) adminHandlerRegistrations(msg *nats.Msg) {
+	registrations, natsRegistrations := c.GetRegistrationInfos()
+
+	m := make(map[string]interface{})
+	items := make([]interface{}, 0, len(registrations))
+	for _, r := range registrations {
+		items = append(items, map[string]interface{}{
+			"subject":      r.Subject,
+			"topic":        r.Topic,
+			"delivery":     r.Delivery,
+			"lease":        r.Lease,
+			"qos":          r.QoS,
+			"delivered":    r.Delivered,
+			"failed":       r.Failed,
+			"lastDelivery": r.LastDelivery,
+			"queueSize":    r.QueueSize,
+			"overflow":     r.Overflow,
+			"queued":       r.Queued,
+			"dropped":      r.Dropped,
+		})
+	}
+	m["registrations"] = items
+	items = make([]interface{}, 0, len(natsRegistrations))
+	for _, r := range natsRegistrations {
+		items = append(items, map[string]interface{}{
+			"id":           r.ID,
+			"subject":      r.Subject,
+			"topic":        r.Topic,
+			"lease":        r.Lease,
+			"qos":          r.QoS,
+			"delivered":    r.Delivered,
+			"failed":       r.Failed,
+			"lastDelivery": r.LastDelivery,
+		})
+	}
+	m["natsRegistrations"] = items
+	m["error"] = ""
+
+	r, err := avro.Writer(m, schema.AdminRegistrationsResponseCodec)
+	if err != nil {
+		log.Printf("Failed to create admin registrations response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
+
+func (c *Config) adminHandlerTopics(msg *nats.Msg) {
+	topics := c.GetTopicInfos()
+	pending := c.GetPendingRequests()
+
+	m := make(map[string]interface{})
+	items := make([]interface{}, 0, len(topics))
+	for _, t := range topics {
+		subjects := make([]interface{}, 0, len(t.Subjects))
+		for _, s := range t.Subjects {
+			subjects = append(subjects, s)
+		}
+		items = append(items, map[string]interface{}{
+			"topic":    t.Topic,
+			"qos":      t.QoS,
+			"subjects": subjects,
+		})
+	}
+	m["topics"] = items
+	items = make([]interface{}, 0, len(pending))
+	for _, p := range pending {
+		items = append(items, map[string]interface{}{
+			"id":            p.ID,
+			"topic":         p.Topic,
+			"mode":          p.Mode,
+			"responseTopic": p.ResponseTopic,
+			"started":       p.Started,
+		})
+	}
+	m["pendingRequests"] = items
+	m["error"] = ""
+
+	r, err := avro.Writer(m, schema.AdminTopicsResponseCodec)
+	if err != nil {
+		log.Printf("Failed to create admin topics response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
@@ -50,13 +50,32 @@ func (c *Channels) RegisterSub(topic string) (string, error) {
 	return newChannel, nil
 }
 
+// RegisterSubWithSubject function to register to a MQTT topic with a given nats subject
+func (c *Channels) RegisterSubWithSubject(topic string, subject string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for t := range c.subChannels {
+		for _, s := range c.subChannels[t] {
+			if s == subject {
+				return fmt.Errorf("subject '%s' is already registered", subject)
+			}
+		}
+	}
+	c.subChannels[topic] = append(c.subChannels[topic], subject)
+	return nil
+}
+
 // Get function to get all registered nats subjects for a specific MQTT topic
 func (c *Channels) Get(topic string) []string {
-	return c.subChannels[topic]
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.subChannels[topic]...)
 }
 
 // GetTopic function to get the corresponding MQTT topic to a nats subscription
 func (c *Channels) GetTopic(subject string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	for t := range c.subChannels {
 		for _, s := range c.subChannels[t] {
 			if s == subject {
@@ -17,14 +17,18 @@ limitations under the License.
 package config
 
 import (
+	"alm-mqtt-module/internal/metrics"
+	"alm-mqtt-module/internal/mqtt"
 	"alm-mqtt-module/pkg/avro"
 	schema "alm-mqtt-module/pkg/schema"
 	"sync"
 	"time"
 
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"strings"
 
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/google/uuid"
@@ -46,120 +50,305 @@ type RegisterHandlerConfig struct {
 }
 
 type subjectChannelMapping struct {
-	channel chan []byte
+	queue   *subscriberQueue
 	subject string
+	// options are the subscription options requested by the registration
+	options paho.SubscribeOptions
+	stats   *deliveryStats
 }
 
 // Config type to store configuration
 type Config struct {
-	registerSubRequestCodec    *goavro.Codec
-	registerSubResponseCodec   *goavro.Codec
-	unregisterSubRequestCodec  *goavro.Codec
-	unregisterSubResponseCodec *goavro.Codec
-	pubRequestCodec            *goavro.Codec
-	pubResponseCodec           *goavro.Codec
-	reqRepRequestCodec         *goavro.Codec
-	reqRepResponseCodec        *goavro.Codec
-	nats                       *nats.Conn
-	basename                   string
-	channels                   Channels
-	newConfigRegisterChan      chan string
-	newConfigUnregisterChan    chan string
-	pubChan                    chan paho.Publish
-	MessageChannelsMutex       sync.Mutex
-	MessageChannels            map[string][]subjectChannelMapping
-	subscribed                 map[string]bool
-	RequestResponseMutex       sync.Mutex
-	RequestResponse            map[string]chan []byte
+	registerSubRequestCodec     *goavro.Codec
+	registerSubResponseCodec    *goavro.Codec
+	unregisterSubRequestCodec   *goavro.Codec
+	unregisterSubResponseCodec  *goavro.Codec
+	renewSubResponseCodec       *goavro.Codec
+	registerNatsResponseCodec   *goavro.Codec
+	unregisterNatsResponseCodec *goavro.Codec
+	pubRequestCodec             *goavro.Codec
+	pubResponseCodec            *goavro.Codec
+	reqRepRequestCodec          *goavro.Codec
+	reqRepResponseCodec         *goavro.Codec
+	reqResCancelResponseCodec   *goavro.Codec
+	nats                        *nats.Conn
+	basename                    string
+	instance                    string
+	channels                    Channels
+	newConfigRegisterChan       chan string
+	newConfigUnregisterChan     chan string
+	pubChan                     chan paho.Publish
+	MessageChannelsMutex        sync.Mutex
+	MessageChannels             map[string][]subjectChannelMapping
+	requestsMutex               sync.Mutex
+	requests                    map[string]*pendingRequest
+	cancelledRequests           map[string]time.Time
+	responseTopics              map[string]int
+	leasesMutex                 sync.Mutex
+	leases                      map[string]*lease
+	jsMutex                     sync.Mutex
+	js                          nats.JetStreamContext
+	natsRegistrationsMutex      sync.Mutex
+	natsRegistrations           map[string]*natsRegistration
+	registrationsMutex          sync.Mutex
+	registrations               map[string]registration
+	storedNatsRegistrations     map[string]storedNatsRegistration
+	registrationsFile           string
+	protocolVersion             ProtocolVersionFunc
+	publish                     PublishFunc
+	spoolState                  SpoolStateFunc
 }
 
 // NewConfig creates a new config containing all channel definitions
 func NewConfig(basename string, natsConn *nats.Conn, newConfigRegisterChan, newConfigUnregisterChan chan string, pubChan chan paho.Publish) *Config {
 	return &Config{
-		registerSubRequestCodec:    schema.RegisterSubRequestCodec,
-		registerSubResponseCodec:   schema.RegisterSubResponseCodec,
-		unregisterSubRequestCodec:  schema.UnregisterSubRequestCodec,
-		unregisterSubResponseCodec: schema.UnregisterSubResponseCodec,
-		pubRequestCodec:            schema.PubRequestCodec,
-		pubResponseCodec:           schema.PubResponseCodec,
-		reqRepRequestCodec:         schema.ReqResRequestCodec,
-		reqRepResponseCodec:        schema.ReqResResponseCodec,
-		nats:                       natsConn,
-		basename:                   basename,
-		channels:                   NewChannels(basename),
-		newConfigRegisterChan:      newConfigRegisterChan,
-		newConfigUnregisterChan:    newConfigUnregisterChan,
-		pubChan:                    pubChan,
-		MessageChannels:            make(map[string][]subjectChannelMapping),
-		subscribed:                 make(map[string]bool),
-		RequestResponse:            make(map[string]chan []byte),
+		registerSubRequestCodec:     schema.RegisterSubRequestCodec,
+		registerSubResponseCodec:    schema.RegisterSubResponseCodec,
+		unregisterSubRequestCodec:   schema.UnregisterSubRequestCodec,
+		unregisterSubResponseCodec:  schema.UnregisterSubResponseCodec,
+		renewSubResponseCodec:       schema.RenewSubResponseCodec,
+		registerNatsResponseCodec:   schema.RegisterNatsResponseCodec,
+		unregisterNatsResponseCodec: schema.UnregisterNatsResponseCodec,
+		pubRequestCodec:             schema.PubRequestCodec,
+		pubResponseCodec:            schema.PubResponseCodec,
+		reqRepRequestCodec:          schema.ReqResRequestCodec,
+		reqRepResponseCodec:         schema.ReqResResponseCodec,
+		reqResCancelResponseCodec:   schema.ReqResCancelResponseCodec,
+		nats:                        natsConn,
+		basename:                    basename,
+		instance:                    uuid.New().String(),
+		channels:                    NewChannels(basename),
+		newConfigRegisterChan:       newConfigRegisterChan,
+		newConfigUnregisterChan:     newConfigUnregisterChan,
+		pubChan:                     pubChan,
+		MessageChannels:             make(map[string][]subjectChannelMapping),
+		requests:                    make(map[string]*pendingRequest),
+		cancelledRequests:           make(map[string]time.Time),
+		responseTopics:              make(map[string]int),
+		leases:                      make(map[string]*lease),
+		natsRegistrations:           make(map[string]*natsRegistration),
+		registrations:               make(map[string]registration),
+		storedNatsRegistrations:     make(map[string]storedNatsRegistration),
 	}
 }
 
 func (c *Config) configHandlerRegister(msg *nats.Msg) {
-	req := parseConfigRegisterRequest(msg)
+	req, err := parseConfigRegisterRequest(msg)
+	if err != nil {
+		fmt.Printf("Invalid register request: %s\n", err)
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+		return
+	}
 	fmt.Printf("Register for '%s'\n", req.Topic)
-	subject, err := c.channels.RegisterSub(req.Topic)
 
-	var errText string = ""
-	if err != nil {
+	if err := ValidateTopicFilter(req.Topic); err != nil {
 		fmt.Println(err)
-		errText = err.Error()
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+		return
+	}
+	if req.Lease < 0 {
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: "lease must not be negative"})
+		return
+	}
+	if err := validateSubscribeOptions(req); err != nil {
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+		return
+	}
+	if err := c.validateRegisterProtocol(req); err != nil {
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+		return
+	}
+	if err := validateQueueOptions(req); err != nil {
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+		return
+	}
+	if req.Delivery == schema.DeliveryModePublish && req.Lease == 0 {
+		// without acknowledge, the lease is the only way to detect gone subscribers
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: "delivery mode 'publish' requires a lease"})
+		return
+	}
+
+	var subject string
+	if req.Subject != "" && req.Delivery == schema.DeliveryModeStream {
+		c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: "subject is not supported with delivery mode 'stream', use streamSubject"})
+		return
+	}
+	if req.Delivery == schema.DeliveryModeStream {
+		if err := c.validateStreamRequest(req); err != nil {
+			c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+			return
+		}
+		subject = c.streamSubject(req)
+		if err := c.channels.RegisterSubWithSubject(req.Topic, subject); err != nil {
+			if req.StreamSubject == "" {
+				err = fmt.Errorf("stream '%s' is already registered with the default subject, use streamSubject", req.Stream)
+			}
+			c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+			return
+		}
+		if err := c.ensureStream(req, subject); err != nil {
+			fmt.Println(err)
+			if _, err := c.channels.UnregisterSub(subject); err != nil {
+				fmt.Println(err)
+			}
+			c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+			return
+		}
+	} else if req.Subject != "" {
+		if err := c.validateRequestedSubject(req.Subject); err != nil {
+			c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+			return
+		}
+		subject = req.Subject
+		if err := c.channels.RegisterSubWithSubject(req.Topic, subject); err != nil {
+			c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+			return
+		}
+	} else {
+		subject, err = c.channels.RegisterSub(req.Topic)
+		if err != nil {
+			fmt.Println(err)
+			c.respondConfigRegister(msg, schema.RegisterSubResponseType{Error: err.Error()})
+			return
+		}
+	}
+
+	granted := c.register(req, subject)
+
+	c.respondConfigRegister(msg, schema.RegisterSubResponseType{
+		Subject: subject,
+		Lease:   int32(granted / time.Millisecond),
+	})
+	c.newConfigRegisterChan <- req.Topic
+}
+
+// validateRequestedSubject checks that a subject requested by a client has the form of the subjects created
+// by the module, so that clients cannot capture other subjects
+func (c *Config) validateRequestedSubject(subject string) error {
+	prefix := c.basename + subjectTokenSeparator
+	if !strings.HasPrefix(subject, prefix) {
+		return fmt.Errorf("invalid subject '%s': must be '%s<uuid>'", subject, prefix)
 	}
+	if _, err := uuid.Parse(strings.TrimPrefix(subject, prefix)); err != nil {
+		return fmt.Errorf("invalid subject '%s': must be '%s<uuid>'", subject, prefix)
+	}
+	return nil
+}
+
+// register starts forwarding messages of a topic to a subject that is already registered in channels.
+// The granted lease is returned.
+func (c *Config) register(req schema.RegisterSubRequestType, subject string) time.Duration {
 	subjectChannelMapping := subjectChannelMapping{
-		channel: make(chan []byte, 20),
+		queue:   newSubscriberQueue(int(req.QueueSize), req.Overflow),
 		subject: subject,
+		options: subscribeOptions(req),
+		stats:   &deliveryStats{},
 	}
 	c.MessageChannelsMutex.Lock()
 	c.MessageChannels[req.Topic] = append(c.MessageChannels[req.Topic], subjectChannelMapping)
 	c.MessageChannelsMutex.Unlock()
-	c.subscribed[subject] = true
-	go func(channel chan []byte, subject string) {
-		for {
-			avro, ok := <-channel
-			if !ok {
-				break
+
+	var granted time.Duration
+	leased := req.Lease > 0
+	if leased {
+		granted = c.startLease(subject, time.Duration(req.Lease)*time.Millisecond, func() {
+			fmt.Printf("Lease of subject '%s' expired. Unregistering.\n", subject)
+			if _, err := c.cleanupSubject(subject); err != nil {
+				fmt.Println(err)
 			}
+		})
+	}
+	c.storeRegistration(subject, req)
 
-			fmt.Printf("\t-> nats '%s'\n", subject)
+	go c.forward(subjectChannelMapping.queue, subject, leased, req.Delivery, subjectChannelMapping.stats)
+	return granted
+}
 
-			if c.subscribed[subject] {
-				_, err = c.nats.Request(subject, avro, time.Duration(timeout)*time.Second)
-				if err != nil {
-					fmt.Printf("Subject '%s' timed out. Unregistering.\n", subject)
-					_, err := c.cleanupSubject(subject)
+// forward sends all messages arriving in queue to the nats subject of a registration
+func (c *Config) forward(queue *subscriberQueue, subject string, leased bool, delivery string, stats *deliveryStats) {
+	for {
+		msg, ok := queue.pop()
+		if !ok {
+			break
+		}
+		avro := msg.data
 
-					if err != nil {
-						log.Fatal(err)
-					}
-					break
-				}
+		fmt.Printf("\t-> nats '%s'\n", subject)
+
+		switch delivery {
+		case schema.DeliveryModePublish:
+			err := c.nats.Publish(subject, avro)
+			stats.add(err)
+			observeDelivery(delivery, msg.received, err)
+			if err != nil {
+				fmt.Printf("Publishing to subject '%s' failed: %s\n", subject, err)
+			}
+			continue
+		case schema.DeliveryModeStream:
+			err := c.publishToStream(subject, avro)
+			stats.add(err)
+			observeDelivery(delivery, msg.received, err)
+			if err != nil {
+				fmt.Printf("Storing message for subject '%s' failed: %s\n", subject, err)
 			}
+			continue
 		}
-	}(subjectChannelMapping.channel, subject)
 
-	res := schema.RegisterSubResponseType{
-		Subject: subject,
-		Error:   errText,
+		// the registration may have been removed while the message was forwarded
+		if !queue.isClosed() {
+			_, err := c.nats.Request(subject, avro, time.Duration(timeout)*time.Second)
+			stats.add(err)
+			observeDelivery(delivery, msg.received, err)
+			if err != nil && leased {
+				// lease based registrations are only removed when the lease expires
+				fmt.Printf("Subject '%s' timed out. Dropping message.\n", subject)
+			} else if err != nil {
+				fmt.Printf("Subject '%s' timed out. Unregistering.\n", subject)
+				_, err := c.cleanupSubject(subject)
+
+				if err != nil {
+					fmt.Println(err)
+				}
+				break
+			}
+		}
 	}
-	r, err := c.createConfigRegisterResponse(res)
+}
+
+// observeDelivery updates the delivery metrics with a message received at received and forwarded with result err
+func observeDelivery(delivery string, received time.Time, err error) {
 	if err != nil {
-		log.Fatal(err)
+		metrics.DeliveryFailures.WithLabelValues(delivery).Inc()
+		if errors.Is(err, nats.ErrTimeout) {
+			metrics.DeliveryTimeouts.Inc()
+		}
+		return
 	}
-	err = msg.Respond(r)
+	metrics.MessagesDelivered.WithLabelValues(delivery).Inc()
+	metrics.DeliveryLatency.WithLabelValues(delivery).Observe(time.Since(received).Seconds())
+}
+
+func (c *Config) respondConfigRegister(msg *nats.Msg, res schema.RegisterSubResponseType) {
+	r, err := c.createConfigRegisterResponse(res)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to create register response: %s", err)
+		return
 	}
-	c.newConfigRegisterChan <- req.Topic
+	respond(msg, r)
 }
 
 func (c *Config) configHandlerUnregister(msg *nats.Msg) {
 	var errText string = ""
-	req := parseConfigUnregisterRequest(msg)
-	fmt.Printf("Unregister for '%s'\n", req.Subject)
-	_, err := c.cleanupSubject(req.Subject)
+	req, err := parseConfigUnregisterRequest(msg)
 	if err != nil {
+		fmt.Printf("Invalid unregister request: %s\n", err)
 		errText = err.Error()
+	} else {
+		fmt.Printf("Unregister for '%s'\n", req.Subject)
+		_, err = c.cleanupSubject(req.Subject)
+		if err != nil {
+			errText = err.Error()
+		}
 	}
 
 	res := schema.UnregisterSubResponseType{
@@ -167,42 +356,96 @@ func (c *Config) configHandlerUnregister(msg *nats.Msg) {
 	}
 	r, err := c.createConfigUnregisterResponse(res)
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = msg.Respond(r)
-	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to create unregister response: %s", err)
+		return
 	}
+	respond(msg, r)
 }
 
-func (c *Config) handlerPublish(msg *nats.Msg) {
-	var errText string = ""
-	req := parsePublishRequest(msg)
-	fmt.Printf("Received Publish Request for '%s'\n", req.Topic)
+// PublishFunc publishes a message on the broker. It reports whether the message was spooled.
+type PublishFunc func(pub *paho.Publish) (bool, error)
 
-	if req.Topic == "" {
-		errText = "Empty topic received"
-	} else {
-		pub := paho.Publish{
-			QoS:        1,
-			Retain:     false,
-			Topic:      req.Topic,
-			Properties: &paho.PublishProperties{},
-			Payload:    req.Payload,
+// SpoolStateFunc returns the state of the publish spool
+type SpoolStateFunc func() mqtt.SpoolState
+
+// SetPublisher sets the functions used to publish the messages of publish requests and to report the state of the
+// publish spool in the response. Without publisher the messages are sent to pubChan.
+func (c *Config) SetPublisher(publish PublishFunc, spoolState SpoolStateFunc) {
+	c.publish = publish
+	c.spoolState = spoolState
+}
+
+func (c *Config) handlerPublish(msg *nats.Msg) {
+	var res schema.PubResponseType
+	req, err := parsePublishRequest(msg)
+	if err != nil {
+		fmt.Printf("Invalid publish request: %s\n", err)
+		res.Error = err.Error()
+	} else if err := validatePublishRequest(req); err != nil {
+		fmt.Println(err)
+		res.Error = err.Error()
+	} else if err := c.validatePublishProtocol(req); err != nil {
+		fmt.Println(err)
+		res.Error = err.Error()
+	} else if c.publish != nil {
+		fmt.Printf("Received Publish Request for '%s'\n", req.Topic)
+		pub := newPublish(req)
+		if res.Spooled, err = c.publish(&pub); err != nil {
+			fmt.Printf("Failed to publish message to topic '%s': %s\n", pub.Topic, err)
+			res.Error = err.Error()
+			res.Spooled = false
 		}
-		c.pubChan <- pub
+	} else {
+		fmt.Printf("Received Publish Request for '%s'\n", req.Topic)
+		c.pubChan <- newPublish(req)
 	}
 
-	res := schema.PubResponseType{
-		Error: errText,
+	if c.spoolState != nil {
+		state := c.spoolState()
+		res.SpoolMessages = int32(state.Messages)
+		res.SpoolBytes = state.Bytes
+		res.SpoolDropped = state.Dropped
 	}
 	r, err := c.createPublishResponse(res)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to create publish response: %s", err)
+		return
 	}
-	err = msg.Respond(r)
-	if err != nil {
-		log.Fatal(err)
+	respond(msg, r)
+}
+
+// validatePublishRequest checks topic, QoS and message expiry of a publish request
+func validatePublishRequest(req schema.PubRequestType) error {
+	if err := ValidateTopicName(req.Topic); err != nil {
+		return err
+	}
+	if req.QoS < 0 || req.QoS > 2 {
+		return fmt.Errorf("invalid QoS %d", req.QoS)
+	}
+	if req.MessageExpiry < 0 || req.MessageExpiry > math.MaxUint32 {
+		return fmt.Errorf("invalid message expiry %d", req.MessageExpiry)
+	}
+	return nil
+}
+
+// newPublish creates the MQTT message of a publish request
+func newPublish(req schema.PubRequestType) paho.Publish {
+	properties := &paho.PublishProperties{
+		ContentType: req.ContentType,
+	}
+	if req.MessageExpiry > 0 {
+		expiry := uint32(req.MessageExpiry)
+		properties.MessageExpiry = &expiry
+	}
+	for _, p := range req.UserProperties {
+		properties.User.Add(p.Key, p.Value)
+	}
+	return paho.Publish{
+		QoS:        byte(req.QoS),
+		Retain:     req.Retain,
+		Topic:      req.Topic,
+		Properties: properties,
+		Payload:    req.Payload,
 	}
 }
 
@@ -213,72 +456,53 @@ func (c *Config) handlerRequestResponse(msg *nats.Msg) {
 	go func(msg *nats.Msg) {
 		var errText string = ""
 		var responsePayload []byte
-		req := parseRequestRepsonseResponse(msg)
-		fmt.Printf("Received Request Repsonse Request for '%s'\n", req.Topic)
-
-		if req.Topic == "" {
-			errText = "Empty topic received"
-		} else if req.Timeout == 0 {
-			errText = "timeout is zero"
+		req, err := parseRequestRepsonseResponse(msg)
+		if err != nil {
+			fmt.Printf("Invalid request response request: %s\n", err)
+			errText = err.Error()
+		} else if err := ValidateTopicName(req.Topic); err != nil {
+			fmt.Println(err)
+			errText = err.Error()
+		} else if req.Timeout <= 0 {
+			errText = "timeout must be greater than zero"
+		} else if err := validateRequestMode(req); err != nil {
+			fmt.Println(err)
+			errText = err.Error()
+		} else if err := c.validateRequestProtocol(req); err != nil {
+			fmt.Println(err)
+			errText = err.Error()
+		} else if req.Inbox != "" {
+			fmt.Printf("Received Request Repsonse Request for '%s' relaying responses to '%s'\n", req.Topic, req.Inbox)
+			c.respondRequestResponse(msg, schema.ReqResResponsetType{})
+			c.streamResponses(req)
+			return
 		} else {
-
-			// channel to capture response
-			response := make(chan []byte)
-
-			// Create uuid as correlation data
-			id := uuid.New()
-
-			// Store response in map
-			c.RequestResponseMutex.Lock()
-			c.RequestResponse[id.String()] = response
-			c.RequestResponseMutex.Unlock()
-
-			// Create response topic
-			responseTopic := fmt.Sprintf("%s%s", ResponseTopicStart, req.Topic)
-			// Send out request
-			pub := paho.Publish{
-				QoS:    1,
-				Retain: false,
-				Topic:  req.Topic,
-				Properties: &paho.PublishProperties{
-					CorrelationData: []byte(id.String()),
-					ResponseTopic:   responseTopic,
-				},
-				Payload: req.Payload,
-			}
-			c.pubChan <- pub
-
-			// Wait for response to arrive
-			select {
-			case res := <-response:
-				fmt.Println("Received Response")
-				responsePayload = res
-			case <-time.After(time.Duration(req.Timeout) * time.Millisecond):
-				fmt.Println("Timeout expired")
-				errText = "timeout expired"
-			}
-
-			// Remove response from map
-			c.RequestResponseMutex.Lock()
-			delete(c.RequestResponse, id.String())
-			c.RequestResponseMutex.Unlock()
+			fmt.Printf("Received Request Repsonse Request for '%s'\n", req.Topic)
+			responsePayload, errText = c.requestResponse(req)
 		}
 
-		res := schema.ReqResResponsetType{
+		c.respondRequestResponse(msg, schema.ReqResResponsetType{
 			Error:   errText,
 			Payload: responsePayload,
-		}
-		r, err := c.createRequestResponseResponse(res)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = msg.Respond(r)
-		if err != nil {
-			log.Fatal(err)
-		}
+		})
 	}(msg)
 }
 
+func (c *Config) respondRequestResponse(msg *nats.Msg, res schema.ReqResResponsetType) {
+	r, err := c.createRequestResponseResponse(res)
+	if err != nil {
+		log.Printf("Failed to create request response response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
+
+func respond(msg *nats.Msg, data []byte) {
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to respond to request on '%s': %s", msg.Subject, err)
+	}
+}
+
 func removeFromSubjectChannelMappingSlice(s []subjectChannelMapping, i int) []subjectChannelMapping {
 	s[i] = s[len(s)-1]
 	return s[:len(s)-1]
@@ -287,6 +511,7 @@ func removeFromSubjectChannelMappingSlice(s []subjectChannelMapping, i int) []su
 func (c *Config) createConfigRegisterResponse(res schema.RegisterSubResponseType) ([]byte, error) {
 	msg := make(map[string]interface{})
 	msg["subject"] = res.Subject
+	msg["lease"] = res.Lease
 	msg["error"] = res.Error
 	return avro.Writer(msg, c.registerSubResponseCodec)
 }
@@ -297,9 +522,20 @@ func (c *Config) createConfigUnregisterResponse(res schema.UnregisterSubResponse
 	return avro.Writer(msg, c.unregisterSubResponseCodec)
 }
 
+func (c *Config) createConfigRenewResponse(res schema.RenewSubResponseType) ([]byte, error) {
+	msg := make(map[string]interface{})
+	msg["lease"] = res.Lease
+	msg["error"] = res.Error
+	return avro.Writer(msg, c.renewSubResponseCodec)
+}
+
 func (c *Config) createPublishResponse(res schema.PubResponseType) ([]byte, error) {
 	msg := make(map[string]interface{})
 	msg["error"] = res.Error
+	msg["spooled"] = res.Spooled
+	msg["spoolMessages"] = res.SpoolMessages
+	msg["spoolBytes"] = res.SpoolBytes
+	msg["spoolDropped"] = res.SpoolDropped
 	return avro.Writer(msg, c.pubResponseCodec)
 }
 
@@ -307,76 +543,320 @@ func (c *Config) createRequestResponseResponse(res schema.ReqResResponsetType) (
 	msg := make(map[string]interface{})
 	msg["error"] = res.Error
 	msg["payload"] = res.Payload
+	msg["end"] = res.End
 	return avro.Writer(msg, c.reqRepResponseCodec)
 }
 
-func parseConfigRegisterRequest(msg *nats.Msg) schema.RegisterSubRequestType {
-	avro, err := avro.NewReader(msg.Data)
+func parseConfigRegisterRequest(msg *nats.Msg) (schema.RegisterSubRequestType, error) {
+	m, err := decodeRequest(msg.Data)
 	if err != nil {
-		log.Fatal(err)
+		return schema.RegisterSubRequestType{}, err
 	}
-	j, err := avro.ByteString()
+	topic, err := getString(m, "topic")
 	if err != nil {
-		log.Fatal(err)
+		return schema.RegisterSubRequestType{}, err
+	}
+	// lease is optional for clients using the schema without lease
+	var lease int32
+	if _, ok := m["lease"]; ok {
+		lease, err = getInt32(m, "lease")
+		if err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
 	}
-	res := schema.RegisterSubRequestType{}
-	err = json.Unmarshal(j, &res)
+	// delivery is optional for clients using the schema without delivery mode
+	delivery := schema.DeliveryModeAck
+	if _, ok := m["delivery"]; ok {
+		delivery, err = getString(m, "delivery")
+		if err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+		if delivery != schema.DeliveryModeAck && delivery != schema.DeliveryModePublish && delivery != schema.DeliveryModeStream {
+			return schema.RegisterSubRequestType{}, fmt.Errorf("unknown delivery mode '%s'", delivery)
+		}
+	}
+	req := schema.RegisterSubRequestType{
+		Topic:    topic,
+		Lease:    lease,
+		Delivery: delivery,
+		QoS:      1,
+		Overflow: schema.OverflowDropOldest,
+	}
+	// stream settings are optional for clients using the schema without streams
+	if _, ok := m["stream"]; ok {
+		if req.Stream, err = getString(m, "stream"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["streamSubject"]; ok {
+		if req.StreamSubject, err = getString(m, "streamSubject"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["maxAge"]; ok {
+		if req.MaxAge, err = getInt64(m, "maxAge"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["maxMsgs"]; ok {
+		if req.MaxMsgs, err = getInt64(m, "maxMsgs"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["maxBytes"]; ok {
+		if req.MaxBytes, err = getInt64(m, "maxBytes"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	// subscription options are optional for clients using the schema without them
+	if _, ok := m["qos"]; ok {
+		if req.QoS, err = getInt32(m, "qos"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["noLocal"]; ok {
+		if req.NoLocal, err = getBool(m, "noLocal"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["retainAsPublished"]; ok {
+		if req.RetainAsPublished, err = getBool(m, "retainAsPublished"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["retainHandling"]; ok {
+		if req.RetainHandling, err = getInt32(m, "retainHandling"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	// queue options are optional for clients using the schema without them
+	if _, ok := m["queueSize"]; ok {
+		if req.QueueSize, err = getInt32(m, "queueSize"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["overflow"]; ok {
+		if req.Overflow, err = getString(m, "overflow"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	if _, ok := m["subject"]; ok {
+		if req.Subject, err = getString(m, "subject"); err != nil {
+			return schema.RegisterSubRequestType{}, err
+		}
+	}
+	return req, nil
+}
+
+func parseConfigRenewRequest(msg *nats.Msg) (schema.RenewSubRequestType, error) {
+	m, err := decodeRequest(msg.Data)
 	if err != nil {
-		log.Fatal(err)
+		return schema.RenewSubRequestType{}, err
 	}
-	return res
+	subject, err := getString(m, "subject")
+	if err != nil {
+		return schema.RenewSubRequestType{}, err
+	}
+	return schema.RenewSubRequestType{
+		Subject: subject,
+	}, nil
 }
 
-func parseConfigUnregisterRequest(msg *nats.Msg) schema.UnregisterSubRequestType {
-	avro, err := avro.NewReader(msg.Data)
+func parseConfigUnregisterRequest(msg *nats.Msg) (schema.UnregisterSubRequestType, error) {
+	m, err := decodeRequest(msg.Data)
 	if err != nil {
-		log.Fatal(err)
+		return schema.UnregisterSubRequestType{}, err
 	}
-	j, err := avro.ByteString()
+	subject, err := getString(m, "subject")
 	if err != nil {
-		log.Fatal(err)
+		return schema.UnregisterSubRequestType{}, err
+	}
+	return schema.UnregisterSubRequestType{
+		Subject: subject,
+	}, nil
+}
+
+func parsePublishRequest(msg *nats.Msg) (schema.PubRequestType, error) {
+	m, err := decodeRequest(msg.Data)
+	if err != nil {
+		return schema.PubRequestType{}, err
 	}
-	res := schema.UnregisterSubRequestType{}
-	err = json.Unmarshal(j, &res)
+	topic, err := getString(m, "topic")
 	if err != nil {
-		log.Fatal(err)
+		return schema.PubRequestType{}, err
+	}
+	payload, err := getBytes(m, "payload")
+	if err != nil {
+		return schema.PubRequestType{}, err
+	}
+	req := schema.PubRequestType{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     1,
+	}
+	// options are optional for clients using the schema without options
+	if _, ok := m["qos"]; ok {
+		if req.QoS, err = getInt32(m, "qos"); err != nil {
+			return schema.PubRequestType{}, err
+		}
+	}
+	if _, ok := m["retain"]; ok {
+		if req.Retain, err = getBool(m, "retain"); err != nil {
+			return schema.PubRequestType{}, err
+		}
+	}
+	if _, ok := m["contentType"]; ok {
+		if req.ContentType, err = getString(m, "contentType"); err != nil {
+			return schema.PubRequestType{}, err
+		}
+	}
+	if _, ok := m["messageExpiry"]; ok {
+		if req.MessageExpiry, err = getInt64(m, "messageExpiry"); err != nil {
+			return schema.PubRequestType{}, err
+		}
 	}
-	return res
+	if _, ok := m["userProperties"]; ok {
+		if req.UserProperties, err = getUserProperties(m, "userProperties"); err != nil {
+			return schema.PubRequestType{}, err
+		}
+	}
+	return req, nil
 }
 
-func parsePublishRequest(msg *nats.Msg) schema.PubRequestType {
-	avro, err := avro.NewReader(msg.Data)
+func parseRequestRepsonseResponse(msg *nats.Msg) (schema.ReqResRequestType, error) {
+	m, err := decodeRequest(msg.Data)
 	if err != nil {
-		log.Fatal(err)
+		return schema.ReqResRequestType{}, err
+	}
+	topic, err := getString(m, "topic")
+	if err != nil {
+		return schema.ReqResRequestType{}, err
+	}
+	payload, err := getBytes(m, "payload")
+	if err != nil {
+		return schema.ReqResRequestType{}, err
+	}
+	timeout, err := getInt32(m, "timeout")
+	if err != nil {
+		return schema.ReqResRequestType{}, err
+	}
+	req := schema.ReqResRequestType{
+		Topic:   topic,
+		Payload: payload,
+		Timeout: timeout,
+		Mode:    schema.RequestModeProperties,
+	}
+	if _, ok := m["mode"]; ok {
+		if req.Mode, err = getString(m, "mode"); err != nil {
+			return schema.ReqResRequestType{}, err
+		}
+	}
+	if _, ok := m["responseTopic"]; ok {
+		if req.ResponseTopic, err = getString(m, "responseTopic"); err != nil {
+			return schema.ReqResRequestType{}, err
+		}
+	}
+	if _, ok := m["correlationField"]; ok {
+		if req.CorrelationField, err = getString(m, "correlationField"); err != nil {
+			return schema.ReqResRequestType{}, err
+		}
 	}
+	if _, ok := m["id"]; ok {
+		if req.ID, err = getString(m, "id"); err != nil {
+			return schema.ReqResRequestType{}, err
+		}
+	}
+	if _, ok := m["inbox"]; ok {
+		if req.Inbox, err = getString(m, "inbox"); err != nil {
+			return schema.ReqResRequestType{}, err
+		}
+	}
+	if _, ok := m["endMarker"]; ok {
+		if req.EndMarker, err = getString(m, "endMarker"); err != nil {
+			return schema.ReqResRequestType{}, err
+		}
+	}
+	return req, nil
+}
 
-	m, err := avro.Map()
+// decodeRequest decodes an avro OCF encoded request into a map of its fields
+func decodeRequest(data []byte) (map[string]interface{}, error) {
+	reader, err := avro.NewReader(data)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cannot decode request: %v", err)
 	}
+	m, err := reader.Map()
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode request: %v", err)
+	}
+	if m == nil {
+		return nil, fmt.Errorf("cannot decode request: no data")
+	}
+	return m, nil
+}
 
-	return schema.PubRequestType{
-		Topic:   m["topic"].(string),
-		Payload: m["payload"].([]byte),
+func getString(m map[string]interface{}, field string) (string, error) {
+	v, ok := m[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field '%s' missing or not of type string", field)
 	}
+	return v, nil
 }
 
-func parseRequestRepsonseResponse(msg *nats.Msg) schema.ReqResRequestType {
-	avro, err := avro.NewReader(msg.Data)
-	if err != nil {
-		log.Fatal(err)
+func getBytes(m map[string]interface{}, field string) ([]byte, error) {
+	v, ok := m[field].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("field '%s' missing or not of type bytes", field)
 	}
+	return v, nil
+}
 
-	m, err := avro.Map()
-	if err != nil {
-		log.Fatal(err)
+func getBool(m map[string]interface{}, field string) (bool, error) {
+	v, ok := m[field].(bool)
+	if !ok {
+		return false, fmt.Errorf("field '%s' missing or not of type boolean", field)
+	}
+	return v, nil
+}
+
+func getInt32(m map[string]interface{}, field string) (int32, error) {
+	v, ok := m[field].(int32)
+	if !ok {
+		return 0, fmt.Errorf("field '%s' missing or not of type int", field)
 	}
+	return v, nil
+}
 
-	return schema.ReqResRequestType{
-		Topic:   m["topic"].(string),
-		Payload: m["payload"].([]byte),
-		Timeout: m["timeout"].(int32),
+func getInt64(m map[string]interface{}, field string) (int64, error) {
+	v, ok := m[field].(int64)
+	if !ok {
+		return 0, fmt.Errorf("field '%s' missing or not of type long", field)
 	}
+	return v, nil
+}
+
+func getUserProperties(m map[string]interface{}, field string) ([]schema.UserProperty, error) {
+	items, ok := m[field].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field '%s' missing or not of type array", field)
+	}
+	properties := make([]schema.UserProperty, 0, len(items))
+	for _, item := range items {
+		p, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("field '%s' contains an item not of type record", field)
+		}
+		key, err := getString(p, "key")
+		if err != nil {
+			return nil, err
+		}
+		value, err := getString(p, "value")
+		if err != nil {
+			return nil, err
+		}
+		properties = append(properties, schema.UserProperty{Key: key, Value: value})
+	}
+	return properties, nil
 }
 
 // HandleConfigRequests registeres for configuration requests on the nats server
@@ -387,6 +867,46 @@ func (c *Config) HandleConfigRequests() {
 	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.config.unregister", c.basename), c.configHandlerUnregister); err != nil {
 		log.Fatal(err)
 	}
+	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.config.renew", c.basename), c.configHandlerRenew); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.config.register-nats", c.basename), c.configHandlerRegisterNats); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.config.unregister-nats", c.basename), c.configHandlerUnregisterNats); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// HandleAdminRequests registers handlers for inspecting the registrations on the nats server
+func (c *Config) HandleAdminRequests() {
+	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.admin.registrations", c.basename), c.adminHandlerRegistrations); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.admin.topics", c.basename), c.adminHandlerTopics); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// AnnounceStart publishes the start of the module on `<basename>.lifecycle`, so that clients register again.
+// Must be called after all requests are handled.
+func (c *Config) AnnounceStart() {
+	msg := make(map[string]interface{})
+	msg["event"] = schema.LifecycleEventStarted
+	msg["instance"] = c.instance
+	msg["time"] = time.Now().UnixNano() / int64(time.Millisecond)
+	data, err := avro.Writer(msg, schema.LifecycleCodec)
+	if err != nil {
+		log.Printf("Failed to create lifecycle event: %s", err)
+		return
+	}
+	// the handlers must be subscribed before clients react on the event
+	if err := c.nats.Flush(); err != nil {
+		log.Printf("Failed to flush subscriptions: %s", err)
+	}
+	if err := c.nats.Publish(fmt.Sprintf("%s.lifecycle", c.basename), data); err != nil {
+		log.Printf("Failed to announce start: %s", err)
+	}
 }
 
 // HandlePublishRequests register handler for publish requests on the nats server
@@ -401,6 +921,9 @@ func (c *Config) HandleRequestResponse() {
 	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.request-response", c.basename), c.handlerRequestResponse); err != nil {
 		log.Fatal(err)
 	}
+	if _, err := c.nats.Subscribe(fmt.Sprintf("%s.request-response.cancel", c.basename), c.handlerRequestResponseCancel); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // GetRegistrations gets all client registrations for a specific topic
@@ -408,37 +931,64 @@ func (c *Config) GetRegistrations(topic string) []string {
 	return c.channels.Get(topic)
 }
 
-// GetChannelsForTopic returns all go channels that feed the handling routines of all nats subscriptions for a given topic
-func (c *Config) GetChannelsForTopic(topic string) map[string]chan []byte {
-	ret := make(map[string]chan []byte)
-	for _, mapping := range c.MessageChannels[topic] {
-		ret[mapping.subject] = mapping.channel
+// GetTopics returns all MQTT topic filters that currently have at least one registration
+func (c *Config) GetTopics() []string {
+	c.MessageChannelsMutex.Lock()
+	defer c.MessageChannelsMutex.Unlock()
+	topics := make([]string, 0, len(c.MessageChannels))
+	for topic := range c.MessageChannels {
+		topics = append(topics, topic)
 	}
-	return ret
+	return topics
+}
+
+// getQueuesForTopic returns the queues that feed the handling routines of all nats subscriptions
+// whose registered topic filter matches the given concrete topic, together with the matching filters.
+// Retained messages are not passed to registrations that requested to not receive retained messages.
+// Must be called with MessageChannelsMutex held.
+func (c *Config) getQueuesForTopic(topic string, retained bool) (map[string]*subscriberQueue, []string) {
+	ret := make(map[string]*subscriberQueue)
+	var filters []string
+	for filter, mappings := range c.MessageChannels {
+		if !MatchTopic(filter, topic) {
+			continue
+		}
+		filters = append(filters, filter)
+		// with retain as published, the retain flag is also set on messages that are not sent on subscribe
+		options, _ := c.subscriptionOptions(filter)
+		for _, mapping := range mappings {
+			if retained && !options.RetainAsPublished && mapping.options.RetainHandling == retainHandlingNever {
+				continue
+			}
+			ret[mapping.subject] = mapping.queue
+		}
+	}
+	return ret, filters
 }
 
 func (c *Config) cleanupSubject(subject string) (string, error) {
-	var err error
-	delete(c.subscribed, subject)
-	topic, err := c.channels.GetTopic(subject)
+	c.stopLease(subject)
+	topic, err := c.channels.UnregisterSub(subject)
 	if err != nil {
-		fmt.Println(err)
+		return "", err
 	}
-	_, err = c.channels.UnregisterSub(subject)
-	if err != nil {
-		fmt.Println(err)
+	if r, ok := c.removeRegistration(subject); ok && r.Delivery == schema.DeliveryModeStream {
+		if err := c.removeStreamSubject(r.Stream, subject); err != nil {
+			fmt.Println(err)
+		}
 	}
 
 	c.MessageChannelsMutex.Lock()
 	for i, chMapp := range c.MessageChannels[topic] {
 		if chMapp.subject == subject {
-			close(chMapp.channel)
+			chMapp.queue.close()
 			c.MessageChannels[topic] = removeFromSubjectChannelMappingSlice(c.MessageChannels[topic], i)
 		}
 	}
 	// remove topic from message channels if no further subjects / channels contained
 	if len(c.MessageChannels[topic]) <= 0 {
 		delete(c.MessageChannels, topic)
+		metrics.MessagesReceived.DeleteLabelValues(topic)
 	}
 	c.MessageChannelsMutex.Unlock()
 
@@ -446,5 +996,5 @@ func (c *Config) cleanupSubject(subject string) (string, error) {
 		c.newConfigUnregisterChan <- topic
 	}
 
-	return topic, err
+	return topic, nil
 }
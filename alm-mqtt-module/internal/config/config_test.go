@@ -17,12 +17,21 @@ limitations under the License.
 package config
 
 import (
+	"alm-mqtt-module/internal/mqtt"
 	"alm-mqtt-module/pkg/avro"
 	schema "alm-mqtt-module/pkg/schema"
+	"bytes"
 	"encoding/json"
+	"math"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/eclipse/paho.golang/paho"
 	"github.com/linkedin/goavro"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 )
@@ -68,7 +77,8 @@ func TestParsePublishRequestWithJsonPayload(t *testing.T) {
 
 	natsMsg := createNatsMessage(assert, msg, schema.PubRequest)
 
-	req := parsePublishRequest(&natsMsg)
+	req, err := parsePublishRequest(&natsMsg)
+	assert.Nil(err)
 	assert.Equal(req.Payload, bytePayload)
 	assert.Equal(req.Topic, topic)
 }
@@ -87,7 +97,8 @@ func TestParsePublishRequestWithStringPayload(t *testing.T) {
 
 	natsMsg := createNatsMessage(assert, msg, schema.PubRequest)
 
-	req := parsePublishRequest(&natsMsg)
+	req, err := parsePublishRequest(&natsMsg)
+	assert.Nil(err)
 	assert.Equal(req.Payload, bytePayload)
 	assert.Equal(string(req.Payload), payload)
 	assert.Equal(req.Topic, topic)
@@ -121,7 +132,8 @@ func TestParseRepuestResponseRequestWithJsonPayload(t *testing.T) {
 
 	natsMsg := createNatsMessage(assert, msg, schema.ReqResRequest)
 
-	req := parseRequestRepsonseResponse(&natsMsg)
+	req, err := parseRequestRepsonseResponse(&natsMsg)
+	assert.Nil(err)
 	assert.Equal(req.Payload, bytePayload)
 	assert.Equal(req.Topic, topic)
 	assert.Equal(timeout, req.Timeout)
@@ -144,9 +156,904 @@ func TestParseRepuestResponseRequestWithStringPayload(t *testing.T) {
 
 	natsMsg := createNatsMessage(assert, msg, schema.ReqResRequest)
 
-	req := parseRequestRepsonseResponse(&natsMsg)
+	req, err := parseRequestRepsonseResponse(&natsMsg)
+	assert.Nil(err)
 	assert.Equal(req.Payload, bytePayload)
 	assert.Equal(string(req.Payload), payload)
 	assert.Equal(req.Topic, topic)
 	assert.Equal(timeout, req.Timeout)
 }
+
+func TestGetQueuesForTopicMatchesFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConfig("module1", nil, nil, nil, nil)
+	c.MessageChannels["sensors/+/temperature"] = []subjectChannelMapping{{queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s1"}}
+	c.MessageChannels["sensors/#"] = []subjectChannelMapping{{queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s2"}, {queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s3"}}
+	c.MessageChannels["sensors/1/temperature"] = []subjectChannelMapping{{queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s4"}}
+	c.MessageChannels["plant/#"] = []subjectChannelMapping{{queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s5"}}
+
+	ch, filters := c.getQueuesForTopic("sensors/1/temperature", false)
+	assert.Len(ch, 4)
+	assert.ElementsMatch([]string{"sensors/+/temperature", "sensors/#", "sensors/1/temperature"}, filters)
+	for _, s := range []string{"s1", "s2", "s3", "s4"} {
+		assert.Contains(ch, s)
+	}
+
+	ch, filters = c.getQueuesForTopic("sensors/2/humidity", false)
+	assert.Len(ch, 2)
+	assert.Equal([]string{"sensors/#"}, filters)
+	assert.Contains(ch, "s2")
+	assert.Contains(ch, "s3")
+
+	ch, filters = c.getQueuesForTopic("other", false)
+	assert.Len(ch, 0)
+	assert.Len(filters, 0)
+}
+
+func TestGetTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConfig("module1", nil, nil, nil, nil)
+	assert.Len(c.GetTopics(), 0)
+
+	c.MessageChannels["sensors/+/temperature"] = []subjectChannelMapping{{queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s1"}}
+	c.MessageChannels["plant/#"] = []subjectChannelMapping{{queue: newSubscriberQueue(0, schema.OverflowDropOldest), subject: "s2"}}
+	assert.ElementsMatch([]string{"sensors/+/temperature", "plant/#"}, c.GetTopics())
+}
+
+func startTestConfig(t *testing.T) (*Config, *nats.Conn, func()) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := natsserver.RunServer(&opts)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		s.Shutdown()
+		t.Fatal(err)
+	}
+	c := NewConfig("module1", nc, make(chan string, 100), make(chan string, 100), make(chan paho.Publish, 100))
+	c.HandleConfigRequests()
+	c.HandlePublishRequests()
+	c.HandleRequestResponse()
+	c.HandleAdminRequests()
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return c, nc, func() {
+		nc.Close()
+		s.Shutdown()
+	}
+}
+
+func encode(assert *assert.Assertions, msg map[string]interface{}, schema string) []byte {
+	codec, err := goavro.NewCodec(schema)
+	assert.Nil(err)
+	bytes, err := avro.Writer(msg, codec)
+	assert.Nil(err)
+	return bytes
+}
+
+func TestHandlersRejectMalformedRequests(t *testing.T) {
+	assert := assert.New(t)
+	_, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	// an OCF file that contains a plain string instead of a record
+	stringCodec, err := goavro.NewCodec(`"string"`)
+	assert.Nil(err)
+	notARecord := new(bytes.Buffer)
+	ocfw, err := goavro.NewOCFWriter(goavro.OCFConfig{W: notARecord, Codec: stringCodec})
+	assert.Nil(err)
+	assert.Nil(ocfw.Append([]interface{}{"topic"}))
+
+	validRegister := encode(assert, map[string]interface{}{"topic": "sensors/#"}, schema.RegisterSubRequest)
+	validPublish := encode(assert, map[string]interface{}{"topic": "a/b", "payload": []byte("x")}, schema.PubRequest)
+	validReqRes := encode(assert, map[string]interface{}{"topic": "a/b", "payload": []byte("x"), "timeout": int32(100)}, schema.ReqResRequest)
+	validUnregister := encode(assert, map[string]interface{}{"subject": "module1.unknown"}, schema.UnregisterSubRequest)
+
+	malformed := map[string][]byte{
+		"empty":         {},
+		"garbage":       []byte("this is not avro at all"),
+		"not a record":  notARecord.Bytes(),
+		"truncated reg": validRegister[:len(validRegister)/2],
+		"truncated pub": validPublish[:len(validPublish)-3],
+		"truncated rr":  validReqRes[:len(validReqRes)-3],
+	}
+
+	tests := []struct {
+		subject string
+		extra   map[string][]byte
+	}{
+		{
+			subject: "module1.config.register",
+			extra: map[string][]byte{
+				"wrong schema":   validUnregister,
+				"invalid filter": encode(assert, map[string]interface{}{"topic": "a/#/b"}, schema.RegisterSubRequest),
+				"empty topic":    encode(assert, map[string]interface{}{"topic": ""}, schema.RegisterSubRequest),
+			},
+		},
+		{
+			subject: "module1.config.unregister",
+			extra: map[string][]byte{
+				"wrong schema":  validRegister,
+				"unknown":       validUnregister,
+				"empty subject": encode(assert, map[string]interface{}{"subject": ""}, schema.UnregisterSubRequest),
+			},
+		},
+		{
+			subject: "module1.publish",
+			extra: map[string][]byte{
+				"wrong schema":   validRegister,
+				"wildcard topic": encode(assert, map[string]interface{}{"topic": "a/+", "payload": []byte("x")}, schema.PubRequest),
+				"empty topic":    encode(assert, map[string]interface{}{"topic": "", "payload": []byte("x")}, schema.PubRequest),
+			},
+		},
+		{
+			subject: "module1.request-response",
+			extra: map[string][]byte{
+				"wrong schema":     validPublish,
+				"wildcard topic":   encode(assert, map[string]interface{}{"topic": "a/#", "payload": []byte("x"), "timeout": int32(100)}, schema.ReqResRequest),
+				"zero timeout":     encode(assert, map[string]interface{}{"topic": "a/b", "payload": []byte("x"), "timeout": int32(0)}, schema.ReqResRequest),
+				"negative timeout": encode(assert, map[string]interface{}{"topic": "a/b", "payload": []byte("x"), "timeout": int32(-5)}, schema.ReqResRequest),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		payloads := make(map[string][]byte)
+		for name, data := range malformed {
+			payloads[name] = data
+		}
+		for name, data := range test.extra {
+			payloads[name] = data
+		}
+		for name, data := range payloads {
+			res, err := nc.Request(test.subject, data, 2*time.Second)
+			if !assert.Nil(err, "%s: %s", test.subject, name) {
+				continue
+			}
+			reader, err := avro.NewReader(res.Data)
+			assert.Nil(err, "%s: %s", test.subject, name)
+			m, err := reader.Map()
+			assert.Nil(err, "%s: %s", test.subject, name)
+			assert.NotEmpty(m["error"], "%s: %s", test.subject, name)
+		}
+	}
+
+	// module is still serving valid requests
+	res, err := nc.Request("module1.config.register", validRegister, 2*time.Second)
+	assert.Nil(err)
+	reader, err := avro.NewReader(res.Data)
+	assert.Nil(err)
+	m, err := reader.Map()
+	assert.Nil(err)
+	assert.Equal("", m["error"])
+	assert.NotEmpty(m["subject"])
+}
+
+func decodeResponse(assert *assert.Assertions, res *nats.Msg) map[string]interface{} {
+	reader, err := avro.NewReader(res.Data)
+	assert.Nil(err)
+	m, err := reader.Map()
+	assert.Nil(err)
+	return m
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	register := encode(assert, map[string]interface{}{"topic": "sensors/#", "lease": int32(300)}, schema.RegisterSubRequest)
+	res, err := nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	assert.Equal(int32(300), m["lease"])
+	subject := m["subject"].(string)
+	assert.Equal("sensors/#", <-c.newConfigRegisterChan)
+
+	// renewing keeps the registration alive
+	renew := encode(assert, map[string]interface{}{"subject": subject}, schema.RenewSubRequest)
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		res, err = nc.Request("module1.config.renew", renew, 2*time.Second)
+		assert.Nil(err)
+		m = decodeResponse(assert, res)
+		assert.Equal("", m["error"])
+		assert.Equal(int32(300), m["lease"])
+	}
+	assert.Contains(c.GetRegistrations("sensors/#"), subject)
+
+	// without renewal the registration is removed
+	select {
+	case topic := <-c.newConfigUnregisterChan:
+		assert.Equal("sensors/#", topic)
+	case <-time.After(time.Second):
+		assert.Fail("lease did not expire")
+	}
+	assert.NotContains(c.GetRegistrations("sensors/#"), subject)
+	assert.Len(c.GetTopics(), 0)
+
+	res, err = nc.Request("module1.config.renew", renew, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+}
+
+func TestRegisterWithoutLease(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	// schema used by clients not knowing about leases
+	legacySchema := `{
+		"type": "record",
+		"name": "alm_mqtt_module.registerSub.request",
+		"fields" : [{"name": "topic", "type": "string"}]
+	}`
+	register := encode(assert, map[string]interface{}{"topic": "sensors/#"}, legacySchema)
+	res, err := nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	assert.Equal(int32(0), m["lease"])
+	subject := m["subject"].(string)
+	assert.False(c.hasLease(subject))
+
+	renew := encode(assert, map[string]interface{}{"subject": subject}, schema.RenewSubRequest)
+	res, err = nc.Request("module1.config.renew", renew, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+
+	register = encode(assert, map[string]interface{}{"topic": "sensors/#", "lease": int32(-1)}, schema.RegisterSubRequest)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+}
+
+func TestPublishDelivery(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	register := encode(assert, map[string]interface{}{"topic": "sensors/#", "lease": int32(5000), "delivery": schema.DeliveryModePublish}, schema.RegisterSubRequest)
+	res, err := nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	subject := m["subject"].(string)
+
+	received := make(chan []byte, 10)
+	// subscriber does not respond
+	_, err = nc.Subscribe(subject, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	assert.Nil(err)
+	assert.Nil(nc.Flush())
+
+	for i := 0; i < 5; i++ {
+		c.Dispatch("sensors/1", false, []byte{byte(i)})
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case data := <-received:
+			assert.Equal([]byte{byte(i)}, data)
+		case <-time.After(time.Second):
+			assert.Fail("message not delivered")
+		}
+	}
+	// registration is kept although no message was acknowledged
+	assert.Contains(c.GetRegistrations("sensors/#"), subject)
+}
+
+func TestPublishDeliveryRequiresLease(t *testing.T) {
+	assert := assert.New(t)
+	_, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	register := encode(assert, map[string]interface{}{"topic": "sensors/#", "lease": int32(0), "delivery": schema.DeliveryModePublish}, schema.RegisterSubRequest)
+	res, err := nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+
+	customSchema := `{
+		"type": "record",
+		"name": "alm_mqtt_module.registerSub.request",
+		"fields" : [{"name": "topic", "type": "string"}, {"name": "delivery", "type": "string"}]
+	}`
+	register = encode(assert, map[string]interface{}{"topic": "sensors/#", "delivery": "unknown"}, customSchema)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+}
+
+func TestStreamDelivery(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	register := encode(assert, map[string]interface{}{
+		"topic":    "sensors/#",
+		"delivery": schema.DeliveryModeStream,
+		"stream":   "SENSORS",
+		"maxMsgs":  int64(3),
+	}, schema.RegisterSubRequest)
+	res, err := nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	assert.Equal("module1.stream.SENSORS", m["subject"])
+
+	for i := 0; i < 5; i++ {
+		c.Dispatch("sensors/1", false, []byte{byte(i)})
+	}
+
+	js, err := nc.JetStream()
+	assert.Nil(err)
+	assert.Eventually(func() bool {
+		info, err := js.StreamInfo("SENSORS")
+		return err == nil && info.State.LastSeq == 5
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// retention limits are honoured, only the latest 3 messages are kept
+	info, err := js.StreamInfo("SENSORS")
+	assert.Nil(err)
+	assert.Equal(uint64(3), info.State.Msgs)
+	assert.Equal(int64(3), info.Config.MaxMsgs)
+
+	// messages can be replayed from a sequence
+	sub, err := js.SubscribeSync("module1.stream.SENSORS", nats.StartSequence(4))
+	assert.Nil(err)
+	for i := 3; i < 5; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		if assert.Nil(err) {
+			assert.Equal([]byte{byte(i)}, msg.Data)
+		}
+	}
+
+	// a second topic can be stored in the same stream using another subject
+	register = encode(assert, map[string]interface{}{
+		"topic":         "plant/#",
+		"delivery":      schema.DeliveryModeStream,
+		"stream":        "SENSORS",
+		"streamSubject": "plant.all",
+		"maxMsgs":       int64(100),
+	}, schema.RegisterSubRequest)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	info, err = js.StreamInfo("SENSORS")
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"module1.stream.SENSORS", "plant.all"}, info.Config.Subjects)
+	// the existing stream keeps its limits
+	assert.Equal(int64(3), info.Config.MaxMsgs)
+	assert.Equal(uint64(3), info.State.Msgs)
+
+	// the same subject can not be registered twice
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+
+	// the default subject allows a single registration per stream
+	register = encode(assert, map[string]interface{}{
+		"topic":    "other/#",
+		"delivery": schema.DeliveryModeStream,
+		"stream":   "SENSORS",
+	}, schema.RegisterSubRequest)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.Contains(m["error"], "use streamSubject")
+
+	// the subjects of the module can not be used
+	register = encode(assert, map[string]interface{}{
+		"topic":         "other/#",
+		"delivery":      schema.DeliveryModeStream,
+		"stream":        "SENSORS",
+		"streamSubject": "module1.config.register",
+	}, schema.RegisterSubRequest)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.Contains(m["error"], "must not match the subjects of 'module1'")
+
+	// unregistering removes the subject from the stream, the stream is kept
+	unregister := encode(assert, map[string]interface{}{"subject": "plant.all"}, schema.UnregisterSubRequest)
+	res, err = nc.Request("module1.config.unregister", unregister, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+	info, err = js.StreamInfo("SENSORS")
+	assert.Nil(err)
+	assert.Equal([]string{"module1.stream.SENSORS"}, info.Config.Subjects)
+	assert.Equal(uint64(3), info.State.Msgs)
+
+	// the last subject is kept
+	unregister = encode(assert, map[string]interface{}{"subject": "module1.stream.SENSORS"}, schema.UnregisterSubRequest)
+	res, err = nc.Request("module1.config.unregister", unregister, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+	info, err = js.StreamInfo("SENSORS")
+	assert.Nil(err)
+	assert.Equal([]string{"module1.stream.SENSORS"}, info.Config.Subjects)
+
+	// stream name is required
+	register = encode(assert, map[string]interface{}{"topic": "plant/#", "delivery": schema.DeliveryModeStream}, schema.RegisterSubRequest)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.NotEmpty(m["error"])
+}
+
+func TestPersistRegistrations(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	file := filepath.Join(t.TempDir(), "registrations.json")
+	assert.Nil(c.PersistRegistrations(file))
+
+	register := encode(assert, map[string]interface{}{"topic": "sensors/#", "lease": int32(5000), "delivery": schema.DeliveryModePublish}, schema.RegisterSubRequest)
+	res, err := nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	subject := m["subject"].(string)
+
+	register = encode(assert, map[string]interface{}{"topic": "other"}, schema.RegisterSubRequest)
+	res, err = nc.Request("module1.config.register", register, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	removed := m["subject"].(string)
+
+	unregister := encode(assert, map[string]interface{}{"subject": removed}, schema.UnregisterSubRequest)
+	res, err = nc.Request("module1.config.unregister", unregister, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+
+	registerNats := encode(assert, map[string]interface{}{"subject": "cmd.>", "lease": int32(5000)}, schema.RegisterNatsRequest)
+	res, err = nc.Request("module1.config.register-nats", registerNats, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	id := m["id"].(string)
+	// stop forwarding of the first module without removing the registration
+	assert.Nil(c.natsRegistrations[id].subscription.Unsubscribe())
+
+	// a restarted module restores the remaining registrations under the same subject and id
+	restarted := NewConfig("module1", nc, make(chan string, 100), make(chan string, 100), make(chan paho.Publish, 100))
+	assert.Nil(restarted.PersistRegistrations(file))
+	assert.Equal([]string{subject}, restarted.GetRegistrations("sensors/#"))
+	assert.Equal([]string{"sensors/#"}, restarted.GetTopics())
+	assert.True(restarted.hasLease(subject))
+	assert.True(restarted.hasLease(id))
+
+	assert.Nil(nc.Publish("cmd.x", []byte("on")))
+	select {
+	case pub := <-restarted.pubChan:
+		assert.Equal("cmd/x", pub.Topic)
+	case <-time.After(time.Second):
+		assert.Fail("nats registration not restored")
+	}
+
+	received := make(chan []byte, 1)
+	_, err = nc.Subscribe(subject, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	assert.Nil(err)
+	assert.Nil(nc.Flush())
+
+	restarted.Dispatch("sensors/1", false, []byte("data"))
+
+	select {
+	case data := <-received:
+		assert.Equal([]byte("data"), data)
+	case <-time.After(time.Second):
+		assert.Fail("message not delivered")
+	}
+}
+
+func TestPersistRegistrationsWithoutFile(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConfig("module1", nil, nil, nil, nil)
+	assert.Nil(c.PersistRegistrations(filepath.Join(t.TempDir(), "missing.json")))
+	assert.Empty(c.GetTopics())
+}
+
+func TestRegisterNats(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	register := encode(assert, map[string]interface{}{"subject": "cmd.line1.>", "topic": "line1/cmd/{rest}", "qos": int32(2), "retain": true}, schema.RegisterNatsRequest)
+	res, err := nc.Request("module1.config.register-nats", register, 2*time.Second)
+	assert.Nil(err)
+	m := decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	id := m["id"].(string)
+
+	assert.Nil(nc.Publish("cmd.line1.valve.open", []byte("on")))
+	select {
+	case pub := <-c.pubChan:
+		assert.Equal("line1/cmd/valve/open", pub.Topic)
+		assert.Equal(byte(2), pub.QoS)
+		assert.True(pub.Retain)
+		assert.Equal([]byte("on"), pub.Payload)
+	case <-time.After(time.Second):
+		assert.Fail("message not forwarded")
+	}
+
+	unregister := encode(assert, map[string]interface{}{"id": id}, schema.UnregisterNatsRequest)
+	res, err = nc.Request("module1.config.unregister-nats", unregister, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+
+	assert.Nil(nc.Publish("cmd.line1.valve.open", []byte("on")))
+	assert.Nil(nc.Flush())
+	select {
+	case <-c.pubChan:
+		assert.Fail("registration not removed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res, err = nc.Request("module1.config.unregister-nats", unregister, 2*time.Second)
+	assert.Nil(err)
+	assert.NotEqual("", decodeResponse(assert, res)["error"])
+}
+
+func TestRegisterNatsRejectsInvalidRequests(t *testing.T) {
+	assert := assert.New(t)
+	_, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	invalid := []map[string]interface{}{
+		{"subject": ">"},
+		{"subject": "module1.config.>"},
+		{"subject": "cmd..x"},
+		{"subject": "cmd.x", "qos": int32(3)},
+		{"subject": "cmd.x", "topic": "cmd/{rest}"},
+		{"subject": "cmd.x", "lease": int32(-1)},
+		{"subject": "cmd.x", "id": "r1"},
+	}
+	for _, req := range invalid {
+		res, err := nc.Request("module1.config.register-nats", encode(assert, req, schema.RegisterNatsRequest), 2*time.Second)
+		assert.Nil(err)
+		assert.NotEqual("", decodeResponse(assert, res)["error"], req)
+	}
+}
+
+func TestRegisterRequestedSubject(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+	register := func(req map[string]interface{}) map[string]interface{} {
+		res, err := nc.Request("module1.config.register", encode(assert, req, schema.RegisterSubRequest), 2*time.Second)
+		assert.Nil(err)
+		return decodeResponse(assert, res)
+	}
+
+	// a lost registration is registered again under its subject
+	subject := "module1.1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	m := register(map[string]interface{}{"topic": "sensors/#", "subject": subject})
+	assert.Equal("", m["error"])
+	assert.Equal(subject, m["subject"])
+	assert.Equal([]string{subject}, c.GetRegistrations("sensors/#"))
+
+	invalid := []map[string]interface{}{
+		{"topic": "sensors/#", "subject": subject},
+		{"topic": "sensors/#", "subject": "module1.config.register"},
+		{"topic": "sensors/#", "subject": "other.1b4e28ba-2fa1-11d2-883f-0016d3cca427"},
+		{"topic": "sensors/#", "subject": "module1.1b4e28ba-2fa1-11d2-883f-0016d3cca428", "delivery": "stream", "stream": "s1"},
+	}
+	for _, req := range invalid {
+		assert.NotEqual("", register(req)["error"], req)
+	}
+	assert.Equal([]string{subject}, c.GetRegistrations("sensors/#"))
+
+	id := "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	req := encode(assert, map[string]interface{}{"subject": "cmd.x", "id": id}, schema.RegisterNatsRequest)
+	res, err := nc.Request("module1.config.register-nats", req, 2*time.Second)
+	assert.Nil(err)
+	m = decodeResponse(assert, res)
+	assert.Equal("", m["error"])
+	assert.Equal(id, m["id"])
+	res, err = nc.Request("module1.config.register-nats", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("id '"+id+"' is already registered", decodeResponse(assert, res)["error"])
+}
+
+func TestPublishOptions(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	req := encode(assert, map[string]interface{}{
+		"topic":         "state/valve",
+		"payload":       []byte("open"),
+		"qos":           int32(2),
+		"retain":        true,
+		"contentType":   "text/plain",
+		"messageExpiry": int64(60),
+		"userProperties": []interface{}{
+			map[string]interface{}{"key": "unit", "value": "none"},
+			map[string]interface{}{"key": "unit", "value": "twice"},
+		},
+	}, schema.PubRequest)
+	res, err := nc.Request("module1.publish", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+
+	pub := <-c.pubChan
+	assert.Equal("state/valve", pub.Topic)
+	assert.Equal([]byte("open"), pub.Payload)
+	assert.Equal(byte(2), pub.QoS)
+	assert.True(pub.Retain)
+	assert.Equal("text/plain", pub.Properties.ContentType)
+	assert.Equal(uint32(60), *pub.Properties.MessageExpiry)
+	assert.Equal(paho.UserProperties{{Key: "unit", Value: "none"}, {Key: "unit", Value: "twice"}}, pub.Properties.User)
+
+	// clients using the schema without options publish with QoS 1
+	legacySchema := `{"type": "record", "name": "alm_mqtt_module.pub.request", "fields": [{"name": "topic", "type": "string"}, {"name": "payload", "type": "bytes"}]}`
+	req = encode(assert, map[string]interface{}{"topic": "state/valve", "payload": []byte("open")}, legacySchema)
+	res, err = nc.Request("module1.publish", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+
+	pub = <-c.pubChan
+	assert.Equal(byte(1), pub.QoS)
+	assert.False(pub.Retain)
+	assert.Nil(pub.Properties.MessageExpiry)
+
+	req = encode(assert, map[string]interface{}{"topic": "state/valve", "payload": []byte("open"), "qos": int32(3)}, schema.PubRequest)
+	res, err = nc.Request("module1.publish", req, 2*time.Second)
+	assert.Nil(err)
+	assert.NotEqual("", decodeResponse(assert, res)["error"])
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	register := func(req map[string]interface{}) map[string]interface{} {
+		res, err := nc.Request("module1.config.register", encode(assert, req, schema.RegisterSubRequest), 2*time.Second)
+		assert.Nil(err)
+		return decodeResponse(assert, res)
+	}
+
+	// telemetry consumer without retained messages
+	m := register(map[string]interface{}{"topic": "state/#", "qos": int32(0), "retainHandling": int32(2)})
+	assert.Equal("", m["error"])
+	telemetry := m["subject"].(string)
+	assert.Equal(map[string]paho.SubscribeOptions{"state/#": {QoS: 0, RetainHandling: 2}}, c.GetSubscriptions())
+
+	// state sync consumer asking for retained messages
+	m = register(map[string]interface{}{"topic": "state/#", "qos": int32(2)})
+	assert.Equal("", m["error"])
+	state := m["subject"].(string)
+	assert.Equal(map[string]paho.SubscribeOptions{"state/#": {QoS: 2, RetainHandling: 0}}, c.GetSubscriptions())
+
+	c.MessageChannelsMutex.Lock()
+	retained, _ := c.getQueuesForTopic("state/valve", true)
+	live, _ := c.getQueuesForTopic("state/valve", false)
+	c.MessageChannelsMutex.Unlock()
+	assert.Contains(retained, state)
+	assert.NotContains(retained, telemetry)
+	assert.Contains(live, state)
+	assert.Contains(live, telemetry)
+
+	for _, req := range []map[string]interface{}{
+		{"topic": "state/#", "qos": int32(3)},
+		{"topic": "state/#", "retainHandling": int32(3)},
+		{"topic": "$share/group/state/#", "noLocal": true},
+	} {
+		assert.NotEqual("", register(req)["error"], req)
+	}
+}
+
+func TestRequestReplyModes(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	request := func(req map[string]interface{}) chan map[string]interface{} {
+		result := make(chan map[string]interface{}, 1)
+		go func() {
+			res, err := nc.Request("module1.request-response", encode(assert, req, schema.ReqResRequest), 2*time.Second)
+			assert.Nil(err)
+			result <- decodeResponse(assert, res)
+		}()
+		return result
+	}
+
+	// topic mode
+	result := request(map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(1000), "mode": "topic"})
+	responseTopic := <-c.newConfigRegisterChan
+	assert.Contains(c.GetSubscriptions(), responseTopic)
+	pub := <-c.pubChan
+	assert.True(strings.HasPrefix(pub.Topic, "dev/1/cmd/req/"))
+	id := strings.TrimPrefix(pub.Topic, "dev/1/cmd/req/")
+	assert.Equal("dev/1/cmd/res/"+id, responseTopic)
+	assert.Equal("", pub.Properties.ResponseTopic)
+	// the request expires with its timeout
+	assert.Equal(uint32(1), *pub.Properties.MessageExpiry)
+	assert.False(c.HandleResponse(&paho.Publish{Topic: "dev/1/cmd/res/other", Payload: []byte("x")}))
+	assert.True(c.HandleResponse(&paho.Publish{Topic: responseTopic, Payload: []byte("pong")}))
+	m := <-result
+	assert.Equal("", m["error"])
+	assert.Equal([]byte("pong"), m["payload"])
+	assert.Equal(responseTopic, <-c.newConfigUnregisterChan)
+	assert.NotContains(c.GetSubscriptions(), responseTopic)
+
+	// envelope mode
+	result = request(map[string]interface{}{"topic": "dev/2/cmd", "payload": []byte(`{"cmd":"ping"}`), "timeout": int32(1000),
+		"mode": "envelope", "responseTopic": "dev/2/replies", "correlationField": "rid"})
+	assert.Equal("dev/2/replies", <-c.newConfigRegisterChan)
+	pub = <-c.pubChan
+	assert.Equal("dev/2/cmd", pub.Topic)
+	var envelope map[string]interface{}
+	assert.Nil(json.Unmarshal(pub.Payload, &envelope))
+	assert.Equal("ping", envelope["cmd"])
+	rid := envelope["rid"].(string)
+	assert.False(c.HandleResponse(&paho.Publish{Topic: "dev/2/replies", Payload: []byte(`{"rid":"other"}`)}))
+	response := []byte(`{"rid":"` + rid + `","result":"pong"}`)
+	assert.True(c.HandleResponse(&paho.Publish{Topic: "dev/2/replies", Payload: response}))
+	m = <-result
+	assert.Equal("", m["error"])
+	assert.Equal(response, m["payload"])
+	assert.Equal("dev/2/replies", <-c.newConfigUnregisterChan)
+
+	// invalid requests
+	for _, req := range []map[string]interface{}{
+		{"topic": "dev/3/cmd", "payload": []byte("not json"), "timeout": int32(1000), "mode": "envelope"},
+		{"topic": "dev/3/cmd", "payload": []byte("{}"), "timeout": int32(1000), "mode": "envelope", "responseTopic": "dev/+/replies"},
+		{"topic": "dev/3/cmd", "payload": []byte("ping"), "timeout": int32(1000), "mode": "topic", "responseTopic": "dev/3/replies"},
+	} {
+		assert.NotEqual("", (<-request(req))["error"], req)
+	}
+}
+
+func TestMqtt311RejectsMqtt5Features(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+	c.SetProtocolVersion(func() byte { return mqtt.Version311 })
+
+	request := func(subject string, req map[string]interface{}, schema string) string {
+		res, err := nc.Request(subject, encode(assert, req, schema), 2*time.Second)
+		assert.Nil(err)
+		return decodeResponse(assert, res)["error"].(string)
+	}
+
+	// MQTT 5 subscription options
+	assert.Contains(request("module1.config.register", map[string]interface{}{"topic": "state/#", "noLocal": true}, schema.RegisterSubRequest), "requires MQTT 5")
+	assert.Contains(request("module1.config.register", map[string]interface{}{"topic": "state/#", "retainHandling": int32(1)}, schema.RegisterSubRequest), "requires MQTT 5")
+	assert.Equal("", request("module1.config.register", map[string]interface{}{"topic": "state/#", "qos": int32(2)}, schema.RegisterSubRequest))
+	assert.Equal("state/#", <-c.newConfigRegisterChan)
+
+	// MQTT 5 properties
+	assert.Contains(request("module1.publish", map[string]interface{}{"topic": "state/valve", "payload": []byte("open"), "contentType": "text/plain"}, schema.PubRequest), "requires MQTT 5")
+	assert.Equal("", request("module1.publish", map[string]interface{}{"topic": "state/valve", "payload": []byte("open"), "retain": true}, schema.PubRequest))
+	assert.Equal("state/valve", (<-c.pubChan).Topic)
+
+	// native request-reply
+	errText := request("module1.request-response", map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(100)}, schema.ReqResRequest)
+	assert.Contains(errText, "requires MQTT 5")
+	assert.Contains(errText, "'topic'")
+	assert.Equal("timeout expired", request("module1.request-response", map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(100), "mode": "topic"}, schema.ReqResRequest))
+
+	// MQTT 5 features are accepted again once the broker is connected using MQTT 5
+	c.SetProtocolVersion(func() byte { return mqtt.Version5 })
+	assert.Equal("", request("module1.config.register", map[string]interface{}{"topic": "state/#", "noLocal": true}, schema.RegisterSubRequest))
+}
+
+func TestRequestReplyStream(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	inbox := nats.NewInbox()
+	responses, err := nc.SubscribeSync(inbox)
+	assert.Nil(err)
+	next := func() map[string]interface{} {
+		msg, err := responses.NextMsg(2 * time.Second)
+		assert.Nil(err)
+		return decodeResponse(assert, msg)
+	}
+
+	req := encode(assert, map[string]interface{}{"topic": "dev/1/update", "payload": []byte("start"), "timeout": int32(1000),
+		"mode": "topic", "inbox": inbox, "endMarker": "done"}, schema.ReqResRequest)
+	res, err := nc.Request("module1.request-response", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+
+	responseTopic := <-c.newConfigRegisterChan
+	<-c.pubChan
+	for _, payload := range []string{"10%", "50%", "done"} {
+		assert.True(c.HandleResponse(&paho.Publish{Topic: responseTopic, Payload: []byte(payload)}))
+	}
+	for _, payload := range []string{"10%", "50%", "done"} {
+		m := next()
+		assert.Equal("", m["error"])
+		assert.Equal([]byte(payload), m["payload"])
+		assert.Equal(payload == "done", m["end"])
+	}
+	assert.Equal(responseTopic, <-c.newConfigUnregisterChan)
+
+	// without any response the stream ends with an error
+	req = encode(assert, map[string]interface{}{"topic": "dev/1/update", "payload": []byte("start"), "timeout": int32(100),
+		"inbox": inbox}, schema.ReqResRequest)
+	res, err = nc.Request("module1.request-response", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("", decodeResponse(assert, res)["error"])
+	m := next()
+	assert.Equal("timeout expired", m["error"])
+	assert.Equal(true, m["end"])
+
+	// an end marker requires an inbox
+	req = encode(assert, map[string]interface{}{"topic": "dev/1/update", "payload": []byte("start"), "timeout": int32(100),
+		"endMarker": "done"}, schema.ReqResRequest)
+	res, err = nc.Request("module1.request-response", req, 2*time.Second)
+	assert.Nil(err)
+	assert.NotEqual("", decodeResponse(assert, res)["error"])
+}
+
+func TestRequestReplyCancel(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, cleanup := startTestConfig(t)
+	defer cleanup()
+
+	cancel := func(id string) string {
+		res, err := nc.Request("module1.request-response.cancel", encode(assert, map[string]interface{}{"id": id}, schema.ReqResCancelRequest), 2*time.Second)
+		assert.Nil(err)
+		return decodeResponse(assert, res)["error"].(string)
+	}
+
+	result := make(chan map[string]interface{}, 1)
+	go func() {
+		req := encode(assert, map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(60000), "id": "r1"}, schema.ReqResRequest)
+		res, err := nc.Request("module1.request-response", req, 2*time.Second)
+		assert.Nil(err)
+		result <- decodeResponse(assert, res)
+	}()
+	pub := <-c.pubChan
+	assert.Equal([]byte("r1"), pub.Properties.CorrelationData)
+
+	// the id is in use
+	req := encode(assert, map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(100), "id": "r1"}, schema.ReqResRequest)
+	res, err := nc.Request("module1.request-response", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("request 'r1' is already pending", decodeResponse(assert, res)["error"])
+
+	assert.Equal("", cancel("r1"))
+	assert.Equal("request cancelled", (<-result)["error"])
+	assert.NotEqual("", cancel("r1"))
+
+	// a cancel overtaking its request rejects the request
+	assert.NotEqual("", cancel("r2"))
+	req = encode(assert, map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(60000), "id": "r2"}, schema.ReqResRequest)
+	res, err = nc.Request("module1.request-response", req, 2*time.Second)
+	assert.Nil(err)
+	assert.Equal("request 'r2' was cancelled", decodeResponse(assert, res)["error"])
+	assert.Len(c.pubChan, 0)
+	assert.Len(c.GetPendingRequests(), 0)
+
+	// requests without deadline wait at most maxRequestTimeout
+	assert.Equal(maxRequestTimeout, requestTimeout(schema.ReqResRequestType{Timeout: math.MaxInt32}))
+	assert.Equal(time.Second, requestTimeout(schema.ReqResRequestType{Timeout: 1000}))
+
+	req = encode(assert, map[string]interface{}{"topic": "dev/1/cmd", "payload": []byte("ping"), "timeout": int32(100), "id": "r/1"}, schema.ReqResRequest)
+	res, err = nc.Request("module1.request-response", req, 2*time.Second)
+	assert.Nil(err)
+	assert.NotEqual("", decodeResponse(assert, res)["error"])
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	schema "alm-mqtt-module/pkg/schema"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// maxLease is the longest lease granted to a registration
+	maxLease = time.Hour
+)
+
+// lease removes a registration if it is not renewed in time
+type lease struct {
+	duration time.Duration
+	timer    *time.Timer
+}
+
+// startLease starts the lease of a registration identified by key. When the lease expires, expire is called.
+// The granted lease is returned.
+func (c *Config) startLease(key string, duration time.Duration, expire func()) time.Duration {
+	if duration > maxLease {
+		duration = maxLease
+	}
+	c.leasesMutex.Lock()
+	defer c.leasesMutex.Unlock()
+	c.leases[key] = &lease{
+		duration: duration,
+		timer:    time.AfterFunc(duration, expire),
+	}
+	return duration
+}
+
+// renewLease restarts the lease of a registration and returns the granted lease
+func (c *Config) renewLease(key string) (time.Duration, error) {
+	c.leasesMutex.Lock()
+	defer c.leasesMutex.Unlock()
+	l, ok := c.leases[key]
+	if !ok {
+		return 0, fmt.Errorf("'%s' is not registered with a lease", key)
+	}
+	if !l.timer.Stop() {
+		// timer already fired, registration is being removed
+		return 0, fmt.Errorf("lease of '%s' already expired", key)
+	}
+	l.timer.Reset(l.duration)
+	return l.duration, nil
+}
+
+// stopLease stops the lease of a registration, if there is one
+func (c *Config) stopLease(key string) {
+	c.leasesMutex.Lock()
+	defer c.leasesMutex.Unlock()
+	if l, ok := c.leases[key]; ok {
+		l.timer.Stop()
+		delete(c.leases, key)
+	}
+}
+
+// hasLease reports whether a registration is lease based
+func (c *Config) hasLease(key string) bool {
+	c.leasesMutex.Lock()
+	defer c.leasesMutex.Unlock()
+	_, ok := c.leases[key]
+	return ok
+}
+
+func (c *Config) configHandlerRenew(msg *nats.Msg) {
+	var errText string = ""
+	var granted time.Duration
+	req, err := parseConfigRenewRequest(msg)
+	if err != nil {
+		fmt.Printf("Invalid renew request: %s\n", err)
+		errText = err.Error()
+	} else {
+		granted, err = c.renewLease(req.Subject)
+		if err != nil {
+			errText = err.Error()
+		}
+	}
+
+	res := schema.RenewSubResponseType{
+		Lease: int32(granted / time.Millisecond),
+		Error: errText,
+	}
+	r, err := c.createConfigRenewResponse(res)
+	if err != nil {
+		log.Printf("Failed to create renew response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
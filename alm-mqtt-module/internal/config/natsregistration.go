@@ -0,0 +1,283 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"alm-mqtt-module/pkg/avro"
+	schema "alm-mqtt-module/pkg/schema"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// subjectPlaceholder is replaced by the whole nats subject in topic templates
+	subjectPlaceholder = "subject"
+)
+
+// natsRegistration forwards the messages of a nats subject to MQTT
+type natsRegistration struct {
+	req          schema.RegisterNatsRequestType
+	topic        Template
+	subscription *nats.Subscription
+	stats        deliveryStats
+}
+
+func (c *Config) configHandlerRegisterNats(msg *nats.Msg) {
+	req, err := parseConfigRegisterNatsRequest(msg)
+	if err != nil {
+		fmt.Printf("Invalid register nats request: %s\n", err)
+		c.respondConfigRegisterNats(msg, schema.RegisterNatsResponseType{Error: err.Error()})
+		return
+	}
+	fmt.Printf("Register nats subject '%s'\n", req.Subject)
+
+	topic, err := c.validateRegisterNatsRequest(req)
+	if err != nil {
+		fmt.Println(err)
+		c.respondConfigRegisterNats(msg, schema.RegisterNatsResponseType{Error: err.Error()})
+		return
+	}
+
+	id := req.ID
+	if id == "" {
+		id = uuid.New().String()
+	} else if err := c.validateRequestedID(id); err != nil {
+		fmt.Println(err)
+		c.respondConfigRegisterNats(msg, schema.RegisterNatsResponseType{Error: err.Error()})
+		return
+	}
+	granted, err := c.registerNats(id, req, topic)
+	if err != nil {
+		fmt.Println(err)
+		c.respondConfigRegisterNats(msg, schema.RegisterNatsResponseType{Error: err.Error()})
+		return
+	}
+	c.respondConfigRegisterNats(msg, schema.RegisterNatsResponseType{
+		ID:    id,
+		Lease: int32(granted / time.Millisecond),
+	})
+}
+
+// validateRegisterNatsRequest checks a register nats request and returns the parsed topic template
+func (c *Config) validateRegisterNatsRequest(req schema.RegisterNatsRequestType) (Template, error) {
+	if err := ValidateSubjectFilter(req.Subject); err != nil {
+		return Template{}, err
+	}
+	// forwarding the subjects of the module itself would forward its own requests
+	first := strings.Split(req.Subject, subjectTokenSeparator)[0]
+	if first == c.basename || first == subjectSingleLevelWildcard || first == subjectMultiLevelWildcard {
+		return Template{}, fmt.Errorf("invalid subject '%s': must not match the subjects of '%s'", req.Subject, c.basename)
+	}
+	if req.QoS < 0 || req.QoS > 2 {
+		return Template{}, fmt.Errorf("invalid QoS %d", req.QoS)
+	}
+	if req.Lease < 0 {
+		return Template{}, fmt.Errorf("lease must not be negative")
+	}
+	text := req.Topic
+	if text == "" {
+		text = fmt.Sprintf("{%s}", subjectPlaceholder)
+	}
+	return NewTemplate(text, subjectPlaceholder, strings.Split(req.Subject, subjectTokenSeparator), subjectMultiLevelWildcard)
+}
+
+// validateRequestedID checks the ID of a lost nats registration requested by a client
+func (c *Config) validateRequestedID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("invalid id '%s': must be a uuid", id)
+	}
+	c.natsRegistrationsMutex.Lock()
+	defer c.natsRegistrationsMutex.Unlock()
+	if _, ok := c.natsRegistrations[id]; ok {
+		return fmt.Errorf("id '%s' is already registered", id)
+	}
+	return nil
+}
+
+// registerNats subscribes the nats subject of a registration and starts its lease. The granted lease is returned.
+func (c *Config) registerNats(id string, req schema.RegisterNatsRequestType, topic Template) (time.Duration, error) {
+	r := &natsRegistration{
+		req:   req,
+		topic: topic,
+	}
+	subscription, err := c.nats.Subscribe(req.Subject, func(msg *nats.Msg) {
+		c.forwardToMqtt(r, msg)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot subscribe '%s': %v", req.Subject, err)
+	}
+	r.subscription = subscription
+
+	c.natsRegistrationsMutex.Lock()
+	c.natsRegistrations[id] = r
+	c.natsRegistrationsMutex.Unlock()
+
+	var granted time.Duration
+	if req.Lease > 0 {
+		granted = c.startLease(id, time.Duration(req.Lease)*time.Millisecond, func() {
+			fmt.Printf("Lease of nats registration '%s' expired. Unregistering.\n", id)
+			if err := c.unregisterNats(id); err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+	c.storeNatsRegistration(id, req)
+	return granted, nil
+}
+
+// unregisterNats stops forwarding the nats subject of a registration
+func (c *Config) unregisterNats(id string) error {
+	c.stopLease(id)
+
+	c.natsRegistrationsMutex.Lock()
+	r, ok := c.natsRegistrations[id]
+	delete(c.natsRegistrations, id)
+	c.natsRegistrationsMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("nats registration '%s' was not registered at all", id)
+	}
+
+	c.removeNatsRegistration(id)
+	return r.subscription.Unsubscribe()
+}
+
+// forwardToMqtt publishes a nats message on the MQTT topic rendered for its subject
+func (c *Config) forwardToMqtt(r *natsRegistration, msg *nats.Msg) {
+	topic, err := r.topic.Render(strings.Split(msg.Subject, subjectTokenSeparator), topicLevelSeparator)
+	if err == nil {
+		err = ValidateTopicName(topic)
+	}
+	r.stats.add(err)
+	if err != nil {
+		fmt.Printf("Cannot forward message of '%s': %s\n", msg.Subject, err)
+		return
+	}
+	fmt.Printf("\t-> mqtt '%s'\n", topic)
+	c.pubChan <- paho.Publish{
+		QoS:        byte(r.req.QoS),
+		Retain:     r.req.Retain,
+		Topic:      topic,
+		Properties: &paho.PublishProperties{},
+		Payload:    msg.Data,
+	}
+}
+
+func (c *Config) configHandlerUnregisterNats(msg *nats.Msg) {
+	var errText string = ""
+	req, err := parseConfigUnregisterNatsRequest(msg)
+	if err != nil {
+		fmt.Printf("Invalid unregister nats request: %s\n", err)
+		errText = err.Error()
+	} else {
+		fmt.Printf("Unregister nats registration '%s'\n", req.ID)
+		if err := c.unregisterNats(req.ID); err != nil {
+			errText = err.Error()
+		}
+	}
+
+	res := schema.UnregisterNatsResponseType{
+		Error: errText,
+	}
+	r, err := c.createConfigUnregisterNatsResponse(res)
+	if err != nil {
+		log.Printf("Failed to create unregister nats response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
+
+func (c *Config) respondConfigRegisterNats(msg *nats.Msg, res schema.RegisterNatsResponseType) {
+	r, err := c.createConfigRegisterNatsResponse(res)
+	if err != nil {
+		log.Printf("Failed to create register nats response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
+
+func (c *Config) createConfigRegisterNatsResponse(res schema.RegisterNatsResponseType) ([]byte, error) {
+	msg := make(map[string]interface{})
+	msg["id"] = res.ID
+	msg["lease"] = res.Lease
+	msg["error"] = res.Error
+	return avro.Writer(msg, c.registerNatsResponseCodec)
+}
+
+func (c *Config) createConfigUnregisterNatsResponse(res schema.UnregisterNatsResponseType) ([]byte, error) {
+	msg := make(map[string]interface{})
+	msg["error"] = res.Error
+	return avro.Writer(msg, c.unregisterNatsResponseCodec)
+}
+
+func parseConfigRegisterNatsRequest(msg *nats.Msg) (schema.RegisterNatsRequestType, error) {
+	m, err := decodeRequest(msg.Data)
+	if err != nil {
+		return schema.RegisterNatsRequestType{}, err
+	}
+	req := schema.RegisterNatsRequestType{
+		QoS: 1,
+	}
+	if req.Subject, err = getString(m, "subject"); err != nil {
+		return schema.RegisterNatsRequestType{}, err
+	}
+	if _, ok := m["topic"]; ok {
+		if req.Topic, err = getString(m, "topic"); err != nil {
+			return schema.RegisterNatsRequestType{}, err
+		}
+	}
+	if _, ok := m["qos"]; ok {
+		if req.QoS, err = getInt32(m, "qos"); err != nil {
+			return schema.RegisterNatsRequestType{}, err
+		}
+	}
+	if _, ok := m["retain"]; ok {
+		if req.Retain, err = getBool(m, "retain"); err != nil {
+			return schema.RegisterNatsRequestType{}, err
+		}
+	}
+	if _, ok := m["lease"]; ok {
+		if req.Lease, err = getInt32(m, "lease"); err != nil {
+			return schema.RegisterNatsRequestType{}, err
+		}
+	}
+	if _, ok := m["id"]; ok {
+		if req.ID, err = getString(m, "id"); err != nil {
+			return schema.RegisterNatsRequestType{}, err
+		}
+	}
+	return req, nil
+}
+
+func parseConfigUnregisterNatsRequest(msg *nats.Msg) (schema.UnregisterNatsRequestType, error) {
+	m, err := decodeRequest(msg.Data)
+	if err != nil {
+		return schema.UnregisterNatsRequestType{}, err
+	}
+	id, err := getString(m, "id")
+	if err != nil {
+		return schema.UnregisterNatsRequestType{}, err
+	}
+	return schema.UnregisterNatsRequestType{
+		ID: id,
+	}, nil
+}
@@ -0,0 +1,302 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	schema "alm-mqtt-module/pkg/schema"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// registrationsFile is the content of the registrations file
+type registrationsFile struct {
+	Registrations     []registration           `json:"registrations"`
+	NatsRegistrations []storedNatsRegistration `json:"natsRegistrations"`
+}
+
+// registration is the persisted form of a registration
+type registration struct {
+	Subject       string `json:"subject"`
+	Topic         string `json:"topic"`
+	Lease         int32  `json:"lease,omitempty"`
+	Delivery      string `json:"delivery"`
+	Stream        string `json:"stream,omitempty"`
+	StreamSubject string `json:"streamSubject,omitempty"`
+	MaxAge        int64  `json:"maxAge,omitempty"`
+	MaxMsgs       int64  `json:"maxMsgs,omitempty"`
+	MaxBytes      int64  `json:"maxBytes,omitempty"`
+	// QoS is a pointer to restore registrations stored without QoS with QoS 1
+	QoS               *int32 `json:"qos,omitempty"`
+	NoLocal           bool   `json:"noLocal,omitempty"`
+	RetainAsPublished bool   `json:"retainAsPublished,omitempty"`
+	RetainHandling    int32  `json:"retainHandling,omitempty"`
+	QueueSize         int32  `json:"queueSize,omitempty"`
+	Overflow          string `json:"overflow,omitempty"`
+}
+
+// storedNatsRegistration is the persisted form of a nats registration
+type storedNatsRegistration struct {
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	Topic   string `json:"topic,omitempty"`
+	QoS     int32  `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+	Lease   int32  `json:"lease,omitempty"`
+}
+
+func newRegistration(subject string, req schema.RegisterSubRequestType) registration {
+	qos := req.QoS
+	return registration{
+		Subject:           subject,
+		Topic:             req.Topic,
+		Lease:             req.Lease,
+		Delivery:          req.Delivery,
+		Stream:            req.Stream,
+		StreamSubject:     req.StreamSubject,
+		MaxAge:            req.MaxAge,
+		MaxMsgs:           req.MaxMsgs,
+		MaxBytes:          req.MaxBytes,
+		QoS:               &qos,
+		NoLocal:           req.NoLocal,
+		RetainAsPublished: req.RetainAsPublished,
+		RetainHandling:    req.RetainHandling,
+		QueueSize:         req.QueueSize,
+		Overflow:          req.Overflow,
+	}
+}
+
+func (r registration) request() schema.RegisterSubRequestType {
+	req := schema.RegisterSubRequestType{
+		Topic:             r.Topic,
+		Lease:             r.Lease,
+		Delivery:          r.Delivery,
+		Stream:            r.Stream,
+		StreamSubject:     r.StreamSubject,
+		MaxAge:            r.MaxAge,
+		MaxMsgs:           r.MaxMsgs,
+		MaxBytes:          r.MaxBytes,
+		QoS:               1,
+		NoLocal:           r.NoLocal,
+		RetainAsPublished: r.RetainAsPublished,
+		RetainHandling:    r.RetainHandling,
+		QueueSize:         r.QueueSize,
+		Overflow:          r.Overflow,
+	}
+	if r.QoS != nil {
+		req.QoS = *r.QoS
+	}
+	if req.Delivery == "" {
+		req.Delivery = schema.DeliveryModeAck
+	}
+	if req.Overflow == "" {
+		req.Overflow = schema.OverflowDropOldest
+	}
+	return req
+}
+
+// PersistRegistrations stores all registrations in file from now on and restores the registrations
+// found in file. Must be called before the config requests are handled.
+// Restored registrations keep their subjects, leases start again with their full duration.
+func (c *Config) PersistRegistrations(file string) error {
+	f, err := loadRegistrations(file)
+	if err != nil {
+		return err
+	}
+
+	c.registrationsMutex.Lock()
+	c.registrationsFile = file
+	c.registrationsMutex.Unlock()
+
+	for _, r := range f.Registrations {
+		if err := c.restoreRegistration(r); err != nil {
+			fmt.Printf("Cannot restore registration of '%s' for '%s': %s\n", r.Subject, r.Topic, err)
+			continue
+		}
+		fmt.Printf("Restored registration of '%s' for '%s'\n", r.Subject, r.Topic)
+	}
+	for _, r := range f.NatsRegistrations {
+		if err := c.restoreNatsRegistration(r); err != nil {
+			fmt.Printf("Cannot restore nats registration '%s' for '%s': %s\n", r.ID, r.Subject, err)
+			continue
+		}
+		fmt.Printf("Restored nats registration '%s' for '%s'\n", r.ID, r.Subject)
+	}
+
+	// write back the file to drop registrations that could not be restored
+	c.registrationsMutex.Lock()
+	defer c.registrationsMutex.Unlock()
+	return c.saveRegistrations()
+}
+
+func (c *Config) restoreRegistration(r registration) error {
+	req := r.request()
+	if err := ValidateTopicFilter(req.Topic); err != nil {
+		return err
+	}
+	if err := validateSubscribeOptions(req); err != nil {
+		return err
+	}
+	if req.Delivery == schema.DeliveryModeStream {
+		if err := c.validateStreamRequest(req); err != nil {
+			return err
+		}
+	}
+	if err := c.channels.RegisterSubWithSubject(req.Topic, r.Subject); err != nil {
+		return err
+	}
+	if req.Delivery == schema.DeliveryModeStream {
+		if err := c.ensureStream(req, r.Subject); err != nil {
+			if _, err := c.channels.UnregisterSub(r.Subject); err != nil {
+				fmt.Println(err)
+			}
+			return err
+		}
+	}
+	c.register(req, r.Subject)
+	return nil
+}
+
+func (c *Config) restoreNatsRegistration(r storedNatsRegistration) error {
+	req := schema.RegisterNatsRequestType{
+		Subject: r.Subject,
+		Topic:   r.Topic,
+		QoS:     r.QoS,
+		Retain:  r.Retain,
+		Lease:   r.Lease,
+	}
+	topic, err := c.validateRegisterNatsRequest(req)
+	if err != nil {
+		return err
+	}
+	_, err = c.registerNats(r.ID, req, topic)
+	return err
+}
+
+// storeRegistration adds a registration to the registration file
+func (c *Config) storeRegistration(subject string, req schema.RegisterSubRequestType) {
+	c.registrationsMutex.Lock()
+	defer c.registrationsMutex.Unlock()
+	c.registrations[subject] = newRegistration(subject, req)
+	if err := c.saveRegistrations(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// removeRegistration removes a registration from the registration file and returns the removed registration
+func (c *Config) removeRegistration(subject string) (registration, bool) {
+	c.registrationsMutex.Lock()
+	defer c.registrationsMutex.Unlock()
+	r, ok := c.registrations[subject]
+	delete(c.registrations, subject)
+	if err := c.saveRegistrations(); err != nil {
+		fmt.Println(err)
+	}
+	return r, ok
+}
+
+// storeNatsRegistration adds a nats registration to the registration file
+func (c *Config) storeNatsRegistration(id string, req schema.RegisterNatsRequestType) {
+	c.registrationsMutex.Lock()
+	defer c.registrationsMutex.Unlock()
+	c.storedNatsRegistrations[id] = storedNatsRegistration{
+		ID:      id,
+		Subject: req.Subject,
+		Topic:   req.Topic,
+		QoS:     req.QoS,
+		Retain:  req.Retain,
+		Lease:   req.Lease,
+	}
+	if err := c.saveRegistrations(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// removeNatsRegistration removes a nats registration from the registration file
+func (c *Config) removeNatsRegistration(id string) {
+	c.registrationsMutex.Lock()
+	defer c.registrationsMutex.Unlock()
+	delete(c.storedNatsRegistrations, id)
+	if err := c.saveRegistrations(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// saveRegistrations writes all registrations to the registration file, if persistence is enabled.
+// Must be called with registrationsMutex held.
+func (c *Config) saveRegistrations() error {
+	if c.registrationsFile == "" {
+		return nil
+	}
+
+	f := registrationsFile{
+		Registrations:     make([]registration, 0, len(c.registrations)),
+		NatsRegistrations: make([]storedNatsRegistration, 0, len(c.storedNatsRegistrations)),
+	}
+	for _, r := range c.registrations {
+		f.Registrations = append(f.Registrations, r)
+	}
+	sort.Slice(f.Registrations, func(i, j int) bool { return f.Registrations[i].Subject < f.Registrations[j].Subject })
+	for _, r := range c.storedNatsRegistrations {
+		f.NatsRegistrations = append(f.NatsRegistrations, r)
+	}
+	sort.Slice(f.NatsRegistrations, func(i, j int) bool { return f.NatsRegistrations[i].ID < f.NatsRegistrations[j].ID })
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode registrations: %v", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a truncated file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(c.registrationsFile), filepath.Base(c.registrationsFile)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot save registrations: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot save registrations: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot save registrations: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), c.registrationsFile); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot save registrations: %v", err)
+	}
+	return nil
+}
+
+// loadRegistrations reads the registrations stored in file. A missing file contains no registrations.
+func loadRegistrations(file string) (registrationsFile, error) {
+	var f registrationsFile
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return f, fmt.Errorf("cannot read registrations: %v", err)
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("cannot decode registrations in '%s': %v", file, err)
+	}
+	return f, nil
+}
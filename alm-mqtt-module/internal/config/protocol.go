@@ -0,0 +1,82 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"alm-mqtt-module/internal/mqtt"
+	"alm-mqtt-module/pkg/schema"
+	"fmt"
+)
+
+// ProtocolVersionFunc returns the MQTT protocol version the broker is connected with
+type ProtocolVersionFunc func() byte
+
+// SetProtocolVersion sets the function used to query the MQTT protocol version. Requests using MQTT 5
+// features are rejected while the broker is connected using MQTT 3.1.1.
+func (c *Config) SetProtocolVersion(f ProtocolVersionFunc) {
+	c.protocolVersion = f
+}
+
+// mqtt311 reports whether the broker is connected using MQTT 3.1.1
+func (c *Config) mqtt311() bool {
+	return c.protocolVersion != nil && c.protocolVersion() == mqtt.Version311
+}
+
+func errRequiresMqtt5(feature string) error {
+	return fmt.Errorf("%s requires MQTT 5, the broker is connected using MQTT %s", feature, mqtt.VersionString(mqtt.Version311))
+}
+
+// validateRegisterProtocol rejects MQTT 5 subscription options while connected using MQTT 3.1.1
+func (c *Config) validateRegisterProtocol(req schema.RegisterSubRequestType) error {
+	if !c.mqtt311() {
+		return nil
+	}
+	switch {
+	case req.NoLocal:
+		return errRequiresMqtt5("subscription option 'noLocal'")
+	case req.RetainAsPublished:
+		return errRequiresMqtt5("subscription option 'retainAsPublished'")
+	case req.RetainHandling != 0:
+		return errRequiresMqtt5("subscription option 'retainHandling'")
+	}
+	return nil
+}
+
+// validatePublishProtocol rejects MQTT 5 properties of a publish request while connected using MQTT 3.1.1
+func (c *Config) validatePublishProtocol(req schema.PubRequestType) error {
+	if !c.mqtt311() {
+		return nil
+	}
+	switch {
+	case req.ContentType != "":
+		return errRequiresMqtt5("property 'contentType'")
+	case req.MessageExpiry != 0:
+		return errRequiresMqtt5("property 'messageExpiry'")
+	case len(req.UserProperties) > 0:
+		return errRequiresMqtt5("property 'userProperties'")
+	}
+	return nil
+}
+
+// validateRequestProtocol rejects request mode 'properties' while connected using MQTT 3.1.1
+func (c *Config) validateRequestProtocol(req schema.ReqResRequestType) error {
+	if c.mqtt311() && req.Mode == schema.RequestModeProperties {
+		return fmt.Errorf("%s. Use mode '%s' or '%s'", errRequiresMqtt5(fmt.Sprintf("request mode '%s'", req.Mode)),
+			schema.RequestModeTopic, schema.RequestModeEnvelope)
+	}
+	return nil
+}
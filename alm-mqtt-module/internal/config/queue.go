@@ -0,0 +1,175 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"alm-mqtt-module/internal/metrics"
+	schema "alm-mqtt-module/pkg/schema"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultQueueSize is the number of messages queued for a registration that does not request a queue size
+	defaultQueueSize = 20
+	// maxQueueSize limits the queue size a registration can request
+	maxQueueSize = 10000
+)
+
+// queuedMessage is a message waiting in the queue of a registration
+type queuedMessage struct {
+	data []byte
+	// received is the time the message arrived from the broker
+	received time.Time
+}
+
+// subscriberQueue buffers the messages of a registration until they are forwarded. Adding messages never
+// blocks, if the queue is full the overflow policy decides which message is dropped.
+type subscriberQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	messages []queuedMessage
+	size     int
+	overflow string
+	dropped  int64
+	closed   bool
+	// overflowed is set once a queue with overflow policy disconnect was full
+	overflowed bool
+}
+
+func newSubscriberQueue(size int, overflow string) *subscriberQueue {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	q := &subscriberQueue{
+		size:     size,
+		overflow: overflow,
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push adds a message without blocking. It returns true if the queue overflowed for the first time and the
+// registration has to be disconnected.
+func (q *subscriberQueue) push(data []byte) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	if q.overflowed {
+		q.dropped++
+		metrics.MessagesDropped.Inc()
+		return false
+	}
+	if len(q.messages) >= q.size {
+		q.dropped++
+		metrics.MessagesDropped.Inc()
+		switch q.overflow {
+		case schema.OverflowDropNewest:
+			return false
+		case schema.OverflowDisconnect:
+			q.overflowed = true
+			return true
+		default:
+			q.messages[0] = queuedMessage{}
+			q.messages = q.messages[1:]
+		}
+	}
+	q.messages = append(q.messages, queuedMessage{data: data, received: time.Now()})
+	q.cond.Signal()
+	return false
+}
+
+// pop returns the oldest message. It blocks until a message is available and returns false once the queue is closed.
+func (q *subscriberQueue) pop() (queuedMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.messages) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return queuedMessage{}, false
+	}
+	msg := q.messages[0]
+	q.messages[0] = queuedMessage{}
+	q.messages = q.messages[1:]
+	return msg, true
+}
+
+// close drops all queued messages and stops the forwarding
+func (q *subscriberQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.messages = nil
+	q.cond.Broadcast()
+}
+
+// isClosed reports whether the registration of the queue was removed
+func (q *subscriberQueue) isClosed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+// stats returns the number of queued and dropped messages
+func (q *subscriberQueue) stats() (queued int32, dropped int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return int32(len(q.messages)), q.dropped
+}
+
+// validateQueueOptions checks queue size and overflow policy of a register request
+func validateQueueOptions(req schema.RegisterSubRequestType) error {
+	if req.QueueSize < 0 || req.QueueSize > maxQueueSize {
+		return fmt.Errorf("queue size must be between 0 and %d", maxQueueSize)
+	}
+	switch req.Overflow {
+	case schema.OverflowDropOldest, schema.OverflowDropNewest, schema.OverflowDisconnect:
+	default:
+		return fmt.Errorf("unknown overflow policy '%s'", req.Overflow)
+	}
+	return nil
+}
+
+// Dispatch queues a MQTT message for all registrations of topic filters matching topic without blocking.
+// Registrations with overflow policy disconnect are removed if their queue is full.
+func (c *Config) Dispatch(topic string, retained bool, data []byte) {
+	var disconnect []string
+	c.MessageChannelsMutex.Lock()
+	queues, filters := c.getQueuesForTopic(topic, retained)
+	for _, filter := range filters {
+		metrics.MessagesReceived.WithLabelValues(filter).Inc()
+	}
+	for subject, queue := range queues {
+		if queue.push(data) {
+			disconnect = append(disconnect, subject)
+		}
+	}
+	c.MessageChannelsMutex.Unlock()
+
+	for _, subject := range disconnect {
+		fmt.Printf("Queue of subject '%s' overflowed. Unregistering.\n", subject)
+		go func(subject string) {
+			if _, err := c.cleanupSubject(subject); err != nil {
+				fmt.Println(err)
+			}
+		}(subject)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	schema "alm-mqtt-module/pkg/schema"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriberQueueOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	pushAll := func(q *subscriberQueue) []bool {
+		var disconnect []bool
+		for i := 0; i < 4; i++ {
+			disconnect = append(disconnect, q.push([]byte{byte(i)}))
+		}
+		return disconnect
+	}
+	popAll := func(q *subscriberQueue) []byte {
+		var data []byte
+		for {
+			queued, _ := q.stats()
+			if queued == 0 {
+				return data
+			}
+			msg, ok := q.pop()
+			assert.True(ok)
+			data = append(data, msg.data...)
+		}
+	}
+
+	q := newSubscriberQueue(2, schema.OverflowDropOldest)
+	assert.Equal([]bool{false, false, false, false}, pushAll(q))
+	_, dropped := q.stats()
+	assert.Equal(int64(2), dropped)
+	assert.Equal([]byte{2, 3}, popAll(q))
+
+	q = newSubscriberQueue(2, schema.OverflowDropNewest)
+	assert.Equal([]bool{false, false, false, false}, pushAll(q))
+	assert.Equal([]byte{0, 1}, popAll(q))
+
+	// the registration is disconnected once
+	q = newSubscriberQueue(2, schema.OverflowDisconnect)
+	assert.Equal([]bool{false, false, true, false}, pushAll(q))
+	queued, dropped := q.stats()
+	assert.Equal(int32(2), queued)
+	assert.Equal(int64(2), dropped)
+
+	// a closed queue stops the forwarding
+	q.close()
+	_, ok := q.pop()
+	assert.False(ok)
+	assert.False(q.push([]byte{4}))
+
+	assert.Equal(defaultQueueSize, newSubscriberQueue(0, schema.OverflowDropOldest).size)
+}
+
+func TestValidateQueueOptions(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateQueueOptions(schema.RegisterSubRequestType{Overflow: schema.OverflowDisconnect, QueueSize: 100}))
+	assert.NotNil(validateQueueOptions(schema.RegisterSubRequestType{Overflow: schema.OverflowDropOldest, QueueSize: -1}))
+	assert.NotNil(validateQueueOptions(schema.RegisterSubRequestType{Overflow: schema.OverflowDropOldest, QueueSize: maxQueueSize + 1}))
+	assert.NotNil(validateQueueOptions(schema.RegisterSubRequestType{Overflow: "block"}))
+}
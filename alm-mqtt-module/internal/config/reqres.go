@@ -0,0 +1,440 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"alm-mqtt-module/internal/metrics"
+	"alm-mqtt-module/pkg/avro"
+	schema "alm-mqtt-module/pkg/schema"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	requestTopicLevel  = "req"
+	responseTopicLevel = "res"
+	// defaultCorrelationField is the field carrying the correlation id in envelope mode
+	defaultCorrelationField = "correlationId"
+	// responseQoS is the QoS response topics are subscribed with
+	responseQoS = 2
+	// streamBufferSize is the number of responses buffered for a request relaying its responses to an inbox
+	streamBufferSize = 100
+	// maxRequestTimeout limits the time the module waits for the response of a request
+	maxRequestTimeout = time.Hour
+	// cancelledRequestTTL is the time the id of a request cancelled before it was started is remembered
+	cancelledRequestTTL = time.Minute
+)
+
+// pendingRequest is a request waiting for its response
+type pendingRequest struct {
+	response chan []byte
+	// cancel is closed when the client cancels the request
+	cancel    chan struct{}
+	cancelled bool
+	topic     string
+	started   time.Time
+	mode      string
+	// responseTopic is the topic subscribed for the response in topic and envelope mode
+	responseTopic    string
+	correlationField string
+}
+
+// validateRequestMode checks the request-reply mode settings of a request
+func validateRequestMode(req schema.ReqResRequestType) error {
+	switch req.Mode {
+	case schema.RequestModeProperties, schema.RequestModeTopic:
+		if req.ResponseTopic != "" || req.CorrelationField != "" {
+			return fmt.Errorf("response topic and correlation field are only supported in mode '%s'", schema.RequestModeEnvelope)
+		}
+	case schema.RequestModeEnvelope:
+		if req.ResponseTopic != "" {
+			if err := ValidateTopicName(req.ResponseTopic); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown request mode '%s'", req.Mode)
+	}
+	if strings.ContainsAny(req.ID, topicLevelSeparator+singleLevelWildcard+multiLevelWildcard) {
+		return fmt.Errorf("invalid request id '%s'", req.ID)
+	}
+	if req.Inbox != "" {
+		if err := ValidateSubject(req.Inbox); err != nil {
+			return err
+		}
+	} else if req.EndMarker != "" {
+		return fmt.Errorf("end marker requires an inbox")
+	}
+	return nil
+}
+
+// requestTimeout returns the time to wait for a response to req, limited to maxRequestTimeout
+func requestTimeout(req schema.ReqResRequestType) time.Duration {
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	if timeout > maxRequestTimeout {
+		return maxRequestTimeout
+	}
+	return timeout
+}
+
+// newRequest creates the MQTT message of a request with correlation id and the pending request waiting for its response
+func newRequest(req schema.ReqResRequestType, id string) (paho.Publish, *pendingRequest, error) {
+	pub := paho.Publish{
+		QoS:        1,
+		Retain:     false,
+		Topic:      req.Topic,
+		Properties: &paho.PublishProperties{},
+		Payload:    req.Payload,
+	}
+	// a request delivered after its timeout can not be answered anymore, neither if the broker holds it
+	// back nor if it waits in the publish spool
+	if timeout := requestTimeout(req); timeout > 0 {
+		expiry := uint32((timeout + time.Second - 1) / time.Second)
+		pub.Properties.MessageExpiry = &expiry
+	}
+	pending := &pendingRequest{
+		response: make(chan []byte, 1),
+		cancel:   make(chan struct{}),
+		started:  time.Now(),
+		mode:     req.Mode,
+	}
+	if req.Inbox != "" {
+		pending.response = make(chan []byte, streamBufferSize)
+	}
+
+	switch req.Mode {
+	case schema.RequestModeProperties:
+		pub.Properties.CorrelationData = []byte(id)
+		pub.Properties.ResponseTopic = fmt.Sprintf("%s%s", ResponseTopicStart, req.Topic)
+	case schema.RequestModeTopic:
+		pub.Topic = strings.Join([]string{req.Topic, requestTopicLevel, id}, topicLevelSeparator)
+		pending.responseTopic = strings.Join([]string{req.Topic, responseTopicLevel, id}, topicLevelSeparator)
+	case schema.RequestModeEnvelope:
+		var envelope map[string]interface{}
+		if err := json.Unmarshal(req.Payload, &envelope); err != nil || envelope == nil {
+			return paho.Publish{}, nil, fmt.Errorf("mode '%s' requires a JSON object payload", schema.RequestModeEnvelope)
+		}
+		pending.correlationField = req.CorrelationField
+		if pending.correlationField == "" {
+			pending.correlationField = defaultCorrelationField
+		}
+		envelope[pending.correlationField] = id
+		payload, err := json.Marshal(envelope)
+		if err != nil {
+			return paho.Publish{}, nil, err
+		}
+		pub.Payload = payload
+		pending.responseTopic = req.ResponseTopic
+		if pending.responseTopic == "" {
+			pending.responseTopic = strings.Join([]string{req.Topic, responseTopicLevel}, topicLevelSeparator)
+		}
+	}
+	pending.topic = pub.Topic
+	return pub, pending, nil
+}
+
+// requestResponse publishes a request on MQTT and waits for its response. It returns the response payload
+// or the error text.
+func (c *Config) requestResponse(req schema.ReqResRequestType) ([]byte, string) {
+	id, pending, err := c.startRequest(req)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err.Error()
+	}
+	defer c.removePendingRequest(id)
+
+	// Wait for response to arrive
+	select {
+	case res := <-pending.response:
+		fmt.Println("Received Response")
+		return res, ""
+	case <-pending.cancel:
+		fmt.Println("Request cancelled")
+		return nil, "request cancelled"
+	case <-time.After(requestTimeout(req)):
+		fmt.Println("Timeout expired")
+		metrics.RequestTimeouts.Inc()
+		return nil, "timeout expired"
+	}
+}
+
+// startRequest stores a pending request and publishes it on MQTT. The caller has to remove the pending request.
+func (c *Config) startRequest(req schema.ReqResRequestType) (string, *pendingRequest, error) {
+	id := req.ID
+	if id == "" {
+		// Create uuid as correlation data
+		id = uuid.New().String()
+	}
+	pub, pending, err := newRequest(req, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the response topic is subscribed before the request is published
+	if err := c.addPendingRequest(id, pending); err != nil {
+		return "", nil, err
+	}
+	c.pubChan <- pub
+	return id, pending, nil
+}
+
+// streamResponses publishes a request on MQTT and relays all its responses to the inbox of the request until
+// a response is the end marker or no response arrives within the timeout
+func (c *Config) streamResponses(req schema.ReqResRequestType) {
+	id, pending, err := c.startRequest(req)
+	if err != nil {
+		fmt.Println(err)
+		c.relayResponse(req.Inbox, schema.ReqResResponsetType{Error: err.Error(), End: true})
+		return
+	}
+	defer c.removePendingRequest(id)
+
+	received := 0
+	for {
+		select {
+		case res := <-pending.response:
+			received++
+			end := isEndMarker(req, res)
+			c.relayResponse(req.Inbox, schema.ReqResResponsetType{Payload: res, End: end})
+			if end {
+				return
+			}
+		case <-pending.cancel:
+			fmt.Println("Request cancelled")
+			c.relayResponse(req.Inbox, schema.ReqResResponsetType{Error: "request cancelled", End: true})
+			return
+		case <-time.After(requestTimeout(req)):
+			res := schema.ReqResResponsetType{End: true}
+			if received == 0 {
+				fmt.Println("Timeout expired")
+				metrics.RequestTimeouts.Inc()
+				res.Error = "timeout expired"
+			}
+			c.relayResponse(req.Inbox, res)
+			return
+		}
+	}
+}
+
+// relayResponse publishes a response on the inbox of a request
+func (c *Config) relayResponse(inbox string, res schema.ReqResResponsetType) {
+	r, err := c.createRequestResponseResponse(res)
+	if err != nil {
+		log.Printf("Failed to create request response response: %s", err)
+		return
+	}
+	if err := c.nats.Publish(inbox, r); err != nil {
+		log.Printf("Failed to relay response to '%s': %s", inbox, err)
+	}
+}
+
+// isEndMarker checks whether a response ends relaying the responses of a request
+func isEndMarker(req schema.ReqResRequestType, payload []byte) bool {
+	if req.EndMarker == "" {
+		return false
+	}
+	if req.Mode != schema.RequestModeEnvelope {
+		return string(payload) == req.EndMarker
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return false
+	}
+	return envelope[req.EndMarker] == true
+}
+
+// addPendingRequest stores a pending request and subscribes its response topic if needed
+func (c *Config) addPendingRequest(id string, pending *pendingRequest) error {
+	subscribe := false
+	c.requestsMutex.Lock()
+	if _, ok := c.requests[id]; ok {
+		c.requestsMutex.Unlock()
+		return fmt.Errorf("request '%s' is already pending", id)
+	}
+	if _, ok := c.cancelledRequests[id]; ok {
+		delete(c.cancelledRequests, id)
+		c.requestsMutex.Unlock()
+		return fmt.Errorf("request '%s' was cancelled", id)
+	}
+	c.requests[id] = pending
+	if pending.responseTopic != "" {
+		c.responseTopics[pending.responseTopic]++
+		subscribe = c.responseTopics[pending.responseTopic] == 1
+	}
+	c.requestsMutex.Unlock()
+
+	if subscribe {
+		c.newConfigRegisterChan <- pending.responseTopic
+	}
+	return nil
+}
+
+// cancelRequest stops waiting for the responses of a pending request. Requests are handled concurrently, so the
+// cancel may arrive before the request is pending. The id is then remembered to reject the request once it arrives.
+func (c *Config) cancelRequest(id string) error {
+	c.requestsMutex.Lock()
+	defer c.requestsMutex.Unlock()
+	now := time.Now()
+	for cancelled, at := range c.cancelledRequests {
+		if now.Sub(at) > cancelledRequestTTL {
+			delete(c.cancelledRequests, cancelled)
+		}
+	}
+	pending, ok := c.requests[id]
+	if !ok {
+		c.cancelledRequests[id] = now
+		return fmt.Errorf("request '%s' is not pending", id)
+	}
+	if pending.cancelled {
+		return fmt.Errorf("request '%s' is not pending", id)
+	}
+	pending.cancelled = true
+	close(pending.cancel)
+	return nil
+}
+
+func (c *Config) handlerRequestResponseCancel(msg *nats.Msg) {
+	var errText string = ""
+	req, err := parseRequestResponseCancelRequest(msg)
+	if err != nil {
+		fmt.Printf("Invalid cancel request: %s\n", err)
+		errText = err.Error()
+	} else {
+		fmt.Printf("Cancel request '%s'\n", req.ID)
+		if err := c.cancelRequest(req.ID); err != nil {
+			errText = err.Error()
+		}
+	}
+
+	msgMap := make(map[string]interface{})
+	msgMap["error"] = errText
+	r, err := avro.Writer(msgMap, c.reqResCancelResponseCodec)
+	if err != nil {
+		log.Printf("Failed to create cancel response: %s", err)
+		return
+	}
+	respond(msg, r)
+}
+
+func parseRequestResponseCancelRequest(msg *nats.Msg) (schema.ReqResCancelRequestType, error) {
+	m, err := decodeRequest(msg.Data)
+	if err != nil {
+		return schema.ReqResCancelRequestType{}, err
+	}
+	id, err := getString(m, "id")
+	if err != nil {
+		return schema.ReqResCancelRequestType{}, err
+	}
+	return schema.ReqResCancelRequestType{
+		ID: id,
+	}, nil
+}
+
+// removePendingRequest removes a pending request and unsubscribes its response topic if no longer needed
+func (c *Config) removePendingRequest(id string) {
+	unsubscribe := ""
+	c.requestsMutex.Lock()
+	if pending, ok := c.requests[id]; ok {
+		delete(c.requests, id)
+		if pending.responseTopic != "" {
+			c.responseTopics[pending.responseTopic]--
+			if c.responseTopics[pending.responseTopic] <= 0 {
+				delete(c.responseTopics, pending.responseTopic)
+				unsubscribe = pending.responseTopic
+			}
+		}
+	}
+	c.requestsMutex.Unlock()
+
+	if unsubscribe != "" {
+		c.newConfigUnregisterChan <- unsubscribe
+	}
+}
+
+// getResponseSubscriptions returns the response topics of all pending requests
+func (c *Config) getResponseSubscriptions() map[string]paho.SubscribeOptions {
+	c.requestsMutex.Lock()
+	defer c.requestsMutex.Unlock()
+	subscriptions := make(map[string]paho.SubscribeOptions, len(c.responseTopics))
+	for topic := range c.responseTopics {
+		subscriptions[topic] = paho.SubscribeOptions{QoS: responseQoS}
+	}
+	return subscriptions
+}
+
+// HandleResponse passes a MQTT message to the pending request it responds to.
+// It reports whether msg is a response and must not be processed any further.
+func (c *Config) HandleResponse(msg *paho.Publish) bool {
+	c.requestsMutex.Lock()
+	defer c.requestsMutex.Unlock()
+
+	if strings.HasPrefix(msg.Topic, ResponseTopicStart) {
+		if msg.Properties == nil {
+			return true
+		}
+		id := string(msg.Properties.CorrelationData)
+		if pending, ok := c.requests[id]; ok && pending.mode == schema.RequestModeProperties {
+			deliverResponse(pending, msg.Payload)
+		}
+		return true
+	}
+
+	if _, ok := c.responseTopics[msg.Topic]; !ok {
+		return false
+	}
+	var envelope map[string]interface{}
+	for id, pending := range c.requests {
+		if pending.responseTopic != msg.Topic {
+			continue
+		}
+		switch pending.mode {
+		case schema.RequestModeTopic:
+			deliverResponse(pending, msg.Payload)
+			return true
+		case schema.RequestModeEnvelope:
+			if envelope == nil {
+				if err := json.Unmarshal(msg.Payload, &envelope); err != nil || envelope == nil {
+					return false
+				}
+			}
+			if envelope[pending.correlationField] == id {
+				deliverResponse(pending, msg.Payload)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deliverResponse passes a response to a pending request. Responses exceeding the buffer of the request are
+// dropped, so requests waiting for a single response only get the first one.
+func deliverResponse(pending *pendingRequest, payload []byte) {
+	select {
+	case pending.response <- payload:
+	default:
+		if cap(pending.response) > 1 {
+			log.Printf("Dropping response, too many responses pending")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	schema "alm-mqtt-module/pkg/schema"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// streamNotFound is the description of the JetStream API error for a missing stream. nats.go returns it
+// as untyped error.
+const streamNotFound = "stream not found"
+
+// streamSubject returns the subject the messages of a stream registration are stored with. As each subject
+// is used by a single registration, the default subject allows only one registration per stream. Further
+// registrations of the stream have to request a subject.
+func (c *Config) streamSubject(req schema.RegisterSubRequestType) string {
+	if req.StreamSubject != "" {
+		return req.StreamSubject
+	}
+	return fmt.Sprintf("%s.stream.%s", c.basename, req.Stream)
+}
+
+// validateStreamRequest checks the stream related settings of a register request
+func (c *Config) validateStreamRequest(req schema.RegisterSubRequestType) error {
+	if req.Stream == "" {
+		return fmt.Errorf("delivery mode 'stream' requires a stream name")
+	}
+	if strings.ContainsAny(req.Stream, ".*> \t") {
+		return fmt.Errorf("invalid stream name '%s'", req.Stream)
+	}
+	if strings.ContainsAny(req.StreamSubject, "*> \t") {
+		return fmt.Errorf("invalid stream subject '%s': wildcards are not allowed", req.StreamSubject)
+	}
+	if strings.Split(req.StreamSubject, ".")[0] == c.basename {
+		return fmt.Errorf("invalid stream subject '%s': must not match the subjects of '%s'", req.StreamSubject, c.basename)
+	}
+	if req.MaxAge < 0 || req.MaxMsgs < 0 || req.MaxBytes < 0 {
+		return fmt.Errorf("stream limits must not be negative")
+	}
+	return nil
+}
+
+// jetStream returns the JetStream context of the nats connection
+func (c *Config) jetStream() (nats.JetStreamContext, error) {
+	c.jsMutex.Lock()
+	defer c.jsMutex.Unlock()
+	if c.js == nil {
+		js, err := c.nats.JetStream()
+		if err != nil {
+			return nil, err
+		}
+		c.js = js
+	}
+	return c.js, nil
+}
+
+// ensureStream creates the JetStream stream of a registration or adds the subject to the stream if it
+// already exists. The limits of the request only apply to created streams, an existing stream keeps its
+// configuration.
+func (c *Config) ensureStream(req schema.RegisterSubRequestType, subject string) error {
+	js, err := c.jetStream()
+	if err != nil {
+		return err
+	}
+
+	info, err := js.StreamInfo(req.Stream)
+	if err != nil && err.Error() == streamNotFound {
+		cfg := &nats.StreamConfig{
+			Name:      req.Stream,
+			Subjects:  []string{subject},
+			Retention: nats.LimitsPolicy,
+			Storage:   nats.FileStorage,
+			MaxAge:    time.Duration(req.MaxAge) * time.Millisecond,
+			MaxMsgs:   -1,
+			MaxBytes:  -1,
+		}
+		if req.MaxMsgs > 0 {
+			cfg.MaxMsgs = req.MaxMsgs
+		}
+		if req.MaxBytes > 0 {
+			cfg.MaxBytes = req.MaxBytes
+		}
+		if _, err := js.AddStream(cfg); err != nil {
+			return fmt.Errorf("cannot create stream '%s': %v", req.Stream, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get stream '%s': %v", req.Stream, err)
+	}
+
+	for _, s := range info.Config.Subjects {
+		if s == subject {
+			return nil
+		}
+	}
+	cfg := info.Config
+	cfg.Subjects = append(append([]string{}, info.Config.Subjects...), subject)
+	if _, err := js.UpdateStream(&cfg); err != nil {
+		return fmt.Errorf("cannot update stream '%s': %v", req.Stream, err)
+	}
+	return nil
+}
+
+// removeStreamSubject removes the subject of an unregistered registration from its stream. The stream
+// and the stored messages are kept. The last subject is not removed, as a stream requires a subject.
+func (c *Config) removeStreamSubject(stream string, subject string) error {
+	js, err := c.jetStream()
+	if err != nil {
+		return err
+	}
+	info, err := js.StreamInfo(stream)
+	if err != nil {
+		return fmt.Errorf("cannot get stream '%s': %v", stream, err)
+	}
+
+	var subjects []string
+	for _, s := range info.Config.Subjects {
+		if s != subject {
+			subjects = append(subjects, s)
+		}
+	}
+	if len(subjects) == 0 || len(subjects) == len(info.Config.Subjects) {
+		return nil
+	}
+	cfg := info.Config
+	cfg.Subjects = subjects
+	if _, err := js.UpdateStream(&cfg); err != nil {
+		return fmt.Errorf("cannot update stream '%s': %v", stream, err)
+	}
+	return nil
+}
+
+// publishToStream stores a message in the stream of a registration
+func (c *Config) publishToStream(subject string, data []byte) error {
+	js, err := c.jetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.Publish(subject, data)
+	return err
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	subjectSingleLevelWildcard = "*"
+	subjectMultiLevelWildcard  = ">"
+	subjectTokenSeparator      = "."
+)
+
+// ValidateSubjectFilter checks that a nats subject used for subscribing is well formed
+func ValidateSubjectFilter(subject string) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("invalid subject '%s'", subject)
+	}
+	tokens := strings.Split(subject, subjectTokenSeparator)
+	for i, token := range tokens {
+		if token == "" {
+			return fmt.Errorf("invalid subject '%s': empty token", subject)
+		}
+		if strings.Contains(token, subjectMultiLevelWildcard) && (token != subjectMultiLevelWildcard || i != len(tokens)-1) {
+			return fmt.Errorf("invalid subject '%s': '>' must occupy the last token", subject)
+		}
+		if strings.Contains(token, subjectSingleLevelWildcard) && token != subjectSingleLevelWildcard {
+			return fmt.Errorf("invalid subject '%s': '*' must occupy an entire token", subject)
+		}
+	}
+	return nil
+}
+
+// ValidateSubject checks that a nats subject used for publishing is well formed and contains no wildcards
+func ValidateSubject(subject string) error {
+	if strings.ContainsAny(subject, subjectSingleLevelWildcard+subjectMultiLevelWildcard) {
+		return fmt.Errorf("invalid subject '%s': wildcards are not allowed", subject)
+	}
+	return ValidateSubjectFilter(subject)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	schema "alm-mqtt-module/pkg/schema"
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	// retainHandlingNever requests to not send retained messages on subscribe
+	retainHandlingNever = 2
+	// sharedSubscriptionPrefix starts the topic filters of MQTT 5 shared subscriptions
+	sharedSubscriptionPrefix = "$share/"
+)
+
+// validateSubscribeOptions checks the subscription options of a register request
+func validateSubscribeOptions(req schema.RegisterSubRequestType) error {
+	if req.QoS < 0 || req.QoS > 2 {
+		return fmt.Errorf("invalid QoS %d", req.QoS)
+	}
+	if req.RetainHandling < 0 || req.RetainHandling > 2 {
+		return fmt.Errorf("invalid retain handling %d", req.RetainHandling)
+	}
+	if req.NoLocal && strings.HasPrefix(req.Topic, sharedSubscriptionPrefix) {
+		return fmt.Errorf("no local is not allowed for shared subscriptions")
+	}
+	return nil
+}
+
+// subscribeOptions returns the subscription options requested by a register request
+func subscribeOptions(req schema.RegisterSubRequestType) paho.SubscribeOptions {
+	return paho.SubscribeOptions{
+		QoS:               byte(req.QoS),
+		NoLocal:           req.NoLocal,
+		RetainAsPublished: req.RetainAsPublished,
+		RetainHandling:    byte(req.RetainHandling),
+	}
+}
+
+// MergeSubscribeOptions returns the options of a subscription that serves the consumers of a and b.
+// It uses the highest QoS and the most permissive options of both.
+func MergeSubscribeOptions(a, b paho.SubscribeOptions) paho.SubscribeOptions {
+	merged := a
+	if b.QoS > merged.QoS {
+		merged.QoS = b.QoS
+	}
+	merged.NoLocal = a.NoLocal && b.NoLocal
+	merged.RetainAsPublished = a.RetainAsPublished || b.RetainAsPublished
+	if b.RetainHandling < merged.RetainHandling {
+		merged.RetainHandling = b.RetainHandling
+	}
+	return merged
+}
+
+// GetSubscriptions returns all MQTT topic filters that currently have at least one registration or
+// pending request together with the subscription options serving all of them
+func (c *Config) GetSubscriptions() map[string]paho.SubscribeOptions {
+	c.MessageChannelsMutex.Lock()
+	subscriptions := make(map[string]paho.SubscribeOptions, len(c.MessageChannels))
+	for topic := range c.MessageChannels {
+		if options, ok := c.subscriptionOptions(topic); ok {
+			subscriptions[topic] = options
+		}
+	}
+	c.MessageChannelsMutex.Unlock()
+
+	for topic, options := range c.getResponseSubscriptions() {
+		if existing, ok := subscriptions[topic]; ok {
+			options = MergeSubscribeOptions(existing, options)
+		}
+		subscriptions[topic] = options
+	}
+	return subscriptions
+}
+
+// subscriptionOptions merges the options of all registrations of a topic filter. Must be called with
+// MessageChannelsMutex held.
+func (c *Config) subscriptionOptions(topic string) (paho.SubscribeOptions, bool) {
+	mappings := c.MessageChannels[topic]
+	if len(mappings) == 0 {
+		return paho.SubscribeOptions{}, false
+	}
+	options := mappings[0].options
+	for _, mapping := range mappings[1:] {
+		options = MergeSubscribeOptions(options, mapping.options)
+	}
+	return options, true
+}
@@ -0,0 +1,36 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeSubscribeOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	a := paho.SubscribeOptions{QoS: 0, NoLocal: true, RetainAsPublished: false, RetainHandling: 2}
+	b := paho.SubscribeOptions{QoS: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 1}
+	assert.Equal(paho.SubscribeOptions{QoS: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 1}, MergeSubscribeOptions(a, b))
+	assert.Equal(MergeSubscribeOptions(a, b), MergeSubscribeOptions(b, a))
+
+	c := paho.SubscribeOptions{QoS: 1}
+	assert.Equal(paho.SubscribeOptions{QoS: 2, NoLocal: false, RetainAsPublished: true, RetainHandling: 0}, MergeSubscribeOptions(MergeSubscribeOptions(a, b), c))
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// restPlaceholder is replaced by all levels matched by the multi-level wildcard of the source
+	restPlaceholder = "rest"
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Template renders a target name from the levels of a source name.
+// Supported placeholders are the whole source name (e.g. '{topic}'), single levels ('{1}', '{2}', ...)
+// and the levels matched by the multi-level wildcard of the source filter ('{rest}').
+type Template struct {
+	text string
+	// source is the name of the placeholder that is replaced by the whole source name
+	source string
+	// levels is the number of levels of the source filter
+	levels int
+	// restIndex is the level of the multi-level wildcard in the source filter or -1 if there is none
+	restIndex int
+}
+
+// NewTemplate parses text and checks that all placeholders can be rendered for names matching filterLevels
+func NewTemplate(text string, source string, filterLevels []string, multiLevelWildcard string) (Template, error) {
+	t := Template{
+		text:      text,
+		source:    source,
+		levels:    len(filterLevels),
+		restIndex: -1,
+	}
+	if text == "" {
+		return t, fmt.Errorf("empty template")
+	}
+	if filterLevels[len(filterLevels)-1] == multiLevelWildcard {
+		t.restIndex = len(filterLevels) - 1
+	}
+
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(text, -1) {
+		name := match[1]
+		switch {
+		case name == source:
+		case name == restPlaceholder:
+			if t.restIndex < 0 {
+				return t, fmt.Errorf("invalid template '%s': '{%s}' requires a multi-level wildcard in the source", text, restPlaceholder)
+			}
+		default:
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 1 {
+				return t, fmt.Errorf("invalid template '%s': unknown placeholder '{%s}'", text, name)
+			}
+			if t.restIndex < 0 && n > t.levels {
+				return t, fmt.Errorf("invalid template '%s': source has only %d levels", text, t.levels)
+			}
+		}
+	}
+	if strings.ContainsAny(placeholderRegexp.ReplaceAllString(text, ""), "{}") {
+		return t, fmt.Errorf("invalid template '%s': unbalanced braces", text)
+	}
+	return t, nil
+}
+
+// Render returns the target name for the levels of a concrete source name. sep is the level separator of the target.
+func (t Template) Render(levels []string, sep string) (string, error) {
+	var err error
+	out := placeholderRegexp.ReplaceAllStringFunc(t.text, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case t.source:
+			return strings.Join(levels, sep)
+		case restPlaceholder:
+			if t.restIndex >= len(levels) {
+				return ""
+			}
+			return strings.Join(levels[t.restIndex:], sep)
+		}
+		n, _ := strconv.Atoi(name)
+		if n > len(levels) {
+			err = fmt.Errorf("cannot render '%s': source has only %d levels", t.text, len(levels))
+			return ""
+		}
+		return levels[n-1]
+	})
+	return out, err
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateRender(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		filter string
+		text   string
+		name   string
+		want   string
+	}{
+		{"line1/plc/#", "plant.line1", "line1/plc/a/b", "plant.line1"},
+		{"line1/plc/#", "plant.{topic}", "line1/plc/a/b", "plant.line1.plc.a.b"},
+		{"line1/plc/#", "plant.{1}.{rest}", "line1/plc/a/b", "plant.line1.a.b"},
+		{"+/plc/+", "plant.{1}.{3}", "line2/plc/temp", "plant.line2.temp"},
+		{"line1/plc/#", "plant.{4}", "line1/plc/a/b", "plant.b"},
+	}
+	for _, test := range tests {
+		tmpl, err := NewTemplate(test.text, "topic", strings.Split(test.filter, "/"), multiLevelWildcard)
+		assert.Nil(err)
+		got, err := tmpl.Render(strings.Split(test.name, "/"), ".")
+		assert.Nil(err)
+		assert.Equal(test.want, got)
+	}
+
+	// level beyond the matched topic
+	tmpl, err := NewTemplate("plant.{5}", "topic", []string{"line1", "#"}, multiLevelWildcard)
+	assert.Nil(err)
+	_, err = tmpl.Render([]string{"line1", "a"}, ".")
+	assert.NotNil(err)
+}
+
+func TestTemplateValidation(t *testing.T) {
+	assert := assert.New(t)
+	invalid := []struct {
+		filter string
+		text   string
+	}{
+		{"line1/plc", ""},
+		{"line1/plc", "plant.{rest}"},
+		{"line1/plc", "plant.{3}"},
+		{"line1/plc", "plant.{0}"},
+		{"line1/plc", "plant.{unknown}"},
+		{"line1/plc", "plant.{1"},
+	}
+	for _, test := range invalid {
+		_, err := NewTemplate(test.text, "topic", strings.Split(test.filter, "/"), multiLevelWildcard)
+		assert.NotNil(err, test.text)
+	}
+}
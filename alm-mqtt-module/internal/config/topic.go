@@ -0,0 +1,100 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+	topicLevelSeparator = "/"
+)
+
+// ValidateTopicFilter checks that a MQTT topic filter is well formed according to the MQTT specification
+func ValidateTopicFilter(filter string) error {
+	if strings.HasPrefix(filter, sharedSubscriptionPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(filter, sharedSubscriptionPrefix), topicLevelSeparator, 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], singleLevelWildcard+multiLevelWildcard) {
+			return fmt.Errorf("invalid shared subscription '%s'", filter)
+		}
+		filter = parts[1]
+	}
+	if filter == "" {
+		return fmt.Errorf("empty topic filter")
+	}
+	levels := strings.Split(filter, topicLevelSeparator)
+	for i, level := range levels {
+		if strings.Contains(level, multiLevelWildcard) {
+			if level != multiLevelWildcard || i != len(levels)-1 {
+				return fmt.Errorf("invalid topic filter '%s': '#' must occupy the last level", filter)
+			}
+		}
+		if strings.Contains(level, singleLevelWildcard) && level != singleLevelWildcard {
+			return fmt.Errorf("invalid topic filter '%s': '+' must occupy an entire level", filter)
+		}
+	}
+	return nil
+}
+
+// ValidateTopicName checks that a MQTT topic name used for publishing is not empty and contains no wildcards
+func ValidateTopicName(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("empty topic")
+	}
+	if strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard) {
+		return fmt.Errorf("invalid topic '%s': wildcards are not allowed", topic)
+	}
+	return nil
+}
+
+// MatchTopic reports whether a concrete MQTT topic name matches a topic filter.
+// Topics starting with '$' are not matched by filters starting with a wildcard.
+// Shared subscriptions match the topics of their topic filter.
+func MatchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(filter, sharedSubscriptionPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(filter, sharedSubscriptionPrefix), topicLevelSeparator, 2)
+		if len(parts) != 2 {
+			return false
+		}
+		filter = parts[1]
+	}
+	if filter == "" || topic == "" {
+		return false
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, singleLevelWildcard) || strings.HasPrefix(filter, multiLevelWildcard)) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, topicLevelSeparator)
+	topicLevels := strings.Split(topic, topicLevelSeparator)
+	for i, level := range filterLevels {
+		if level == multiLevelWildcard {
+			// '#' also matches the parent level, e.g. 'a/#' matches 'a'
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != singleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sensors/temperature", "sensors/temperature", true},
+		{"sensors/temperature", "sensors/humidity", false},
+		{"sensors/temperature", "sensors/temperature/raw", false},
+		{"sensors/+/temperature", "sensors/1/temperature", true},
+		{"sensors/+/temperature", "sensors/1/2/temperature", false},
+		{"sensors/+/temperature", "sensors//temperature", true},
+		{"sensors/+", "sensors", false},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"plant/#", "plant", true},
+		{"plant/#", "plant/line1", true},
+		{"plant/#", "plant/line1/plc", true},
+		{"plant/#", "plants/line1", false},
+		{"#", "any/topic/at/all", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"$share/group/plant/#", "plant/line1", true},
+		{"$share/group/plant/#", "other", false},
+		{"", "topic", false},
+		{"topic", "", false},
+	}
+	for _, test := range tests {
+		assert.Equal(test.match, MatchTopic(test.filter, test.topic), "filter '%s', topic '%s'", test.filter, test.topic)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	assert := assert.New(t)
+	valid := []string{"a", "a/b", "a/+/c", "+", "#", "a/#", "+/+/#", "/", "$SYS/#", "$share/group/a/#"}
+	for _, filter := range valid {
+		assert.Nil(ValidateTopicFilter(filter), filter)
+	}
+	invalid := []string{"", "a#", "a/#/c", "a/b#", "a+", "a/+b/c", "#/a", "$share/group", "$share//a", "$share/gr+oup/a"}
+	for _, filter := range invalid {
+		assert.NotNil(ValidateTopicFilter(filter), filter)
+	}
+}
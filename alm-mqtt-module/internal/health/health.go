@@ -0,0 +1,159 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health reports whether the module is alive and ready
+package health
+
+import (
+	"alm-mqtt-module/pkg/avro"
+	"alm-mqtt-module/pkg/schema"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Monitor tracks the connections of the module and the time the last message was processed
+type Monitor struct {
+	nats          *nats.Conn
+	mqttConnected func() bool
+	// maxIdle is the time without processed message after which the module is not live anymore. 0 disables the check.
+	maxIdle time.Duration
+	// maxDisconnected is the time without connection to the broker after which the module is not live anymore.
+	// 0 disables the check.
+	maxDisconnected time.Duration
+	started         time.Time
+
+	mutex       sync.Mutex
+	lastMessage time.Time
+	// disconnectedSince is the time the connection to the broker was lost, zero while connected
+	disconnectedSince time.Time
+}
+
+// NewMonitor creates a monitor. mqttConnected reports whether the connection to the MQTT broker is established.
+// The monitor considers the broker disconnected since its creation until ConnectionUp is called.
+func NewMonitor(natsConn *nats.Conn, mqttConnected func() bool, maxIdle, maxDisconnected time.Duration) *Monitor {
+	now := time.Now()
+	return &Monitor{
+		nats:              natsConn,
+		mqttConnected:     mqttConnected,
+		maxIdle:           maxIdle,
+		maxDisconnected:   maxDisconnected,
+		started:           now,
+		disconnectedSince: now,
+	}
+}
+
+// ConnectionUp records that the connection to the broker was established
+func (m *Monitor) ConnectionUp() {
+	m.mutex.Lock()
+	m.disconnectedSince = time.Time{}
+	m.mutex.Unlock()
+}
+
+// ConnectionLost records that the connection to the broker was lost
+func (m *Monitor) ConnectionLost() {
+	m.mutex.Lock()
+	if m.disconnectedSince.IsZero() {
+		m.disconnectedSince = time.Now()
+	}
+	m.mutex.Unlock()
+}
+
+// MessageProcessed records that a message was processed
+func (m *Monitor) MessageProcessed() {
+	m.mutex.Lock()
+	m.lastMessage = time.Now()
+	m.mutex.Unlock()
+}
+
+// Status returns the current health of the module
+func (m *Monitor) Status() schema.HealthType {
+	now := time.Now()
+	status := schema.HealthType{
+		NatsConnected:    m.nats.IsConnected(),
+		MqttConnected:    m.mqttConnected(),
+		SinceLastMessage: -1,
+	}
+
+	m.mutex.Lock()
+	lastMessage := m.lastMessage
+	disconnectedSince := m.disconnectedSince
+	m.mutex.Unlock()
+
+	idleSince := m.started
+	if !lastMessage.IsZero() {
+		status.SinceLastMessage = int64(now.Sub(lastMessage) / time.Millisecond)
+		idleSince = lastMessage
+	}
+	// a closed nats connection is never restored. The session reconnects to the broker by itself, but if it
+	// does not succeed for too long, a restart is the last resort.
+	status.Live = !m.nats.IsClosed() && (m.maxIdle == 0 || now.Sub(idleSince) <= m.maxIdle) &&
+		(m.maxDisconnected == 0 || disconnectedSince.IsZero() || now.Sub(disconnectedSince) <= m.maxDisconnected)
+	status.Ready = status.NatsConnected && status.MqttConnected
+	return status
+}
+
+// Handle adds the `/healthz` and `/readyz` endpoints to mux. They respond with the status and
+// 503 Service Unavailable if the module is not live or ready.
+func (m *Monitor) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := m.Status()
+		writeStatus(w, status, status.Live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := m.Status()
+		writeStatus(w, status, status.Ready)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, status schema.HealthType, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to write health status: %s", err)
+	}
+}
+
+// HandleRequests answers health requests on `<basename>.health`
+func (m *Monitor) HandleRequests(basename string) error {
+	_, err := m.nats.Subscribe(fmt.Sprintf("%s.health", basename), m.handler)
+	return err
+}
+
+func (m *Monitor) handler(msg *nats.Msg) {
+	status := m.Status()
+	r, err := avro.Writer(map[string]interface{}{
+		"live":             status.Live,
+		"ready":            status.Ready,
+		"natsConnected":    status.NatsConnected,
+		"mqttConnected":    status.MqttConnected,
+		"sinceLastMessage": status.SinceLastMessage,
+	}, schema.HealthCodec)
+	if err != nil {
+		log.Printf("Failed to create health response: %s", err)
+		return
+	}
+	if err := msg.Respond(r); err != nil {
+		log.Printf("Failed to respond to request on '%s': %s", msg.Subject, err)
+	}
+}
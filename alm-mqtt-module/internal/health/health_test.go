@@ -0,0 +1,119 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"alm-mqtt-module/pkg/client"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Nil(err)
+	defer nc.Close()
+
+	mqttConnected := false
+	m := NewMonitor(nc, func() bool { return mqttConnected }, time.Hour, time.Hour)
+	assert.Nil(m.HandleRequests("module1"))
+	mux := http.NewServeMux()
+	m.Handle(mux)
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var status map[string]interface{}
+		assert.Nil(json.Unmarshal(rec.Body.Bytes(), &status))
+		return rec.Code, status
+	}
+
+	// not ready while the broker is not connected
+	code, status := get("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(false, status["mqttConnected"])
+	assert.Equal(true, status["natsConnected"])
+	code, status = get("/healthz")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(float64(-1), status["sinceLastMessage"])
+
+	mqttConnected = true
+	m.MessageProcessed()
+	code, _ = get("/readyz")
+	assert.Equal(http.StatusOK, code)
+
+	res, err := client.NewClient("module1", nc).Health()
+	assert.Nil(err)
+	assert.True(res.Live)
+	assert.True(res.Ready)
+	assert.True(res.SinceLastMessage >= 0)
+
+	// not live without messages within the maximum idle time
+	m.maxIdle = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	code, status = get("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(false, status["live"])
+	m.maxIdle = 0
+
+	// not live if the broker was not connected within the maximum disconnected time
+	m.ConnectionUp()
+	m.maxDisconnected = 20 * time.Millisecond
+	// the time connected without any probe does not count as disconnected
+	time.Sleep(50 * time.Millisecond)
+	mqttConnected = false
+	m.ConnectionLost()
+	code, _ = get("/healthz")
+	assert.Equal(http.StatusOK, code)
+	time.Sleep(50 * time.Millisecond)
+	code, _ = get("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	mqttConnected = true
+	m.ConnectionUp()
+	code, _ = get("/healthz")
+	assert.Equal(http.StatusOK, code)
+}
+
+func TestHealthNeverConnected(t *testing.T) {
+	assert := assert.New(t)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Nil(err)
+	defer nc.Close()
+
+	// the broker counts as disconnected since the start until the first connect
+	m := NewMonitor(nc, func() bool { return false }, 0, 20*time.Millisecond)
+	assert.True(m.Status().Live)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(m.Status().Live)
+	m.ConnectionUp()
+	assert.True(m.Status().Live)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics contains the Prometheus metrics of the module
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "alm_mqtt"
+
+var (
+	// MessagesReceived counts the MQTT messages received per topic filter of the registrations
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "MQTT messages received per registered topic filter",
+	}, []string{"filter"})
+
+	// MessagesDelivered counts the messages forwarded to the subscribers per delivery mode
+	MessagesDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_delivered_total",
+		Help:      "Messages forwarded to nats subscribers per delivery mode",
+	}, []string{"delivery"})
+
+	// DeliveryFailures counts the messages that could not be forwarded or were not acknowledged in time
+	DeliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_failures_total",
+		Help:      "Messages that could not be forwarded to nats subscribers per delivery mode",
+	}, []string{"delivery"})
+
+	// DeliveryTimeouts counts the messages not acknowledged by the subscriber in time
+	DeliveryTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_timeouts_total",
+		Help:      "Messages not acknowledged by the nats subscriber in time",
+	})
+
+	// DeliveryLatency observes the time from receiving a MQTT message until it was forwarded
+	DeliveryLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_latency_seconds",
+		Help:      "Time from receiving a MQTT message until it was forwarded to the nats subscriber",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"delivery"})
+
+	// MessagesDropped counts the messages dropped because the queue of a registration was full
+	MessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dropped_total",
+		Help:      "Messages dropped because the queue of a registration was full",
+	})
+
+	// RequestTimeouts counts the request-reply requests that got no response in time
+	RequestTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_timeouts_total",
+		Help:      "Request-reply requests without response within the timeout",
+	})
+
+	// PublishErrors counts the messages that could not be published on the MQTT broker
+	PublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publish_errors_total",
+		Help:      "Messages rejected by the MQTT broker or the publish spool",
+	})
+
+	// ConnectionsLost counts the lost connections to the MQTT broker
+	ConnectionsLost = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connections_lost_total",
+		Help:      "Lost connections to the MQTT broker",
+	})
+)
+
+// Gauge registers a gauge at reg whose value is queried from f on each scrape
+func Gauge(reg prometheus.Registerer, name, help string, f func() float64) {
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f)
+}
+
+// Bool converts a state to a gauge value
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Handle adds the `/metrics` endpoint serving the metrics of gatherer to mux. The counters of this
+// package are registered at the default registry.
+func Handle(mux *http.ServeMux, gatherer prometheus.Gatherer) {
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(MessagesReceived, DeliveryLatency)
+	// the counters are global and keep their values between test runs
+	MessagesReceived.Reset()
+	DeliveryLatency.Reset()
+	connected := true
+	Gauge(reg, "test_connected", "test gauge", func() float64 { return Bool(connected) })
+	MessagesReceived.WithLabelValues("sensors/#").Inc()
+	DeliveryLatency.WithLabelValues("ack").Observe(0.002)
+
+	mux := http.NewServeMux()
+	Handle(mux, reg)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/metrics")
+	assert.Nil(err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(err)
+	assert.Contains(string(body), `alm_mqtt_messages_received_total{filter="sensors/#"} 1`)
+	assert.Contains(string(body), `alm_mqtt_delivery_latency_seconds_bucket{delivery="ack",le="0.005"} 1`)
+	assert.Contains(string(body), "alm_mqtt_test_connected 1")
+}
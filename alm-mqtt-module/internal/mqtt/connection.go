@@ -0,0 +1,267 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt311 "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	// operationTimeout limits the time MQTT 3.1.1 operations wait for the acknowledge of the broker
+	operationTimeout = 30 * time.Second
+	// unsupportedProtocolVersion is the MQTT 5 CONNACK reason code refusing the protocol version
+	unsupportedProtocolVersion = 0x84
+	// connackLength is the size of a MQTT 3.1.1 CONNACK packet
+	connackLength = 4
+)
+
+// errProtocolRefused is returned if the broker did not accept the CONNECT of the protocol version
+var errProtocolRefused = errors.New("protocol version refused")
+
+// connection is an established connection to the broker using one of the supported protocol versions
+type connection interface {
+	subscribe(subscriptions map[string]paho.SubscribeOptions) error
+	unsubscribe(topics []string) error
+	publish(pub *paho.Publish) error
+	disconnect()
+}
+
+// v5Connection is a MQTT 5 connection
+type v5Connection struct {
+	client *paho.Client
+}
+
+func (c *v5Connection) subscribe(subscriptions map[string]paho.SubscribeOptions) error {
+	_, err := c.client.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: subscriptions,
+	})
+	return err
+}
+
+func (c *v5Connection) unsubscribe(topics []string) error {
+	_, err := c.client.Unsubscribe(context.Background(), &paho.Unsubscribe{
+		Topics: topics,
+	})
+	return err
+}
+
+func (c *v5Connection) publish(pub *paho.Publish) error {
+	_, err := c.client.Publish(context.Background(), pub)
+	return err
+}
+
+func (c *v5Connection) disconnect() {
+	_ = c.client.Disconnect(&paho.Disconnect{})
+}
+
+// connectV5 establishes a MQTT 5 connection. lost is called when the connection breaks.
+func (s *Session) connectV5(lost func()) (connection, error) {
+	c, err := s.options.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn := &recordingConn{Conn: c}
+
+	client := paho.NewClient(paho.ClientConfig{
+		Conn:   conn,
+		Router: paho.NewSingleHandlerRouter(s.handler),
+		OnClientError: func(err error) {
+			log.Printf("MQTT client error: %s", err)
+			lost()
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			log.Printf("MQTT broker disconnected with reason: %d", d.ReasonCode)
+			lost()
+		},
+	})
+
+	res, err := client.Connect(context.Background(), s.options.Connect())
+	if res != nil && res.ReasonCode == unsupportedProtocolVersion {
+		conn.Close()
+		return nil, fmt.Errorf("%w: connect failed with reason: %d", errProtocolRefused, res.ReasonCode)
+	}
+	if err != nil && res == nil {
+		conn.Close()
+		// MQTT 3.1.1 brokers answer with a CONNACK that cannot be parsed as MQTT 5 CONNACK
+		if conn.refusedProtocol() {
+			return nil, fmt.Errorf("%w: connect failed with reason: %d", errProtocolRefused, packets.ErrRefusedBadProtocolVersion)
+		}
+		return nil, err
+	}
+	if res.ReasonCode != 0 {
+		_ = client.Disconnect(&paho.Disconnect{})
+		reason := ""
+		if res.Properties != nil {
+			reason = res.Properties.ReasonString
+		}
+		return nil, fmt.Errorf("connect failed with reason: %d - %s", res.ReasonCode, reason)
+	}
+	return &v5Connection{client: client}, nil
+}
+
+// recordingConn keeps the first bytes received to recognize a MQTT 3.1.1 CONNACK
+type recordingConn struct {
+	net.Conn
+	mutex sync.Mutex
+	head  []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mutex.Lock()
+	if rest := connackLength - len(c.head); rest > 0 {
+		if n < rest {
+			rest = n
+		}
+		c.head = append(c.head, b[:rest]...)
+	}
+	c.mutex.Unlock()
+	return n, err
+}
+
+// refusedProtocol reports whether a MQTT 3.1.1 CONNACK refusing the protocol version was received
+func (c *recordingConn) refusedProtocol() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.head) == connackLength && c.head[0] == packets.Connack<<4 && c.head[1] == connackLength-2 &&
+		c.head[3] == packets.ErrRefusedBadProtocolVersion
+}
+
+// v311Connection is a MQTT 3.1.1 connection. MQTT 5 properties and subscription options are not sent.
+type v311Connection struct {
+	client mqtt311.Client
+	// warned is used to report ignored MQTT 5 subscription options only once
+	warned sync.Once
+}
+
+func (c *v311Connection) subscribe(subscriptions map[string]paho.SubscribeOptions) error {
+	filters := make(map[string]byte, len(subscriptions))
+	for topic, options := range subscriptions {
+		if options.NoLocal || options.RetainAsPublished || options.RetainHandling != 0 {
+			c.warned.Do(func() {
+				log.Printf("MQTT 5 subscription options are not supported with MQTT 3.1.1 and are ignored")
+			})
+		}
+		filters[topic] = options.QoS
+	}
+	token := c.client.SubscribeMultiple(filters, nil)
+	if err := wait(token); err != nil {
+		return err
+	}
+	for topic, qos := range token.(*mqtt311.SubscribeToken).Result() {
+		if qos > 2 {
+			return fmt.Errorf("subscription of '%s' rejected by broker", topic)
+		}
+	}
+	return nil
+}
+
+func (c *v311Connection) unsubscribe(topics []string) error {
+	return wait(c.client.Unsubscribe(topics...))
+}
+
+func (c *v311Connection) publish(pub *paho.Publish) error {
+	return wait(c.client.Publish(pub.Topic, pub.QoS, pub.Retain, pub.Payload))
+}
+
+func (c *v311Connection) disconnect() {
+	c.client.Disconnect(0)
+}
+
+// wait waits for the acknowledge of a MQTT 3.1.1 operation. WaitTimeout is not used, because it holds
+// the lock of the token while waiting, which delays a failing operation until the timeout elapsed.
+func wait(token mqtt311.Token) error {
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(operationTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return token.Error()
+	case <-timer.C:
+		return fmt.Errorf("no acknowledge from broker: %w", context.DeadlineExceeded)
+	}
+}
+
+// connectV311 establishes a MQTT 3.1.1 connection. lost is called when the connection breaks.
+func (s *Session) connectV311(lost func()) (connection, error) {
+	addr, useTLS, err := s.options.address()
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt311.NewClientOptions()
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		cfg, err := s.options.tlsConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		opts.AddBroker("ssl://" + addr)
+		opts.SetTLSConfig(cfg)
+	} else {
+		opts.AddBroker("tcp://" + addr)
+	}
+	cp := s.options.Connect()
+	opts.SetClientID(cp.ClientID)
+	opts.SetUsername(cp.Username)
+	opts.SetPassword(string(cp.Password))
+	opts.SetProtocolVersion(uint(Version311))
+	opts.SetCleanSession(true)
+	opts.SetKeepAlive(keepAlive * time.Second)
+	opts.SetConnectTimeout(dialTimeout)
+	// the session reconnects and restores the subscriptions itself
+	opts.SetAutoReconnect(false)
+	opts.SetOrderMatters(true)
+	opts.SetDefaultPublishHandler(func(_ mqtt311.Client, msg mqtt311.Message) {
+		s.handler(&paho.Publish{
+			QoS:        msg.Qos(),
+			Retain:     msg.Retained(),
+			Topic:      msg.Topic(),
+			Properties: &paho.PublishProperties{},
+			Payload:    msg.Payload(),
+		})
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt311.Client, err error) {
+		log.Printf("MQTT client error: %s", err)
+		lost()
+	})
+
+	client := mqtt311.NewClient(opts)
+	token := client.Connect()
+	if err := wait(token); err != nil {
+		// the return code is only set once the connect completed
+		if !errors.Is(err, context.DeadlineExceeded) &&
+			token.(*mqtt311.ConnectToken).ReturnCode() == packets.ErrRefusedBadProtocolVersion {
+			return nil, fmt.Errorf("%w: %s", errProtocolRefused, err)
+		}
+		return nil, err
+	}
+	return &v311Connection{client: client}, nil
+}
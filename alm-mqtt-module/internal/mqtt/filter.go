@@ -0,0 +1,136 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	singleLevelWildcard      = "+"
+	multiLevelWildcard       = "#"
+	topicLevelSeparator      = "/"
+	sharedSubscriptionPrefix = "$share/"
+)
+
+// mergeOverlapping replaces overlapping topic filters by a filter matching all their topics, subscribed with
+// the highest QoS. MQTT 3.1.1 brokers may deliver a message once per matching subscription, so with merged
+// filters each message is received once. Messages of topics that are only matched by the merged filter are
+// ignored by the handler. Shared subscriptions are kept as they are.
+func mergeOverlapping(subscriptions map[string]paho.SubscribeOptions) map[string]paho.SubscribeOptions {
+	filters := make([]string, 0, len(subscriptions))
+	merged := make(map[string]paho.SubscribeOptions, len(subscriptions))
+	for filter, options := range subscriptions {
+		if strings.HasPrefix(filter, sharedSubscriptionPrefix) {
+			merged[filter] = options
+			continue
+		}
+		filters = append(filters, filter)
+	}
+	// sorted to get the same result for the same subscriptions
+	sort.Strings(filters)
+	qos := make(map[string]byte, len(filters))
+	for _, filter := range filters {
+		qos[filter] = subscriptions[filter].QoS
+	}
+
+	// the merged filter might overlap filters checked before, so all pairs are checked again after a merge
+	for i, j, ok := overlapping(filters); ok; i, j, ok = overlapping(filters) {
+		filter := generalizeFilters(filters[i], filters[j])
+		q := qos[filters[i]]
+		if qos[filters[j]] > q {
+			q = qos[filters[j]]
+		}
+		filters = append(filters[:j], filters[j+1:]...)
+		filters[i] = filter
+		qos[filter] = q
+	}
+	for _, filter := range filters {
+		merged[filter] = paho.SubscribeOptions{QoS: qos[filter]}
+	}
+	return merged
+}
+
+// overlapping returns the indexes i < j of the first overlapping filters
+func overlapping(filters []string) (int, int, bool) {
+	for i := range filters {
+		for j := i + 1; j < len(filters); j++ {
+			if filtersOverlap(filters[i], filters[j]) {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// filtersOverlap reports whether a topic name exists that is matched by both topic filters
+func filtersOverlap(a string, b string) bool {
+	aLevels := strings.Split(a, topicLevelSeparator)
+	bLevels := strings.Split(b, topicLevelSeparator)
+	// topics starting with '$' are not matched by filters starting with a wildcard
+	if isWildcard(aLevels[0]) && strings.HasPrefix(bLevels[0], "$") ||
+		isWildcard(bLevels[0]) && strings.HasPrefix(aLevels[0], "$") {
+		return false
+	}
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == multiLevelWildcard || bLevels[i] == multiLevelWildcard {
+			return true
+		}
+		if aLevels[i] != bLevels[i] && aLevels[i] != singleLevelWildcard && bLevels[i] != singleLevelWildcard {
+			return false
+		}
+	}
+	// '#' also matches the parent level, e.g. 'a/#' matches 'a'
+	switch {
+	case len(aLevels) == len(bLevels):
+		return true
+	case len(aLevels) == len(bLevels)+1:
+		return aLevels[len(bLevels)] == multiLevelWildcard
+	case len(bLevels) == len(aLevels)+1:
+		return bLevels[len(aLevels)] == multiLevelWildcard
+	}
+	return false
+}
+
+// generalizeFilters returns a topic filter matching all topics of both filters. Levels that differ are
+// replaced by '+', if the number of levels differs the remaining levels are replaced by '#'.
+func generalizeFilters(a string, b string) string {
+	aLevels := strings.Split(a, topicLevelSeparator)
+	bLevels := strings.Split(b, topicLevelSeparator)
+	levels := make([]string, 0, len(aLevels))
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		switch {
+		case aLevels[i] == multiLevelWildcard || bLevels[i] == multiLevelWildcard:
+			return strings.Join(append(levels, multiLevelWildcard), topicLevelSeparator)
+		case aLevels[i] == bLevels[i]:
+			levels = append(levels, aLevels[i])
+		default:
+			levels = append(levels, singleLevelWildcard)
+		}
+	}
+	if len(aLevels) != len(bLevels) {
+		levels = append(levels, multiLevelWildcard)
+	}
+	return strings.Join(levels, topicLevelSeparator)
+}
+
+func isWildcard(level string) bool {
+	return level == singleLevelWildcard || level == multiLevelWildcard
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFiltersOverlap(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/+", "a", false},
+		{"a/+/c", "a/b/#", true},
+		{"a/+/c", "a/b/d", false},
+		{"+/b", "a/+", true},
+		{"#", "$SYS/x", false},
+		{"+/x", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+	}
+	for _, test := range tests {
+		assert.Equal(test.overlap, filtersOverlap(test.a, test.b), "%s %s", test.a, test.b)
+		assert.Equal(test.overlap, filtersOverlap(test.b, test.a), "%s %s", test.b, test.a)
+	}
+}
+
+func TestGeneralizeFilters(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		a, b, filter string
+	}{
+		{"a/b", "a/b", "a/b"},
+		{"a/#", "a/b/c", "a/#"},
+		{"a", "a/#", "a/#"},
+		{"a/+/c", "a/b/#", "a/+/#"},
+		{"+/b", "a/+", "+/+"},
+		{"a/b", "a/b/c", "a/b/#"},
+	}
+	for _, test := range tests {
+		assert.Equal(test.filter, generalizeFilters(test.a, test.b), "%s %s", test.a, test.b)
+		assert.Equal(test.filter, generalizeFilters(test.b, test.a), "%s %s", test.b, test.a)
+	}
+}
+
+func TestMergeOverlapping(t *testing.T) {
+	assert := assert.New(t)
+	merged := mergeOverlapping(map[string]paho.SubscribeOptions{
+		"a/b":          {QoS: 2},
+		"a/#":          {QoS: 0},
+		"b/+/c":        {QoS: 1},
+		"b/x/#":        {QoS: 0},
+		"c":            {QoS: 1},
+		"$SYS/#":       {QoS: 0},
+		"$share/g/a/b": {QoS: 1},
+	})
+	assert.Equal(map[string]paho.SubscribeOptions{
+		"a/#":          {QoS: 2},
+		"b/+/#":        {QoS: 1},
+		"c":            {QoS: 1},
+		"$SYS/#":       {QoS: 0},
+		"$share/g/a/b": {QoS: 1},
+	}, merged)
+
+	// a merged filter is merged again with filters it overlaps, even if they did not overlap the original filters
+	merged = mergeOverlapping(map[string]paho.SubscribeOptions{"+/z/w": {}, "a/+": {}, "a/x/#": {}})
+	assert.Equal(map[string]paho.SubscribeOptions{"+/+/#": {}}, merged)
+}
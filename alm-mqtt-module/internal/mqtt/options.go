@@ -0,0 +1,224 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	defaultServer    = "mosquitto:1883"
+	defaultTLSPort   = "8883"
+	defaultPlainPort = "1883"
+	dialTimeout      = 10 * time.Second
+	// keepAlive in seconds. Used to detect broken connections to the broker.
+	keepAlive = 30
+)
+
+const (
+	// VersionAuto tries MQTT 5 first and falls back to MQTT 3.1.1 if the broker refuses it
+	VersionAuto byte = 0
+	// Version311 is MQTT 3.1.1, protocol level 4
+	Version311 byte = 4
+	// Version5 is MQTT 5, protocol level 5
+	Version5 byte = 5
+)
+
+// Options contains everything needed to establish a connection to the MQTT broker
+type Options struct {
+	// Server is the broker address, either `host:port` or an URL like `tcp://host:port` or `ssl://host:port`
+	Server   string
+	ClientID string
+	Username string
+	Password string
+	// CAFile is a PEM bundle used to verify the broker certificate. If empty, the system roots are used.
+	CAFile string
+	// CertFile and KeyFile contain the PEM encoded client certificate used for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name used to verify the broker certificate
+	ServerName         string
+	InsecureSkipVerify bool
+	// ProtocolVersion selects the MQTT protocol, one of VersionAuto, Version311 or Version5
+	ProtocolVersion byte
+	// Spool limits the messages kept while the broker is not reachable
+	Spool SpoolOptions
+}
+
+// OptionsFromEnv reads the MQTT connection options from the environment
+func OptionsFromEnv() (Options, error) {
+	o := Options{
+		Server:     defaultServer,
+		ClientID:   os.Getenv("MQTT_CLIENT_ID"),
+		Username:   os.Getenv("MQTT_USERNAME"),
+		Password:   os.Getenv("MQTT_PASSWORD"),
+		CAFile:     os.Getenv("MQTT_CA_FILE"),
+		CertFile:   os.Getenv("MQTT_CERT_FILE"),
+		KeyFile:    os.Getenv("MQTT_KEY_FILE"),
+		ServerName: os.Getenv("MQTT_TLS_SERVER_NAME"),
+	}
+	if env := os.Getenv("MQTT_SERVER"); len(env) > 0 {
+		o.Server = env
+	}
+	var err error
+	if env := os.Getenv("MQTT_TLS_INSECURE_SKIP_VERIFY"); len(env) > 0 {
+		if o.InsecureSkipVerify, err = strconv.ParseBool(env); err != nil {
+			return o, fmt.Errorf("invalid MQTT_TLS_INSECURE_SKIP_VERIFY '%s': %v", env, err)
+		}
+	}
+	version, err := ParseProtocolVersion(os.Getenv("MQTT_PROTOCOL_VERSION"))
+	if err != nil {
+		return o, err
+	}
+	o.ProtocolVersion = version
+	if o.Spool, err = spoolOptionsFromEnv(); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// ParseProtocolVersion parses the MQTT protocol version `5`, `3.1.1` or `auto`. An empty string selects auto.
+func ParseProtocolVersion(s string) (byte, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto":
+		return VersionAuto, nil
+	case "5", "5.0":
+		return Version5, nil
+	case "3.1.1", "4":
+		return Version311, nil
+	}
+	return VersionAuto, fmt.Errorf("unsupported MQTT protocol version '%s', use 5, 3.1.1 or auto", s)
+}
+
+// VersionString returns the name of a MQTT protocol version
+func VersionString(version byte) string {
+	switch version {
+	case Version5:
+		return "5"
+	case Version311:
+		return "3.1.1"
+	}
+	return "auto"
+}
+
+// address splits the configured server into host:port and whether TLS shall be used
+func (o Options) address() (string, bool, error) {
+	server := o.Server
+	useTLS := false
+	if i := strings.Index(server, "://"); i >= 0 {
+		scheme := strings.ToLower(server[:i])
+		server = server[i+3:]
+		switch scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("unsupported MQTT server scheme '%s'", scheme)
+		}
+	}
+	server = strings.TrimSuffix(server, "/")
+	if server == "" {
+		return "", false, fmt.Errorf("empty MQTT server address")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		port := defaultPlainPort
+		if useTLS {
+			port = defaultTLSPort
+		}
+		server = net.JoinHostPort(server, port)
+	}
+	return server, useTLS, nil
+}
+
+// tlsConfig creates the TLS configuration used to connect to the broker
+func (o Options) tlsConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Dial opens the network connection to the broker, using TLS for `ssl://`, `tls://` and `mqtts://` servers
+func (o Options) Dial() (net.Conn, error) {
+	addr, useTLS, err := o.address()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if !useTLS {
+		return dialer.Dial("tcp", addr)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	cfg, err := o.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, cfg)
+}
+
+// Connect returns the CONNECT packet containing the client ID and credentials
+func (o Options) Connect() *paho.Connect {
+	cp := &paho.Connect{
+		ClientID:   o.ClientID,
+		KeepAlive:  keepAlive,
+		CleanStart: true,
+	}
+	if o.Username != "" {
+		cp.Username = o.Username
+		cp.UsernameFlag = true
+	}
+	if o.Password != "" {
+		cp.Password = []byte(o.Password)
+		cp.PasswordFlag = true
+	}
+	return cp
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddress(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		server string
+		addr   string
+		useTLS bool
+	}{
+		{"mosquitto:1883", "mosquitto:1883", false},
+		{"mosquitto", "mosquitto:1883", false},
+		{"tcp://mosquitto:1884", "mosquitto:1884", false},
+		{"mqtt://mosquitto", "mosquitto:1883", false},
+		{"ssl://broker.example.com:8884", "broker.example.com:8884", true},
+		{"mqtts://broker.example.com", "broker.example.com:8883", true},
+		{"TLS://broker.example.com/", "broker.example.com:8883", true},
+	}
+	for _, test := range tests {
+		addr, useTLS, err := Options{Server: test.server}.address()
+		assert.Nil(err, test.server)
+		assert.Equal(test.addr, addr, test.server)
+		assert.Equal(test.useTLS, useTLS, test.server)
+	}
+
+	_, _, err := Options{Server: "ws://broker:80"}.address()
+	assert.NotNil(err)
+	_, _, err = Options{Server: "ssl://"}.address()
+	assert.NotNil(err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := Options{}.tlsConfig("broker")
+	assert.Nil(err)
+	assert.Equal("broker", cfg.ServerName)
+
+	cfg, err = Options{ServerName: "other"}.tlsConfig("broker")
+	assert.Nil(err)
+	assert.Equal("other", cfg.ServerName)
+
+	_, err = Options{CAFile: "/does/not/exist"}.tlsConfig("broker")
+	assert.NotNil(err)
+	_, err = Options{CertFile: "client.crt"}.tlsConfig("broker")
+	assert.NotNil(err)
+}
+
+func TestConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	cp := Options{}.Connect()
+	assert.False(cp.UsernameFlag)
+	assert.False(cp.PasswordFlag)
+
+	cp = Options{ClientID: "edge1", Username: "user", Password: "secret"}.Connect()
+	assert.Equal("edge1", cp.ClientID)
+	assert.True(cp.UsernameFlag)
+	assert.Equal("user", cp.Username)
+	assert.True(cp.PasswordFlag)
+	assert.Equal([]byte("secret"), cp.Password)
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		version  string
+		expected byte
+	}{
+		{"", VersionAuto},
+		{"auto", VersionAuto},
+		{"5", Version5},
+		{"3.1.1", Version311},
+		{" AUTO ", VersionAuto},
+	}
+	for _, test := range tests {
+		version, err := ParseProtocolVersion(test.version)
+		assert.Nil(err, test.version)
+		assert.Equal(test.expected, version, test.version)
+	}
+
+	_, err := ParseProtocolVersion("3.1")
+	assert.NotNil(err)
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv("MQTT_TLS_INSECURE_SKIP_VERIFY")
+
+	assert.Nil(os.Setenv("MQTT_TLS_INSECURE_SKIP_VERIFY", "true"))
+	o, err := OptionsFromEnv()
+	assert.Nil(err)
+	assert.True(o.InsecureSkipVerify)
+
+	assert.Nil(os.Setenv("MQTT_TLS_INSECURE_SKIP_VERIFY", "yes"))
+	_, err = OptionsFromEnv()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "invalid MQTT_TLS_INSECURE_SKIP_VERIFY 'yes'")
+	}
+}
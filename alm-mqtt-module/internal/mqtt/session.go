@@ -0,0 +1,410 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"alm-mqtt-module/internal/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+	// maxQueuedPublishes is the default limit of publishes kept while the broker is not reachable
+	maxQueuedPublishes = 1000
+)
+
+// ErrNotConnected is returned if an operation requires a connection to the broker that is currently not established
+var ErrNotConnected = errors.New("not connected to MQTT broker")
+
+// SubscriptionsFunc returns all subscriptions that shall be active on the broker
+type SubscriptionsFunc func() map[string]paho.SubscribeOptions
+
+// Session is a supervised MQTT connection. It reconnects with backoff whenever the connection
+// is lost, restores all subscriptions and spools publishes while disconnected.
+type Session struct {
+	options       Options
+	handler       paho.MessageHandler
+	subscriptions SubscriptionsFunc
+
+	// mutex guards conn, version, lost and spool. It is never held during network I/O.
+	mutex   sync.Mutex
+	conn    connection
+	version byte
+	lost    chan struct{}
+	spool   *spool
+	// spooled is signalled whenever a message was added to the spool, so a late spooled message is drained
+	spooled chan struct{}
+	// connectionUp and connectionLost are called when the connection is established or lost
+	connectionUp   func()
+	connectionLost func()
+
+	// subscribeMutex serializes the updates of subscribed, the subscriptions on a MQTT 3.1.1 broker
+	subscribeMutex sync.Mutex
+	subscribed     map[string]paho.SubscribeOptions
+}
+
+// NewSession creates a new session. All incoming messages are passed to handler.
+// subscriptions is queried after each (re)connect to restore the subscriptions on the broker.
+// Messages left in the spool directory are published once the session is connected.
+func NewSession(options Options, handler paho.MessageHandler, subscriptions SubscriptionsFunc) (*Session, error) {
+	spool, err := newSpool(options.Spool)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		options:       options,
+		handler:       handler,
+		subscriptions: subscriptions,
+		version:       options.ProtocolVersion,
+		spool:         spool,
+		spooled:       make(chan struct{}, 1),
+		subscribed:    make(map[string]paho.SubscribeOptions),
+	}, nil
+}
+
+// Run connects to the broker and keeps the connection alive. It never returns.
+func (s *Session) Run() {
+	delay := minReconnectDelay
+	for {
+		conn, version, lost, err := s.connect()
+		if err != nil {
+			log.Printf("Failed to connect to %s: %s. Retrying in %s", s.options.Server, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = minReconnectDelay
+		log.Printf("Connected to MQTT broker '%s' using MQTT %s", s.options.Server, VersionString(version))
+
+		s.mutex.Lock()
+		s.conn = conn
+		s.version = version
+		s.lost = lost
+		connectionUp, connectionLost := s.connectionUp, s.connectionLost
+		s.mutex.Unlock()
+		if connectionUp != nil {
+			connectionUp()
+		}
+		s.serve(conn, lost)
+
+		log.Printf("Connection to MQTT broker '%s' lost", s.options.Server)
+		metrics.ConnectionsLost.Inc()
+
+		s.mutex.Lock()
+		s.conn = nil
+		s.mutex.Unlock()
+		if connectionLost != nil {
+			connectionLost()
+		}
+		conn.disconnect()
+	}
+}
+
+// SetConnectionHandlers sets the functions called after the connection to the broker was established
+// and after it was lost. Either may be nil.
+func (s *Session) SetConnectionHandlers(up func(), lost func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connectionUp = up
+	s.connectionLost = lost
+}
+
+// Connected reports whether the session is currently connected to the broker
+func (s *Session) Connected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn != nil
+}
+
+// ProtocolVersion returns the MQTT protocol version of the current or last connection. Before the first
+// connect it returns the configured version, which is VersionAuto unless a version was selected.
+func (s *Session) ProtocolVersion() byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.version
+}
+
+// Subscribe subscribes to the given topic filters. If the session is not connected, the
+// subscription is expected to be restored by the SubscriptionsFunc on the next connect.
+// With MQTT 3.1.1 the subscriptions of the SubscriptionsFunc are updated instead, see mergeOverlapping.
+func (s *Session) Subscribe(subscriptions map[string]paho.SubscribeOptions) error {
+	s.mutex.Lock()
+	conn, version := s.conn, s.version
+	s.mutex.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	if version == Version311 {
+		return s.updateSubscriptions(conn)
+	}
+	return conn.subscribe(subscriptions)
+}
+
+// Unsubscribe removes the subscriptions for the given topic filters. With MQTT 3.1.1 the subscriptions
+// of the SubscriptionsFunc are updated instead, see mergeOverlapping.
+func (s *Session) Unsubscribe(topics ...string) error {
+	s.mutex.Lock()
+	conn, version := s.conn, s.version
+	s.mutex.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	if version == Version311 {
+		return s.updateSubscriptions(conn)
+	}
+	return conn.unsubscribe(topics)
+}
+
+// Publish sends a message to the broker. While the broker is not reachable the message is
+// spooled and sent as soon as the connection is established again. It reports whether the
+// message was spooled. ErrSpoolFull is returned if the spool rejects the message.
+func (s *Session) Publish(pub *paho.Publish) (bool, error) {
+	s.mutex.Lock()
+	conn, lost := s.conn, s.lost
+	spooled, err := true, error(nil)
+	// while spooled messages are drained, new messages are spooled behind them to keep the order
+	if conn == nil || s.spool.len() > 0 {
+		err = s.addToSpool(pub)
+		s.mutex.Unlock()
+	} else {
+		s.mutex.Unlock()
+		spooled, err = s.publish(conn, lost, pub)
+	}
+	if err != nil {
+		metrics.PublishErrors.Inc()
+	}
+	return spooled, err
+}
+
+// SpoolState returns the state of the publish spool
+func (s *Session) SpoolState() SpoolState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.spool.state()
+}
+
+// connect establishes a connection using the configured protocol version. In auto mode the version
+// detected last is tried first, the other version is tried if the broker refuses the protocol.
+func (s *Session) connect() (connection, byte, chan struct{}, error) {
+	versions := []byte{s.options.ProtocolVersion}
+	if s.options.ProtocolVersion == VersionAuto {
+		versions = []byte{Version5, Version311}
+		if s.ProtocolVersion() == Version311 {
+			versions = []byte{Version311, Version5}
+		}
+	}
+
+	var err error
+	for i, version := range versions {
+		lost := make(chan struct{})
+		var once sync.Once
+		connectionLost := func() {
+			once.Do(func() { close(lost) })
+		}
+
+		var conn connection
+		if version == Version311 {
+			conn, err = s.connectV311(connectionLost)
+		} else {
+			conn, err = s.connectV5(connectionLost)
+		}
+		if err == nil {
+			return conn, version, lost, nil
+		}
+		if !errors.Is(err, errProtocolRefused) {
+			return nil, 0, nil, err
+		}
+		if i < len(versions)-1 {
+			log.Printf("MQTT %s refused by broker: %s", VersionString(version), err)
+		}
+	}
+	return nil, 0, nil, err
+}
+
+// serve restores the subscriptions and publishes the spooled messages until the connection is lost.
+// Messages spooled while connected, e.g. by a publish that failed on the previous connection, are
+// drained as soon as they are added.
+func (s *Session) serve(conn connection, lost chan struct{}) {
+	s.resubscribe(conn)
+	for {
+		s.drain(conn, lost)
+		select {
+		case <-s.spooled:
+		case <-lost:
+			return
+		}
+	}
+}
+
+// addToSpool spools a message and wakes up serve to drain it. Must be called with mutex held.
+func (s *Session) addToSpool(pub *paho.Publish) error {
+	if err := s.spool.add(pub); err != nil {
+		return err
+	}
+	select {
+	case s.spooled <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// resubscribe restores all subscriptions after a connect
+func (s *Session) resubscribe(conn connection) {
+	if s.ProtocolVersion() == Version311 {
+		s.subscribeMutex.Lock()
+		s.subscribed = make(map[string]paho.SubscribeOptions)
+		s.subscribeMutex.Unlock()
+		if err := s.updateSubscriptions(conn); err != nil {
+			log.Printf("Failed to restore subscriptions: %s", err)
+		}
+		return
+	}
+
+	subscriptions := s.subscriptions()
+	if len(subscriptions) == 0 {
+		return
+	}
+	for topic := range subscriptions {
+		fmt.Printf("Resubscribing '%s'\n", topic)
+	}
+	if err := conn.subscribe(subscriptions); err != nil {
+		log.Printf("Failed to restore subscriptions: %s", err)
+	}
+}
+
+// updateSubscriptions subscribes the merged topic filters of all subscriptions on a MQTT 3.1.1 broker and
+// removes the subscriptions no longer needed. New filters are subscribed first to not miss messages.
+func (s *Session) updateSubscriptions(conn connection) error {
+	s.subscribeMutex.Lock()
+	defer s.subscribeMutex.Unlock()
+	merged := mergeOverlapping(s.subscriptions())
+
+	changed := make(map[string]paho.SubscribeOptions)
+	for topic, options := range merged {
+		if current, ok := s.subscribed[topic]; !ok || current != options {
+			fmt.Printf("Subscribing merged topic filter '%s'\n", topic)
+			changed[topic] = options
+		}
+	}
+	if len(changed) > 0 {
+		if err := conn.subscribe(changed); err != nil {
+			return err
+		}
+		for topic, options := range changed {
+			s.subscribed[topic] = options
+		}
+	}
+
+	var removed []string
+	for topic := range s.subscribed {
+		if _, ok := merged[topic]; !ok {
+			fmt.Printf("Unsubscribing merged topic filter '%s'\n", topic)
+			removed = append(removed, topic)
+		}
+	}
+	if len(removed) > 0 {
+		if err := conn.unsubscribe(removed); err != nil {
+			return err
+		}
+		for _, topic := range removed {
+			delete(s.subscribed, topic)
+		}
+	}
+	return nil
+}
+
+// drain sends all spooled publishes in order. The mutex is only held to access the spool, so
+// new messages are spooled behind the drained ones meanwhile.
+func (s *Session) drain(conn connection, lost chan struct{}) {
+	for {
+		if closed(lost) {
+			return
+		}
+		s.mutex.Lock()
+		pub, ok := s.spool.first()
+		s.mutex.Unlock()
+		if !ok {
+			return
+		}
+		if err := conn.publish(pub); err != nil {
+			if isConnectionError(err, lost) {
+				log.Printf("Failed to publish spooled message to '%s': %s", pub.Topic, err)
+				return
+			}
+			log.Printf("Dropping spooled message to '%s': %s", pub.Topic, err)
+			metrics.PublishErrors.Inc()
+		}
+		s.mutex.Lock()
+		// the message might have been dropped from the full spool while it was published
+		if first, ok := s.spool.first(); ok && first == pub {
+			s.spool.remove()
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// publish sends a message and spools it if the connection broke
+func (s *Session) publish(conn connection, lost chan struct{}, pub *paho.Publish) (bool, error) {
+	err := conn.publish(pub)
+	if err != nil && isConnectionError(err, lost) {
+		log.Printf("Failed to publish message to '%s': %s. Spooling message", pub.Topic, err)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		// the session might be connected again already, addToSpool makes sure the message is drained
+		return true, s.addToSpool(pub)
+	}
+	return false, err
+}
+
+// current returns the current connection and the channel closed when it is lost. conn is nil if not connected.
+func (s *Session) current() (connection, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn, s.lost
+}
+
+func closed(lost chan struct{}) bool {
+	select {
+	case <-lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// isConnectionError reports whether err was caused by a broken connection rather than rejected by the broker
+func isConnectionError(err error, lost chan struct{}) bool {
+	select {
+	case <-lost:
+		return true
+	default:
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,465 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishQueuedWhileDisconnected(t *testing.T) {
+	assert := assert.New(t)
+	s, err := NewSession(Options{Spool: SpoolOptions{MaxMessages: maxQueuedPublishes}}, nil, nil)
+	assert.Nil(err)
+
+	assert.False(s.Connected())
+	assert.Equal(ErrNotConnected, s.Subscribe(map[string]paho.SubscribeOptions{"topic": {QoS: 1}}))
+	assert.Equal(ErrNotConnected, s.Unsubscribe("topic"))
+
+	for i := 0; i < maxQueuedPublishes+10; i++ {
+		spooled, err := s.Publish(&paho.Publish{Topic: fmt.Sprintf("topic/%d", i)})
+		assert.Nil(err)
+		assert.True(spooled)
+	}
+	assert.Len(s.spool.entries, maxQueuedPublishes)
+	// oldest messages are dropped first
+	assert.Equal("topic/10", s.spool.entries[0].pub.Topic)
+	assert.Equal(fmt.Sprintf("topic/%d", maxQueuedPublishes+9), s.spool.entries[len(s.spool.entries)-1].pub.Topic)
+	assert.Equal(int64(10), s.SpoolState().Dropped)
+}
+
+func TestSpoolOnDisk(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	options := Options{Spool: SpoolOptions{Dir: dir, MaxMessages: 3, Policy: SpoolReject}}
+
+	s, err := NewSession(options, nil, nil)
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		_, err := s.Publish(&paho.Publish{Topic: fmt.Sprintf("topic/%d", i), QoS: 1, Payload: []byte("data"),
+			Properties: &paho.PublishProperties{ContentType: "text/plain"}})
+		assert.Nil(err)
+	}
+	_, err = s.Publish(&paho.Publish{Topic: "topic/3"})
+	assert.Equal(ErrSpoolFull, err)
+	state := s.SpoolState()
+	assert.Equal(3, state.Messages)
+	assert.Equal(int64(0), state.Dropped)
+
+	// a new session restores the messages in order
+	s, err = NewSession(options, nil, nil)
+	assert.Nil(err)
+	assert.Equal(state, s.SpoolState())
+	for i, e := range s.spool.entries {
+		assert.Equal(fmt.Sprintf("topic/%d", i), e.pub.Topic)
+		assert.Equal(byte(1), e.pub.QoS)
+		assert.Equal([]byte("data"), e.pub.Payload)
+		assert.Equal("text/plain", e.pub.Properties.ContentType)
+	}
+
+	// published messages are removed from the directory
+	s.spool.remove()
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(files, 2)
+	_, err = s.Publish(&paho.Publish{Topic: "topic/3"})
+	assert.Nil(err)
+	s, err = NewSession(options, nil, nil)
+	assert.Nil(err)
+	assert.Equal("topic/1", s.spool.entries[0].pub.Topic)
+	assert.Equal("topic/3", s.spool.entries[2].pub.Topic)
+
+	// files left over by an interrupted write are removed
+	tmp := filepath.Join(dir, fmt.Sprintf("%020d%s%s", 10, spoolFileExt, spoolTmpExt))
+	assert.Nil(ioutil.WriteFile(tmp, []byte("{"), 0644))
+	s, err = NewSession(options, nil, nil)
+	assert.Nil(err)
+	assert.Equal(3, s.SpoolState().Messages)
+	_, err = os.Stat(tmp)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestSpoolLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewSession(Options{Spool: SpoolOptions{Policy: "drop-newest"}}, nil, nil)
+	assert.NotNil(err)
+
+	// size limit drops the oldest messages
+	sp, err := newSpool(SpoolOptions{MaxBytes: 300})
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(sp.add(&paho.Publish{Topic: fmt.Sprintf("topic/%d", i), Payload: make([]byte, 50)}))
+	}
+	assert.True(sp.bytes <= 300)
+	assert.Equal("topic/4", sp.entries[len(sp.entries)-1].pub.Topic)
+	assert.Equal(int64(5-len(sp.entries)), sp.dropped)
+	assert.True(errors.Is(sp.add(&paho.Publish{Topic: "large", Payload: make([]byte, 300)}), ErrSpoolFull))
+
+	// expired messages are dropped
+	sp, err = newSpool(SpoolOptions{MaxAge: time.Minute})
+	assert.Nil(err)
+	assert.Nil(sp.add(&paho.Publish{Topic: "old"}))
+	assert.Nil(sp.add(&paho.Publish{Topic: "new"}))
+	sp.entries[0].time = time.Now().Add(-2 * time.Minute)
+	pub, ok := sp.first()
+	assert.True(ok)
+	assert.Equal("new", pub.Topic)
+	assert.Equal(SpoolState{Messages: 1, Bytes: sp.entries[0].size, Dropped: 1}, sp.state())
+
+	// messages are dropped after their message expiry interval, which is reduced by the time spooled
+	sp, err = newSpool(SpoolOptions{})
+	assert.Nil(err)
+	expiry := uint32(10)
+	request := &paho.Publish{Topic: "request", Properties: &paho.PublishProperties{MessageExpiry: &expiry}}
+	assert.Nil(sp.add(request))
+	assert.Nil(sp.add(&paho.Publish{Topic: "request", Properties: &paho.PublishProperties{MessageExpiry: &expiry}}))
+	assert.Nil(sp.add(&paho.Publish{Topic: "other"}))
+	sp.entries[0].expires = time.Now()
+	sp.entries[1].expires = time.Now().Add(4500 * time.Millisecond)
+	pub, ok = sp.first()
+	assert.True(ok)
+	assert.Equal(uint32(5), *pub.Properties.MessageExpiry)
+	// the message of the caller is not modified
+	assert.Equal(uint32(10), *request.Properties.MessageExpiry)
+	sp.remove()
+	pub, ok = sp.first()
+	assert.True(ok)
+	assert.Equal("other", pub.Topic)
+	assert.Nil(pub.Properties.MessageExpiry)
+	assert.Equal(int64(1), sp.dropped)
+}
+
+// fakeBroker accepts connections like a broker supporting only MQTT 3.1.1
+type fakeBroker struct {
+	// levels receives the protocol levels of all CONNECT packets
+	levels chan byte
+	// subscribed receives the topic filters of all SUBSCRIBE packets
+	subscribed chan string
+	// published receives the topics of all PUBLISH packets
+	published chan string
+	// unsubscribed receives the topic filters of all UNSUBSCRIBE packets
+	unsubscribed chan string
+
+	mutex sync.Mutex
+	conns []net.Conn
+	// refuse is the number of next connections refused as server unavailable
+	refuse int
+	// subacks delays the SUBACKs until it is closed, if not nil
+	subacks chan struct{}
+}
+
+// serveMqtt311 serves MQTT 3.1.1 connections on l until it is closed
+func serveMqtt311(l net.Listener) *fakeBroker {
+	b := &fakeBroker{
+		levels:       make(chan byte, 100),
+		subscribed:   make(chan string, 100),
+		published:    make(chan string, 100),
+		unsubscribed: make(chan string, 100),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT, the protocol name "MQTT" is followed by the protocol level
+			level := body[6]
+			b.levels <- level
+			b.mutex.Lock()
+			b.conns = append(b.conns, conn)
+			refuse := b.refuse > 0
+			if refuse {
+				b.refuse--
+			}
+			b.mutex.Unlock()
+			if refuse {
+				_, _ = conn.Write([]byte{0x20, 0x02, 0x00, 0x03})
+				return
+			}
+			if level != Version311 {
+				_, _ = conn.Write([]byte{0x20, 0x02, 0x00, 0x01})
+				return
+			}
+			_, _ = conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH
+			n := int(body[0])<<8 | int(body[1])
+			b.published <- string(body[2 : 2+n])
+		case 8: // SUBSCRIBE, the packet identifier is followed by the topic filters and their QoS
+			granted := []byte{}
+			for i := 2; i < len(body); {
+				n := int(body[i])<<8 | int(body[i+1])
+				b.subscribed <- string(body[i+2 : i+2+n])
+				granted = append(granted, body[i+2+n])
+				i += 3 + n
+			}
+			b.mutex.Lock()
+			subacks := b.subacks
+			b.mutex.Unlock()
+			if subacks != nil {
+				<-subacks
+			}
+			_, _ = conn.Write(append([]byte{0x90, byte(2 + len(granted)), body[0], body[1]}, granted...))
+		case 10: // UNSUBSCRIBE, the packet identifier is followed by the topic filters
+			for i := 2; i < len(body); {
+				n := int(body[i])<<8 | int(body[i+1])
+				b.unsubscribed <- string(body[i+2 : i+2+n])
+				i += 2 + n
+			}
+			_, _ = conn.Write([]byte{0xb0, 0x02, body[0], body[1]})
+		case 12: // PINGREQ
+			_, _ = conn.Write([]byte{0xd0, 0x00})
+		}
+	}
+}
+
+// drop closes all connections, refusing the next n connections
+func (b *fakeBroker) drop(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+	b.refuse = n
+}
+
+// readPacket reads a MQTT control packet and returns its first header byte and its body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func TestProtocolVersionDetection(t *testing.T) {
+	assert := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	b := serveMqtt311(l)
+
+	s, err := NewSession(Options{Server: l.Addr().String()}, func(*paho.Publish) {}, func() map[string]paho.SubscribeOptions { return nil })
+	assert.Nil(err)
+	assert.Equal(VersionAuto, s.ProtocolVersion())
+	go s.Run()
+
+	assert.Equal(Version5, <-b.levels)
+	assert.Equal(Version311, <-b.levels)
+	assert.Eventually(s.Connected, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(Version311, s.ProtocolVersion())
+
+	// only a CONNACK refusing the protocol version is a reason to fall back to MQTT 3.1.1. The connection
+	// of the session is kept, so its reconnect does not take the refused connection.
+	b.mutex.Lock()
+	b.refuse = 1
+	b.mutex.Unlock()
+	_, err = s.connectV5(func() {})
+	assert.NotNil(err)
+	assert.False(errors.Is(err, errProtocolRefused))
+	assert.Equal(Version5, <-b.levels)
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	b := serveMqtt311(l)
+	subacks := make(chan struct{})
+	b.subacks = subacks
+
+	s, err := NewSession(Options{Server: l.Addr().String(), ProtocolVersion: Version311}, func(*paho.Publish) {},
+		func() map[string]paho.SubscribeOptions { return map[string]paho.SubscribeOptions{"a/b": {QoS: 1}} })
+	assert.Nil(err)
+	events := make(chan string, 10)
+	s.SetConnectionHandlers(func() { events <- "up" }, func() { events <- "lost" })
+	go s.Run()
+	assert.Equal(Version311, <-b.levels)
+	assert.Equal("up", <-events)
+	assert.Equal("a/b", <-b.subscribed)
+
+	// the session is usable while the subscriptions are restored
+	assert.True(s.Connected())
+	spooled, err := s.Publish(&paho.Publish{Topic: "c/d"})
+	assert.Nil(err)
+	assert.False(spooled)
+	close(subacks)
+	assert.Equal("c/d", <-b.published)
+
+	// the first reconnect fails, the next one after the backoff delay restores the subscriptions
+	// and publishes the spooled messages
+	b.drop(1)
+	assert.Equal("lost", <-events)
+	assert.False(s.Connected())
+	spooled, err = s.Publish(&paho.Publish{Topic: "e/f"})
+	assert.Nil(err)
+	assert.True(spooled)
+	assert.Equal(Version311, <-b.levels)
+	assert.Equal(Version311, <-b.levels)
+	assert.Equal("up", <-events)
+	assert.Equal("a/b", <-b.subscribed)
+	assert.Equal("e/f", <-b.published)
+	assert.True(s.Connected())
+	assert.Equal(0, s.SpoolState().Messages)
+}
+
+func TestMergedSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	b := serveMqtt311(l)
+
+	var mutex sync.Mutex
+	subscriptions := map[string]paho.SubscribeOptions{"a/b": {QoS: 1}, "c": {QoS: 0}}
+	s, err := NewSession(Options{Server: l.Addr().String(), ProtocolVersion: Version311}, func(*paho.Publish) {},
+		func() map[string]paho.SubscribeOptions {
+			mutex.Lock()
+			defer mutex.Unlock()
+			ret := make(map[string]paho.SubscribeOptions)
+			for topic, options := range subscriptions {
+				ret[topic] = options
+			}
+			return ret
+		})
+	assert.Nil(err)
+	go s.Run()
+	assert.Equal(Version311, <-b.levels)
+	received := []string{<-b.subscribed, <-b.subscribed}
+	assert.ElementsMatch([]string{"a/b", "c"}, received)
+	assert.Eventually(s.Connected, 5*time.Second, 10*time.Millisecond)
+
+	// an overlapping filter replaces the subscription, so that the broker sends each message once
+	mutex.Lock()
+	subscriptions["a/#"] = paho.SubscribeOptions{QoS: 0}
+	mutex.Unlock()
+	assert.Nil(s.Subscribe(map[string]paho.SubscribeOptions{"a/#": {QoS: 0}}))
+	assert.Equal("a/#", <-b.subscribed)
+	assert.Equal("a/b", <-b.unsubscribed)
+	assert.Equal(map[string]paho.SubscribeOptions{"a/#": {QoS: 1}, "c": {QoS: 0}}, s.subscribed)
+
+	// the subscription is restored once the overlapping filter is removed
+	mutex.Lock()
+	delete(subscriptions, "a/#")
+	mutex.Unlock()
+	assert.Nil(s.Unsubscribe("a/#"))
+	assert.Equal("a/b", <-b.subscribed)
+	assert.Equal("a/#", <-b.unsubscribed)
+	assert.Equal(map[string]paho.SubscribeOptions{"a/b": {QoS: 1}, "c": {QoS: 0}}, s.subscribed)
+}
+
+// fakeConnection records the published topics. If block is set, publish waits for it after recording the topic and
+// fails like a broken connection.
+type fakeConnection struct {
+	published chan string
+	block     chan struct{}
+}
+
+func (c *fakeConnection) subscribe(map[string]paho.SubscribeOptions) error { return nil }
+func (c *fakeConnection) unsubscribe([]string) error                       { return nil }
+func (c *fakeConnection) disconnect()                                      {}
+
+func (c *fakeConnection) publish(pub *paho.Publish) error {
+	c.published <- pub.Topic
+	if c.block != nil {
+		<-c.block
+		return &net.OpError{Op: "write", Err: errors.New("broken pipe")}
+	}
+	return nil
+}
+
+func TestLateSpooledMessageIsDrained(t *testing.T) {
+	assert := assert.New(t)
+	s, err := NewSession(Options{}, func(*paho.Publish) {}, func() map[string]paho.SubscribeOptions { return nil })
+	assert.Nil(err)
+
+	// a publish hangs on a connection that broke
+	broken := &fakeConnection{published: make(chan string, 1), block: make(chan struct{})}
+	s.conn, s.lost = broken, make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		spooled, err := s.Publish(&paho.Publish{Topic: "late"})
+		assert.Nil(err)
+		done <- spooled
+	}()
+	assert.Equal("late", <-broken.published)
+
+	// the session reconnected and drained the empty spool before the publish failed
+	conn := &fakeConnection{published: make(chan string, 10)}
+	lost := make(chan struct{})
+	defer close(lost)
+	s.mutex.Lock()
+	s.conn, s.lost = conn, lost
+	s.mutex.Unlock()
+	go s.serve(conn, lost)
+	// let serve drain the empty spool and wait
+	time.Sleep(50 * time.Millisecond)
+
+	close(broken.block)
+	assert.True(<-done)
+	assert.Equal("late", <-conn.published)
+
+	// later messages are sent directly
+	assert.Eventually(func() bool { return s.SpoolState().Messages == 0 }, time.Second, 10*time.Millisecond)
+	spooled, err := s.Publish(&paho.Publish{Topic: "next"})
+	assert.Nil(err)
+	assert.False(spooled)
+	assert.Equal("next", <-conn.published)
+}
@@ -0,0 +1,366 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	// SpoolDropOldest drops the oldest messages to make room for new messages if the spool is full
+	SpoolDropOldest = "drop-oldest"
+	// SpoolReject rejects new messages if the spool is full
+	SpoolReject = "reject"
+
+	spoolFileExt = ".json"
+	spoolTmpExt  = ".tmp"
+)
+
+// ErrSpoolFull is returned if a message is rejected because the publish spool is full
+var ErrSpoolFull = errors.New("publish spool full")
+
+// SpoolOptions limits the messages kept while the broker is not reachable
+type SpoolOptions struct {
+	// Dir is the directory the messages are stored in to keep them across restarts. If empty, messages are kept in memory.
+	Dir string
+	// MaxMessages limits the number of spooled messages. 0 disables the limit.
+	MaxMessages int
+	// MaxBytes limits the size of all spooled messages. 0 disables the limit.
+	MaxBytes int64
+	// MaxAge drops messages that were spooled longer ago. 0 disables the limit.
+	MaxAge time.Duration
+	// Policy is either SpoolDropOldest (default) or SpoolReject
+	Policy string
+}
+
+// SpoolState describes the messages waiting to be published
+type SpoolState struct {
+	// Messages is the number of spooled messages
+	Messages int
+	// Bytes is the size of all spooled messages
+	Bytes int64
+	// Dropped is the number of messages dropped since the start because of the limits
+	Dropped int64
+}
+
+// spoolOptionsFromEnv reads the spool options from the environment
+func spoolOptionsFromEnv() (SpoolOptions, error) {
+	o := SpoolOptions{
+		Dir:         os.Getenv("PUBLISH_SPOOL_DIR"),
+		MaxMessages: maxQueuedPublishes,
+		Policy:      SpoolDropOldest,
+	}
+	var err error
+	if env := os.Getenv("PUBLISH_SPOOL_MAX_MESSAGES"); len(env) > 0 {
+		if o.MaxMessages, err = strconv.Atoi(env); err != nil || o.MaxMessages < 0 {
+			return o, fmt.Errorf("invalid PUBLISH_SPOOL_MAX_MESSAGES '%s'", env)
+		}
+	}
+	if env := os.Getenv("PUBLISH_SPOOL_MAX_BYTES"); len(env) > 0 {
+		if o.MaxBytes, err = strconv.ParseInt(env, 10, 64); err != nil || o.MaxBytes < 0 {
+			return o, fmt.Errorf("invalid PUBLISH_SPOOL_MAX_BYTES '%s'", env)
+		}
+	}
+	if env := os.Getenv("PUBLISH_SPOOL_MAX_AGE"); len(env) > 0 {
+		if o.MaxAge, err = time.ParseDuration(env); err != nil || o.MaxAge < 0 {
+			return o, fmt.Errorf("invalid PUBLISH_SPOOL_MAX_AGE '%s'", env)
+		}
+	}
+	if env := os.Getenv("PUBLISH_SPOOL_POLICY"); len(env) > 0 {
+		o.Policy = env
+	}
+	return o, nil
+}
+
+// spooledMessage is a message as stored in the spool directory
+type spooledMessage struct {
+	Time            int64               `json:"time"`
+	Topic           string              `json:"topic"`
+	QoS             byte                `json:"qos"`
+	Retain          bool                `json:"retain,omitempty"`
+	Payload         []byte              `json:"payload"`
+	ContentType     string              `json:"contentType,omitempty"`
+	MessageExpiry   *uint32             `json:"messageExpiry,omitempty"`
+	ResponseTopic   string              `json:"responseTopic,omitempty"`
+	CorrelationData []byte              `json:"correlationData,omitempty"`
+	UserProperties  paho.UserProperties `json:"userProperties,omitempty"`
+}
+
+func newSpooledMessage(pub *paho.Publish, t time.Time) spooledMessage {
+	m := spooledMessage{
+		Time:    t.UnixNano() / int64(time.Millisecond),
+		Topic:   pub.Topic,
+		QoS:     pub.QoS,
+		Retain:  pub.Retain,
+		Payload: pub.Payload,
+	}
+	if pub.Properties != nil {
+		m.ContentType = pub.Properties.ContentType
+		m.MessageExpiry = pub.Properties.MessageExpiry
+		m.ResponseTopic = pub.Properties.ResponseTopic
+		m.CorrelationData = pub.Properties.CorrelationData
+		m.UserProperties = pub.Properties.User
+	}
+	return m
+}
+
+func (m spooledMessage) publish() *paho.Publish {
+	return &paho.Publish{
+		QoS:    m.QoS,
+		Retain: m.Retain,
+		Topic:  m.Topic,
+		Properties: &paho.PublishProperties{
+			ContentType:     m.ContentType,
+			MessageExpiry:   m.MessageExpiry,
+			ResponseTopic:   m.ResponseTopic,
+			CorrelationData: m.CorrelationData,
+			User:            m.UserProperties,
+		},
+		Payload: m.Payload,
+	}
+}
+
+type spoolEntry struct {
+	pub  *paho.Publish
+	time time.Time
+	// expires is the end of the MQTT 5 message expiry interval, zero if the message does not expire
+	expires time.Time
+	size    int64
+	// file is the name of the file the message is stored in, empty if the spool is kept in memory
+	file string
+}
+
+// newSpoolEntry creates the entry of a message spooled at t. The message is copied, as the message expiry
+// interval is adjusted before it is published.
+func newSpoolEntry(pub *paho.Publish, t time.Time, size int64, file string) spoolEntry {
+	p := *pub
+	properties := paho.PublishProperties{}
+	if pub.Properties != nil {
+		properties = *pub.Properties
+	}
+	p.Properties = &properties
+	e := spoolEntry{pub: &p, time: t, size: size, file: file}
+	if properties.MessageExpiry != nil {
+		e.expires = t.Add(time.Duration(*properties.MessageExpiry) * time.Second)
+	}
+	return e
+}
+
+// spool keeps the messages published while the broker is not reachable, in memory or in a directory
+type spool struct {
+	options SpoolOptions
+	entries []spoolEntry
+	bytes   int64
+	dropped int64
+	// seq numbers the files, their names keep the messages in order
+	seq uint64
+}
+
+// newSpool creates a spool and loads the messages stored in its directory
+func newSpool(options SpoolOptions) (*spool, error) {
+	switch options.Policy {
+	case "":
+		options.Policy = SpoolDropOldest
+	case SpoolDropOldest, SpoolReject:
+	default:
+		return nil, fmt.Errorf("unknown spool policy '%s', use %s or %s", options.Policy, SpoolDropOldest, SpoolReject)
+	}
+	s := &spool{options: options}
+	if options.Dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory: %v", err)
+	}
+	files, err := ioutil.ReadDir(options.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read spool directory: %v", err)
+	}
+	// names are zero padded sequence numbers, so sorting by name restores the order
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, f := range files {
+		name := f.Name()
+		if !f.IsDir() && strings.HasSuffix(name, spoolTmpExt) {
+			// left over by a crash while a message was written
+			_ = os.Remove(filepath.Join(options.Dir, name))
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, spoolFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+		path := filepath.Join(options.Dir, name)
+		data, err := ioutil.ReadFile(path)
+		var m spooledMessage
+		if err == nil {
+			err = json.Unmarshal(data, &m)
+		}
+		if err != nil {
+			log.Printf("Dropping unreadable spooled message '%s': %s", path, err)
+			_ = os.Remove(path)
+			continue
+		}
+		s.entries = append(s.entries, newSpoolEntry(m.publish(), time.Unix(0, m.Time*int64(time.Millisecond)),
+			int64(len(data)), path))
+		s.bytes += int64(len(data))
+	}
+	if len(s.entries) > 0 {
+		log.Printf("Restored %d spooled messages", len(s.entries))
+	}
+	return s, nil
+}
+
+// add appends a message. If the spool is full, the oldest messages are dropped or the message is rejected
+// with ErrSpoolFull, depending on the policy.
+func (s *spool) add(pub *paho.Publish) error {
+	now := time.Now()
+	s.expire(now)
+
+	m := newSpooledMessage(pub, now)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if s.options.MaxBytes > 0 && size > s.options.MaxBytes {
+		return fmt.Errorf("%w: message to '%s' exceeds the spool size", ErrSpoolFull, pub.Topic)
+	}
+	for s.full(size) {
+		if s.options.Policy == SpoolReject {
+			return ErrSpoolFull
+		}
+		log.Printf("Publish spool full. Dropping message to '%s'", s.entries[0].pub.Topic)
+		s.drop()
+	}
+
+	entry := newSpoolEntry(pub, now, size, "")
+	if s.options.Dir != "" {
+		entry.file = filepath.Join(s.options.Dir, fmt.Sprintf("%020d%s", s.seq, spoolFileExt))
+		if err := writeFile(entry.file, data); err != nil {
+			return fmt.Errorf("cannot spool message: %v", err)
+		}
+		s.seq++
+	}
+	s.entries = append(s.entries, entry)
+	s.bytes += size
+	return nil
+}
+
+// first returns the oldest message that did not expire. Its message expiry interval is reduced by the
+// time it waited in the spool.
+func (s *spool) first() (*paho.Publish, bool) {
+	now := time.Now()
+	s.expire(now)
+	if len(s.entries) == 0 {
+		return nil, false
+	}
+	e := s.entries[0]
+	if !e.expires.IsZero() {
+		remaining := uint32((e.expires.Sub(now) + time.Second - 1) / time.Second)
+		e.pub.Properties.MessageExpiry = &remaining
+	}
+	return e.pub, true
+}
+
+// remove removes the oldest message after it was published
+func (s *spool) remove() {
+	e := s.entries[0]
+	if e.file != "" {
+		if err := os.Remove(e.file); err != nil {
+			log.Printf("Failed to remove spooled message '%s': %s", e.file, err)
+		}
+	}
+	s.entries = s.entries[1:]
+	s.bytes -= e.size
+	if len(s.entries) == 0 {
+		s.entries = nil
+	}
+}
+
+// drop removes the oldest message without publishing it
+func (s *spool) drop() {
+	s.remove()
+	s.dropped++
+}
+
+// expire drops the oldest messages as long as they exceeded the maximum age or their message expiry interval
+func (s *spool) expire(now time.Time) {
+	for len(s.entries) > 0 {
+		e := s.entries[0]
+		maxAgeExceeded := s.options.MaxAge > 0 && now.Sub(e.time) > s.options.MaxAge
+		if !maxAgeExceeded && (e.expires.IsZero() || now.Before(e.expires)) {
+			return
+		}
+		log.Printf("Dropping expired spooled message to '%s'", e.pub.Topic)
+		s.drop()
+	}
+}
+
+// full reports whether a message of size does not fit into the spool
+func (s *spool) full(size int64) bool {
+	if len(s.entries) == 0 {
+		return false
+	}
+	if s.options.MaxMessages > 0 && len(s.entries) >= s.options.MaxMessages {
+		return true
+	}
+	return s.options.MaxBytes > 0 && s.bytes+size > s.options.MaxBytes
+}
+
+func (s *spool) len() int {
+	return len(s.entries)
+}
+
+func (s *spool) state() SpoolState {
+	return SpoolState{
+		Messages: len(s.entries),
+		Bytes:    s.bytes,
+		Dropped:  s.dropped,
+	}
+}
+
+// writeFile writes data to a temporary file first, so a crash never leaves a partially written message
+func writeFile(file string, data []byte) error {
+	tmp := file + spoolTmpExt
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routes
+
+import (
+	conf "alm-mqtt-module/internal/config"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// defaultRequestTimeout is the time to wait for the nats reply if the route sets no timeout
+	defaultRequestTimeout = 5 * time.Second
+	// TopicHeader is the nats header carrying the MQTT topic of a forwarded request
+	TopicHeader = "Mqtt-Topic"
+	// ErrorProperty is the MQTT 5 user property set on responses of failed requests
+	ErrorProperty = "error"
+)
+
+// Request forwards MQTT 5 requests published on a topic filter as nats requests and publishes
+// the replies on the response topic of the requests
+type Request struct {
+	// Topic is the MQTT topic filter to subscribe
+	Topic string `yaml:"topic"`
+	// Subject is the template of the nats subject. Placeholders: {topic}, {1}, {2}, ... and {rest}
+	Subject string `yaml:"subject"`
+	// QoS is the QoS used to subscribe the topic filter and to publish the responses
+	QoS byte `yaml:"qos"`
+	// Timeout to wait for the nats reply in milliseconds. Defaults to 5000.
+	Timeout int `yaml:"timeout"`
+}
+
+type requestRoute struct {
+	Request
+	subject conf.Template
+	timeout time.Duration
+}
+
+// Serve forwards a MQTT request to the nats subject of the first request route matching its topic and
+// publishes the reply on the response topic of the request. It reports whether msg was handled, which is
+// not the case for messages without response topic or if no request route matches.
+func (r *Routes) Serve(msg *paho.Publish) bool {
+	if msg.Properties == nil || msg.Properties.ResponseTopic == "" {
+		return false
+	}
+	levels := strings.Split(msg.Topic, topicLevelSeparator)
+
+	r.mutex.Lock()
+	var route *requestRoute
+	for i := range r.requests {
+		if conf.MatchTopic(r.requests[i].Topic, msg.Topic) {
+			route = &r.requests[i]
+			break
+		}
+	}
+	r.mutex.Unlock()
+	if route == nil {
+		return false
+	}
+
+	if err := conf.ValidateTopicName(msg.Properties.ResponseTopic); err != nil {
+		fmt.Printf("Cannot serve request on '%s': %s\n", msg.Topic, err)
+		return true
+	}
+	subject, err := route.subject.Render(levels, subjectTokenSeparator)
+	if err == nil {
+		err = conf.ValidateSubject(subject)
+	}
+	if err != nil {
+		fmt.Printf("Cannot serve request on '%s': %s\n", msg.Topic, err)
+		// like replies, the response is sent in a separate routine, as the publish channel is served by the
+		// routine that might be waiting for the caller
+		go r.respond(route, msg, nil, err)
+		return true
+	}
+
+	// wait for the reply in a separate routine so that further messages can be processed
+	go func() {
+		fmt.Printf("\t-> nats request '%s'\n", subject)
+		req := nats.NewMsg(subject)
+		req.Data = msg.Payload
+		if r.nats.HeadersSupported() {
+			req.Header.Set(TopicHeader, msg.Topic)
+		}
+		reply, err := r.nats.RequestMsg(req, route.timeout)
+		if err != nil {
+			fmt.Printf("Request on '%s' failed: %s\n", subject, err)
+			r.respond(route, msg, nil, err)
+			return
+		}
+		r.respond(route, msg, reply.Data, nil)
+	}()
+	return true
+}
+
+// respond publishes the response to a MQTT request. Failed requests are answered with an empty payload
+// and the error in the user property `ErrorProperty`.
+func (r *Routes) respond(route *requestRoute, msg *paho.Publish, payload []byte, err error) {
+	properties := &paho.PublishProperties{
+		CorrelationData: msg.Properties.CorrelationData,
+	}
+	if err != nil {
+		properties.User.Add(ErrorProperty, err.Error())
+	}
+	r.pubChan <- paho.Publish{
+		QoS:        route.QoS,
+		Topic:      msg.Properties.ResponseTopic,
+		Properties: properties,
+		Payload:    payload,
+	}
+}
+
+// requests validates all request routes of the file and prepares their templates
+func (f File) requests() ([]requestRoute, error) {
+	requests := make([]requestRoute, 0, len(f.Requests))
+	for _, req := range f.Requests {
+		if err := conf.ValidateTopicFilter(req.Topic); err != nil {
+			return nil, err
+		}
+		if req.QoS > 2 {
+			return nil, fmt.Errorf("invalid QoS %d for topic '%s'", req.QoS, req.Topic)
+		}
+		if req.Timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout %d for topic '%s'", req.Timeout, req.Topic)
+		}
+		t, err := conf.NewTemplate(req.Subject, "topic", strings.Split(req.Topic, topicLevelSeparator), mqttMultiLevel)
+		if err != nil {
+			return nil, err
+		}
+		timeout := defaultRequestTimeout
+		if req.Timeout > 0 {
+			timeout = time.Duration(req.Timeout) * time.Millisecond
+		}
+		requests = append(requests, requestRoute{Request: req, subject: t, timeout: timeout})
+	}
+	return requests, nil
+}
@@ -0,0 +1,334 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routes
+
+import (
+	conf "alm-mqtt-module/internal/config"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	topicLevelSeparator   = "/"
+	subjectTokenSeparator = "."
+	mqttMultiLevel        = "#"
+	natsMultiLevel        = ">"
+)
+
+// File is the content of a route file. JSON files are accepted as well, as JSON is a subset of YAML.
+type File struct {
+	Inbound  []Inbound  `yaml:"inbound"`
+	Outbound []Outbound `yaml:"outbound"`
+	Requests []Request  `yaml:"requests"`
+}
+
+// Inbound forwards MQTT messages of a topic filter to a nats subject
+type Inbound struct {
+	// Topic is the MQTT topic filter to subscribe
+	Topic string `yaml:"topic"`
+	// Subject is the template of the nats subject. Placeholders: {topic}, {1}, {2}, ... and {rest}
+	Subject string `yaml:"subject"`
+	// QoS is the QoS used to subscribe the topic filter
+	QoS byte `yaml:"qos"`
+}
+
+// Outbound forwards nats messages of a subject to a MQTT topic
+type Outbound struct {
+	// Subject is the nats subject to subscribe, may contain wildcards
+	Subject string `yaml:"subject"`
+	// Topic is the template of the MQTT topic. Placeholders: {subject}, {1}, {2}, ... and {rest}
+	Topic string `yaml:"topic"`
+	// QoS is the QoS used to publish the messages
+	QoS byte `yaml:"qos"`
+	// Retain sets the retain flag of the published messages
+	Retain bool `yaml:"retain"`
+}
+
+type inboundRoute struct {
+	Inbound
+	subject conf.Template
+}
+
+type outboundRoute struct {
+	Outbound
+	topic        conf.Template
+	subscription *nats.Subscription
+}
+
+// Routes forwards messages according to static routes read from a route file
+type Routes struct {
+	nats            *nats.Conn
+	subscribeChan   chan string
+	unsubscribeChan chan string
+	pubChan         chan paho.Publish
+
+	// mutex guards all fields below
+	mutex    sync.Mutex
+	file     string
+	modTime  time.Time
+	size     int64
+	inbound  []inboundRoute
+	outbound map[Outbound]*outboundRoute
+	requests []requestRoute
+}
+
+// NewRoutes creates an empty set of routes. MQTT topic filters that need to be subscribed or can be
+// unsubscribed are sent to subscribeChan and unsubscribeChan, messages to publish on MQTT to pubChan.
+func NewRoutes(natsConn *nats.Conn, subscribeChan, unsubscribeChan chan string, pubChan chan paho.Publish) *Routes {
+	return &Routes{
+		nats:            natsConn,
+		subscribeChan:   subscribeChan,
+		unsubscribeChan: unsubscribeChan,
+		pubChan:         pubChan,
+		outbound:        make(map[Outbound]*outboundRoute),
+	}
+}
+
+// Load reads the routes from file and applies them
+func (r *Routes) Load(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("cannot read routes: %v", err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("cannot read routes: %v", err)
+	}
+	f, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("invalid routes in '%s': %v", file, err)
+	}
+	inbound, outbound, err := f.routes()
+	if err != nil {
+		return fmt.Errorf("invalid routes in '%s': %v", file, err)
+	}
+	requests, err := f.requests()
+	if err != nil {
+		return fmt.Errorf("invalid routes in '%s': %v", file, err)
+	}
+
+	r.mutex.Lock()
+	r.file = file
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	r.mutex.Unlock()
+
+	r.apply(inbound, outbound, requests)
+	return nil
+}
+
+// Watch reloads the route file whenever it changes. Invalid route files are reported and the
+// previous routes are kept. Watch never returns.
+func (r *Routes) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		r.mutex.Lock()
+		file, modTime, size := r.file, r.modTime, r.size
+		r.mutex.Unlock()
+
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Printf("Cannot check routes: %s", err)
+			continue
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+		log.Printf("Reloading routes from '%s'", file)
+		if err := r.Load(file); err != nil {
+			log.Printf("%s. Keeping previous routes", err)
+		}
+	}
+}
+
+// Topics returns the MQTT topic filters of all inbound and request routes with the highest QoS requested for each filter
+func (r *Routes) Topics() map[string]byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.topics()
+}
+
+// Forward publishes the data of a MQTT message on the subjects of all inbound routes matching topic
+func (r *Routes) Forward(topic string, data []byte) {
+	levels := strings.Split(topic, topicLevelSeparator)
+	subjects := make(map[string]bool)
+
+	r.mutex.Lock()
+	for _, route := range r.inbound {
+		if !conf.MatchTopic(route.Topic, topic) {
+			continue
+		}
+		subject, err := route.subject.Render(levels, subjectTokenSeparator)
+		if err == nil {
+			err = conf.ValidateSubject(subject)
+		}
+		if err != nil {
+			fmt.Printf("Cannot forward message of '%s': %s\n", topic, err)
+			continue
+		}
+		subjects[subject] = true
+	}
+	r.mutex.Unlock()
+
+	for subject := range subjects {
+		fmt.Printf("\t-> nats '%s'\n", subject)
+		if err := r.nats.Publish(subject, data); err != nil {
+			fmt.Printf("Publishing to subject '%s' failed: %s\n", subject, err)
+		}
+	}
+}
+
+// topics returns the topic filters of all inbound and request routes. Must be called with mutex held.
+func (r *Routes) topics() map[string]byte {
+	topics := make(map[string]byte)
+	for _, route := range r.inbound {
+		if qos, ok := topics[route.Topic]; !ok || route.QoS > qos {
+			topics[route.Topic] = route.QoS
+		}
+	}
+	for _, route := range r.requests {
+		if qos, ok := topics[route.Topic]; !ok || route.QoS > qos {
+			topics[route.Topic] = route.QoS
+		}
+	}
+	return topics
+}
+
+// apply replaces the current routes. Outbound routes that did not change keep their nats subscription.
+func (r *Routes) apply(inbound []inboundRoute, outbound map[Outbound]*outboundRoute, requests []requestRoute) {
+	r.mutex.Lock()
+	oldTopics := r.topics()
+	r.inbound = inbound
+	r.requests = requests
+	newTopics := r.topics()
+
+	for key, route := range r.outbound {
+		if _, ok := outbound[key]; ok {
+			outbound[key] = route
+			continue
+		}
+		if err := route.subscription.Unsubscribe(); err != nil {
+			log.Printf("Failed to unsubscribe '%s': %s", route.Subject, err)
+		}
+	}
+	for _, route := range outbound {
+		if route.subscription != nil {
+			continue
+		}
+		route := route
+		s, err := r.nats.Subscribe(route.Subject, func(msg *nats.Msg) {
+			r.publish(route, msg)
+		})
+		if err != nil {
+			log.Printf("Failed to subscribe '%s': %s", route.Subject, err)
+			continue
+		}
+		route.subscription = s
+	}
+	r.outbound = outbound
+	r.mutex.Unlock()
+
+	// notify after releasing the mutex, the receiver queries Topics
+	for topic, qos := range newTopics {
+		if oldQoS, ok := oldTopics[topic]; !ok || oldQoS != qos {
+			r.subscribeChan <- topic
+		}
+	}
+	for topic := range oldTopics {
+		if _, ok := newTopics[topic]; !ok {
+			r.unsubscribeChan <- topic
+		}
+	}
+}
+
+// publish forwards a nats message of an outbound route to MQTT
+func (r *Routes) publish(route *outboundRoute, msg *nats.Msg) {
+	topic, err := route.topic.Render(strings.Split(msg.Subject, subjectTokenSeparator), topicLevelSeparator)
+	if err == nil {
+		err = conf.ValidateTopicName(topic)
+	}
+	if err != nil {
+		fmt.Printf("Cannot forward message of '%s': %s\n", msg.Subject, err)
+		return
+	}
+	fmt.Printf("\t-> mqtt '%s'\n", topic)
+	r.pubChan <- paho.Publish{
+		QoS:        route.QoS,
+		Retain:     route.Retain,
+		Topic:      topic,
+		Properties: &paho.PublishProperties{},
+		Payload:    msg.Data,
+	}
+}
+
+// Parse decodes the content of a route file. Unknown fields are rejected.
+func Parse(data []byte) (File, error) {
+	var f File
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return File{}, err
+	}
+	return f, nil
+}
+
+// routes validates all routes of the file and prepares their templates
+func (f File) routes() ([]inboundRoute, map[Outbound]*outboundRoute, error) {
+	inbound := make([]inboundRoute, 0, len(f.Inbound))
+	for _, in := range f.Inbound {
+		if err := conf.ValidateTopicFilter(in.Topic); err != nil {
+			return nil, nil, err
+		}
+		if in.QoS > 2 {
+			return nil, nil, fmt.Errorf("invalid QoS %d for topic '%s'", in.QoS, in.Topic)
+		}
+		t, err := conf.NewTemplate(in.Subject, "topic", strings.Split(in.Topic, topicLevelSeparator), mqttMultiLevel)
+		if err != nil {
+			return nil, nil, err
+		}
+		inbound = append(inbound, inboundRoute{Inbound: in, subject: t})
+	}
+
+	outbound := make(map[Outbound]*outboundRoute)
+	for _, out := range f.Outbound {
+		if err := conf.ValidateSubjectFilter(out.Subject); err != nil {
+			return nil, nil, err
+		}
+		if out.QoS > 2 {
+			return nil, nil, fmt.Errorf("invalid QoS %d for subject '%s'", out.QoS, out.Subject)
+		}
+		t, err := conf.NewTemplate(out.Topic, "subject", strings.Split(out.Subject, subjectTokenSeparator), natsMultiLevel)
+		if err != nil {
+			return nil, nil, err
+		}
+		outbound[out] = &outboundRoute{Outbound: out, topic: t}
+	}
+	return inbound, outbound, nil
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routes
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRejectsInvalidRoutes(t *testing.T) {
+	assert := assert.New(t)
+	invalid := []string{
+		"inbound:\n  - topic: a/#/b\n    subject: a\n",
+		"inbound:\n  - topic: a\n    subject: a\n    qos: 3\n",
+		"outbound:\n  - subject: a.>.b\n    topic: a\n",
+		"outbound:\n  - subject: a..b\n    topic: a\n",
+		"outbound:\n  - subject: a.b\n    topic: a\n    unknown: true\n",
+		"requests:\n  - topic: a/+\n    subject: b.{3}\n",
+		"requests:\n  - topic: a/+\n    subject: b\n    timeout: -1\n",
+	}
+	for _, data := range invalid {
+		f, err := Parse([]byte(data))
+		if err == nil {
+			_, _, err = f.routes()
+		}
+		if err == nil {
+			_, err = f.requests()
+		}
+		assert.NotNil(err, data)
+	}
+
+	// JSON is accepted as well
+	f, err := Parse([]byte(`{"inbound": [{"topic": "a/#", "subject": "b.{rest}", "qos": 1}]}`))
+	assert.Nil(err)
+	_, _, err = f.routes()
+	assert.Nil(err)
+	assert.Equal([]Inbound{{Topic: "a/#", Subject: "b.{rest}", QoS: 1}}, f.Inbound)
+}
+
+func startTestRoutes(t *testing.T) (*Routes, *nats.Conn, chan string, chan string, chan paho.Publish, func()) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	s := natsserver.RunServer(&opts)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		s.Shutdown()
+		t.Fatal(err)
+	}
+	subscribeChan := make(chan string, 10)
+	unsubscribeChan := make(chan string, 10)
+	pubChan := make(chan paho.Publish, 10)
+	r := NewRoutes(nc, subscribeChan, unsubscribeChan, pubChan)
+	return r, nc, subscribeChan, unsubscribeChan, pubChan, func() {
+		nc.Close()
+		s.Shutdown()
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	assert := assert.New(t)
+	r, nc, subscribeChan, unsubscribeChan, pubChan, cleanup := startTestRoutes(t)
+	defer cleanup()
+
+	file := filepath.Join(t.TempDir(), "routes.yaml")
+	assert.Nil(ioutil.WriteFile(file, []byte(`
+inbound:
+  - topic: line1/plc/#
+    subject: plant.line1.{rest}
+    qos: 1
+  - topic: line1/plc/#
+    subject: plant.all
+    qos: 2
+outbound:
+  - subject: cmd.line1.>
+    topic: line1/cmd/{rest}
+    qos: 1
+    retain: true
+`), 0644))
+	assert.Nil(r.Load(file))
+	assert.Equal(map[string]byte{"line1/plc/#": 2}, r.Topics())
+	assert.Equal("line1/plc/#", <-subscribeChan)
+
+	// inbound
+	received := make(chan *nats.Msg, 10)
+	_, err := nc.ChanSubscribe("plant.>", received)
+	assert.Nil(err)
+	assert.Nil(nc.Flush())
+	r.Forward("line1/plc/temp", []byte("data"))
+	subjects := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			assert.Equal([]byte("data"), msg.Data)
+			subjects[msg.Subject] = true
+		case <-time.After(time.Second):
+			assert.Fail("message not forwarded")
+		}
+	}
+	assert.Equal(map[string]bool{"plant.line1.temp": true, "plant.all": true}, subjects)
+
+	// outbound
+	assert.Nil(nc.Publish("cmd.line1.valve.open", []byte("on")))
+	select {
+	case pub := <-pubChan:
+		assert.Equal("line1/cmd/valve/open", pub.Topic)
+		assert.Equal(byte(1), pub.QoS)
+		assert.True(pub.Retain)
+		assert.Equal([]byte("on"), pub.Payload)
+	case <-time.After(time.Second):
+		assert.Fail("message not forwarded")
+	}
+
+	// reload replaces the routes
+	assert.Nil(ioutil.WriteFile(file, []byte(`{"inbound": [{"topic": "line2/#", "subject": "plant.line2"}]}`), 0644))
+	assert.Nil(r.Load(file))
+	assert.Equal(map[string]byte{"line2/#": 0}, r.Topics())
+	assert.Equal("line2/#", <-subscribeChan)
+	assert.Equal("line1/plc/#", <-unsubscribeChan)
+
+	assert.Nil(nc.Publish("cmd.line1.valve.open", []byte("on")))
+	assert.Nil(nc.Flush())
+	select {
+	case <-pubChan:
+		assert.Fail("outbound route not removed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// invalid routes are rejected
+	assert.Nil(ioutil.WriteFile(file, []byte(`{"inbound": [{"topic": "line2/#/x", "subject": "plant"}]}`), 0644))
+	assert.NotNil(r.Load(file))
+	assert.Equal(map[string]byte{"line2/#": 0}, r.Topics())
+}
+
+func TestRequestRoutes(t *testing.T) {
+	assert := assert.New(t)
+	r, nc, subscribeChan, _, pubChan, cleanup := startTestRoutes(t)
+	defer cleanup()
+
+	file := filepath.Join(t.TempDir(), "routes.yaml")
+	assert.Nil(ioutil.WriteFile(file, []byte(`
+requests:
+  - topic: devices/+/rpc/#
+    subject: services.{rest}
+    qos: 1
+    timeout: 200
+`), 0644))
+	assert.Nil(r.Load(file))
+	assert.Equal("devices/+/rpc/#", <-subscribeChan)
+
+	_, err := nc.Subscribe("services.time.get", func(msg *nats.Msg) {
+		assert.Equal("devices/d1/rpc/time/get", msg.Header.Get(TopicHeader))
+		assert.Nil(msg.Respond(append([]byte("re: "), msg.Data...)))
+	})
+	assert.Nil(err)
+	assert.Nil(nc.Flush())
+
+	request := func(topic string) *paho.Publish {
+		return &paho.Publish{
+			Topic:   topic,
+			Payload: []byte("now"),
+			Properties: &paho.PublishProperties{
+				ResponseTopic:   "devices/d1/response",
+				CorrelationData: []byte("42"),
+			},
+		}
+	}
+
+	assert.True(r.Serve(request("devices/d1/rpc/time/get")))
+	select {
+	case pub := <-pubChan:
+		assert.Equal("devices/d1/response", pub.Topic)
+		assert.Equal([]byte("42"), pub.Properties.CorrelationData)
+		assert.Equal([]byte("re: now"), pub.Payload)
+		assert.Empty(pub.Properties.User)
+	case <-time.After(time.Second):
+		assert.Fail("no response published")
+	}
+
+	// no service for the subject
+	assert.True(r.Serve(request("devices/d1/rpc/unknown")))
+	select {
+	case pub := <-pubChan:
+		assert.Equal([]byte("42"), pub.Properties.CorrelationData)
+		assert.Empty(pub.Payload)
+		assert.NotEqual("", pub.Properties.User.Get(ErrorProperty))
+	case <-time.After(time.Second):
+		assert.Fail("no response published")
+	}
+
+	// a subject that can not be rendered is answered without blocking the caller on a full publish channel
+	for i := 0; i < cap(pubChan); i++ {
+		pubChan <- paho.Publish{}
+	}
+	served := make(chan bool)
+	go func() { served <- r.Serve(request("devices/d1/rpc")) }()
+	select {
+	case ok := <-served:
+		assert.True(ok)
+	case <-time.After(time.Second):
+		assert.Fail("serve blocked")
+	}
+	for i := 0; i < cap(pubChan); i++ {
+		<-pubChan
+	}
+	select {
+	case pub := <-pubChan:
+		assert.Equal([]byte("42"), pub.Properties.CorrelationData)
+		assert.NotEqual("", pub.Properties.User.Get(ErrorProperty))
+	case <-time.After(time.Second):
+		assert.Fail("no response published")
+	}
+
+	// no request or no matching request route
+	assert.False(r.Serve(&paho.Publish{Topic: "devices/d1/rpc/time/get", Properties: &paho.PublishProperties{}}))
+	assert.False(r.Serve(request("other/topic")))
+}
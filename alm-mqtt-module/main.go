@@ -18,23 +18,31 @@ package main
 
 import (
 	conf "alm-mqtt-module/internal/config"
+	"alm-mqtt-module/internal/health"
+	"alm-mqtt-module/internal/metrics"
+	"alm-mqtt-module/internal/mqtt"
+	"alm-mqtt-module/internal/routes"
 	"alm-mqtt-module/internal/version"
 	"alm-mqtt-module/pkg/avro"
 	"alm-mqtt-module/pkg/client"
-	"context"
 	"fmt"
 	"log"
-	"net"
+	"net/http"
 	"os"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
 
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	connectTimeoutSeconds int = 30
+	// routesReloadInterval is the interval the route file is checked for changes
+	routesReloadInterval = 5 * time.Second
+	// defaultHealthMaxDisconnected is the time without connection to the broker after which the module is not live anymore
+	defaultHealthMaxDisconnected = 5 * time.Minute
 )
 
 var (
@@ -44,44 +52,74 @@ var (
 	newConfigRegisterChan   chan string
 	newConfigUnregisterChan chan string
 	pubChan                 chan paho.Publish
+	staticRoutes            *routes.Routes
+	reqRepTopic             string
+	healthMonitor           *health.Monitor
+	// subscribed contains the options the topic filters were subscribed with last. It is only used by the main loop.
+	subscribed = map[string]paho.SubscribeOptions{}
 )
 
+// subscriber subscribes topic filters on the MQTT broker
+type subscriber interface {
+	Subscribe(subscriptions map[string]paho.SubscribeOptions) error
+}
+
+// mqttRouter dispatches every incoming MQTT message exactly once, regardless of how many
+// subscribed topic filters match it. Fan-out to the registrations is done by the config.
+// Requests served by a request route are not forwarded to the registrations.
+func mqttRouter(msg *paho.Publish) {
+	defer healthMonitor.MessageProcessed()
+	if config.HandleResponse(msg) {
+		fmt.Println("New MQTT response received")
+		return
+	}
+	if staticRoutes.Serve(msg) {
+		return
+	}
+	mqttHandler(msg)
+}
+
 func mqttHandler(msg *paho.Publish) {
 	fmt.Printf("New MQTT message for '%s'\n", msg.Topic)
 
-	m := make(map[string]interface{})
-	m["payload"] = msg.Payload
-	m["acqTime"] = time.Now().Unix()
-	m["device"] = deviceID
-	avro, err := avro.Writer(m, client.DataCodec)
+	data, err := encodeMessage(msg)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Printf("Cannot encode message of '%s': %s\n", msg.Topic, err)
+		return
 	}
 
-	config.MessageChannelsMutex.Lock()
-	ch := config.GetChannelsForTopic(msg.Topic)
-	for k := range ch {
-		ch[k] <- avro
-	}
-	config.MessageChannelsMutex.Unlock()
-}
+	config.Dispatch(msg.Topic, msg.Retain, data)
 
-func reqestResponseHandler(msg *paho.Publish) {
-	fmt.Println("New MQTT response received")
+	staticRoutes.Forward(msg.Topic, data)
+}
 
-	config.RequestResponseMutex.Lock()
-	if respChan, ok := config.RequestResponse[string(msg.Properties.CorrelationData)]; ok {
-		respChan <- msg.Payload
+// encodeMessage encodes a MQTT message with its metadata as forwarded to the subscribers, see `client.ParseMessage`
+func encodeMessage(msg *paho.Publish) ([]byte, error) {
+	m := make(map[string]interface{})
+	m["payload"] = msg.Payload
+	m["acqTime"] = time.Now().Unix()
+	m["device"] = deviceID
+	m["topic"] = msg.Topic
+	m["qos"] = int32(msg.QoS)
+	m["retained"] = msg.Retain
+	userProperties := make([]interface{}, 0)
+	if msg.Properties != nil {
+		m["contentType"] = msg.Properties.ContentType
+		m["correlationData"] = msg.Properties.CorrelationData
+		for _, p := range msg.Properties.User {
+			userProperties = append(userProperties, map[string]interface{}{"key": p.Key, "value": p.Value})
+		}
 	}
-	config.RequestResponseMutex.Unlock()
+	m["userProperties"] = userProperties
+	return avro.Writer(m, client.DataCodec)
 }
 
 func main() {
 	log.Printf("alm-mqtt-module version: %s\n", version.Version)
 
-	mqttServer := "mosquitto:1883"
-	if env := os.Getenv("MQTT_SERVER"); len(env) > 0 {
-		mqttServer = env
+	mqttOptions, err := mqtt.OptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	natsServer := "nats"
@@ -117,100 +155,180 @@ func main() {
 	natsClient = <-natsClientChan
 	defer natsClient.Close()
 
-	mqttClientChan := make(chan *paho.Client)
-	go func() {
-		conn, err := net.Dial("tcp", mqttServer)
-		if err != nil {
-			log.Fatalf("Failed to connect to %s: %s", mqttServer, err)
-		}
+	// Channels to register and unregister for 100 simultations requests
+	newConfigRegisterChan = make(chan string, 100)
+	newConfigUnregisterChan = make(chan string, 100)
+	pubChan = make(chan paho.Publish, 100)
 
-		// From https://github.com/eclipse/paho.golang/blob/336f2adf08b8233199ac8132b8dd12cbb8c69eca/paho/client.go
-		// client.Conn *MUST* be set to an already connected net.Conn before
-		// Connect() is called.
-		client := paho.NewClient(paho.ClientConfig{
-			Conn: conn,
-		})
+	config = conf.NewConfig("alm-mqtt-module", natsClient, newConfigRegisterChan, newConfigUnregisterChan, pubChan)
 
-		for i := 0; i < connectTimeoutSeconds; i++ {
-			// Connect Client to MQTT Broker
-			res, err := client.Connect(context.Background(), &paho.Connect{})
-			if err != nil {
-				log.Printf("Failed to connect to %s: %s", mqttServer, err.Error())
-			} else if res.ReasonCode != 0 {
-				log.Printf("Failed to connect with reason: %d - %s", res.ReasonCode, res.Properties.ReasonString)
-			} else {
-				println("Connected to MQTT Broker successfully")
-				mqttClientChan <- client
-				return
-			}
-			time.Sleep(time.Second)
+	// Restore registrations before the session subscribes to the registered topics
+	if env := os.Getenv("REGISTRATIONS_FILE"); len(env) > 0 {
+		if err := config.PersistRegistrations(env); err != nil {
+			log.Fatal(err)
 		}
-		log.Fatal("Cannot connect to MQTT broker.")
-	}()
-
-	mqttClient := <-mqttClientChan
+	}
 
 	// Request reply topic wildcard
-	reqRepTopic := fmt.Sprintf("%s#", conf.ResponseTopicStart)
-	// Register separate handler for this topic
-	mqttClient.Router.RegisterHandler(reqRepTopic, reqestResponseHandler)
-	// Subscribe to response topics
-	if _, err := (*mqttClient).Subscribe(context.Background(), &paho.Subscribe{
-		Subscriptions: map[string]paho.SubscribeOptions{
-			reqRepTopic: {QoS: 2},
-		},
-	}); err != nil {
+	reqRepTopic = fmt.Sprintf("%s#", conf.ResponseTopicStart)
+
+	// Static routes share the subscribe and unsubscribe channels with the registrations
+	staticRoutes = routes.NewRoutes(natsClient, newConfigRegisterChan, newConfigUnregisterChan, pubChan)
+	if env := os.Getenv("ROUTES_FILE"); len(env) > 0 {
+		go func() {
+			if err := staticRoutes.Load(env); err != nil {
+				log.Fatal(err)
+			}
+			staticRoutes.Watch(routesReloadInterval)
+		}()
+	}
+
+	// The session restores the response topics and all registered topics after each (re)connect
+	mqttSession, err := mqtt.NewSession(mqttOptions, mqttRouter, subscriptions)
+	if err != nil {
 		log.Fatal(err)
 	}
+	config.SetProtocolVersion(mqttSession.ProtocolVersion)
+	config.SetPublisher(mqttSession.Publish, mqttSession.SpoolState)
 
-	// Channels to register and unregister for 100 simultations requests
-	newConfigRegisterChan = make(chan string, 100)
-	newConfigUnregisterChan = make(chan string, 100)
-	pubChan = make(chan paho.Publish, 100)
+	var maxIdle time.Duration
+	if env := os.Getenv("HEALTH_MAX_IDLE"); len(env) > 0 {
+		if maxIdle, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("Invalid HEALTH_MAX_IDLE '%s': %s", env, err)
+		}
+	}
+	maxDisconnected := defaultHealthMaxDisconnected
+	if env := os.Getenv("HEALTH_MAX_DISCONNECTED"); len(env) > 0 {
+		if maxDisconnected, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("Invalid HEALTH_MAX_DISCONNECTED '%s': %s", env, err)
+		}
+	}
+	healthMonitor = health.NewMonitor(natsClient, mqttSession.Connected, maxIdle, maxDisconnected)
+	mqttSession.SetConnectionHandlers(healthMonitor.ConnectionUp, healthMonitor.ConnectionLost)
+	go mqttSession.Run()
 
-	config = conf.NewConfig("alm-mqtt-module", natsClient, newConfigRegisterChan, newConfigUnregisterChan, pubChan)
+	if env := os.Getenv("HTTP_ADDRESS"); len(env) > 0 {
+		serveHTTP(env, mqttSession)
+	}
 
-	go config.HandleConfigRequests()
-	go config.HandlePublishRequests()
-	go config.HandleRequestResponse()
+	config.HandleConfigRequests()
+	config.HandlePublishRequests()
+	config.HandleRequestResponse()
+	config.HandleAdminRequests()
+	if err := healthMonitor.HandleRequests("alm-mqtt-module"); err != nil {
+		log.Fatal(err)
+	}
+	config.AnnounceStart()
 
 	for {
 		select {
 		case newMqttTopic := <-newConfigRegisterChan:
-			fmt.Printf("Subscribing '%s'\n", newMqttTopic)
-
-			// Register separate handler for this topic
-			mqttClient.Router.RegisterHandler(newMqttTopic, mqttHandler)
-
-			if _, err := (*mqttClient).Subscribe(context.Background(), &paho.Subscribe{
-				Subscriptions: map[string]paho.SubscribeOptions{
-					newMqttTopic: {QoS: 1},
-				},
-			}); err != nil {
-				log.Fatal(err)
+			if options, ok := subscriptions()[newMqttTopic]; ok {
+				subscribe(mqttSession, newMqttTopic, options)
 			}
 
 		case removeMqttTopic := <-newConfigUnregisterChan:
+			if options, ok := subscriptions()[removeMqttTopic]; ok {
+				// still needed by a registration or a route, the options might be lowered
+				subscribe(mqttSession, removeMqttTopic, options)
+				continue
+			}
+			delete(subscribed, removeMqttTopic)
 			fmt.Printf("Unsubscribing '%s'\n", removeMqttTopic)
-			if _, err := (*mqttClient).Unsubscribe(context.Background(), &paho.Unsubscribe{
-				Topics: []string{removeMqttTopic},
-			}); err != nil {
-				log.Fatal(err)
+			if err := mqttSession.Unsubscribe(removeMqttTopic); err != nil {
+				log.Printf("Failed to unsubscribe '%s': %s", removeMqttTopic, err)
 			}
 
-			// Unregister separate handler for this topic
-			mqttClient.Router.UnregisterHandler(removeMqttTopic)
-
 		case pub := <-pubChan:
+			// subscribe pending topics first, the message may be a request whose response topic must be
+			// subscribed before the request is published
+		pending:
+			for {
+				select {
+				case newMqttTopic := <-newConfigRegisterChan:
+					if options, ok := subscriptions()[newMqttTopic]; ok {
+						subscribe(mqttSession, newMqttTopic, options)
+					}
+				default:
+					break pending
+				}
+			}
 			fmt.Printf("Publish message to topic '%s'\n", pub.Topic)
 
-			if _, err := (*mqttClient).Publish(context.Background(), &pub); err != nil {
-				log.Fatal(err)
+			if _, err := mqttSession.Publish(&pub); err != nil {
+				log.Printf("Failed to publish message to topic '%s': %s", pub.Topic, err)
 			}
 		}
 	}
 }
 
+// subscribe subscribes a MQTT topic filter with the options currently needed for it. A filter already
+// subscribed with these options is not subscribed again, as the broker would send the retained messages again.
+func subscribe(session subscriber, topic string, options paho.SubscribeOptions) {
+	if current, ok := subscribed[topic]; ok && current == options {
+		return
+	}
+	fmt.Printf("Subscribing '%s'\n", topic)
+
+	if err := session.Subscribe(map[string]paho.SubscribeOptions{
+		topic: options,
+	}); err != nil {
+		log.Printf("Failed to subscribe '%s': %s", topic, err)
+		// the options of the filter on the broker are unknown, e.g. restored with other options on reconnect
+		delete(subscribed, topic)
+		return
+	}
+	subscribed[topic] = options
+}
+
+// subscriptions returns all MQTT topic filters needed by the response topics, the registrations, the
+// pending requests and the static routes. Filters used by several of them are subscribed with the
+// highest QoS and the most permissive options.
+func subscriptions() map[string]paho.SubscribeOptions {
+	subscriptions := config.GetSubscriptions()
+	subscriptions[reqRepTopic] = paho.SubscribeOptions{QoS: 2}
+	for topic, qos := range staticRoutes.Topics() {
+		options := paho.SubscribeOptions{QoS: qos}
+		if s, ok := subscriptions[topic]; ok {
+			options = conf.MergeSubscribeOptions(s, options)
+		}
+		subscriptions[topic] = options
+	}
+	return subscriptions
+}
+
+// serveHTTP starts the HTTP server providing the metrics and health endpoints
+func serveHTTP(address string, mqttSession *mqtt.Session) {
+	metrics.Gauge(prometheus.DefaultRegisterer, "registrations", "Registrations forwarding MQTT topics to nats", func() float64 {
+		registrations, _ := config.GetRegistrationInfos()
+		return float64(len(registrations))
+	})
+	metrics.Gauge(prometheus.DefaultRegisterer, "nats_registrations", "Registrations forwarding nats subjects to MQTT", func() float64 {
+		_, natsRegistrations := config.GetRegistrationInfos()
+		return float64(len(natsRegistrations))
+	})
+	metrics.Gauge(prometheus.DefaultRegisterer, "pending_requests", "Request-reply correlations waiting for a response", func() float64 {
+		return float64(len(config.GetPendingRequests()))
+	})
+	metrics.Gauge(prometheus.DefaultRegisterer, "publish_spool_messages", "Messages waiting in the publish spool", func() float64 {
+		return float64(mqttSession.SpoolState().Messages)
+	})
+	metrics.Gauge(prometheus.DefaultRegisterer, "mqtt_connected", "Whether the connection to the MQTT broker is established", func() float64 {
+		return metrics.Bool(mqttSession.Connected())
+	})
+	metrics.Gauge(prometheus.DefaultRegisterer, "nats_connected", "Whether the connection to the nats server is established", func() float64 {
+		return metrics.Bool(natsClient.IsConnected())
+	})
+
+	mux := http.NewServeMux()
+	metrics.Handle(mux, prometheus.DefaultGatherer)
+	healthMonitor.Handle(mux)
+	go func() {
+		log.Printf("Serving HTTP on '%s'", address)
+		log.Fatal(http.ListenAndServe(address, mux))
+	}()
+}
+
 func setupConnOptions(opts []nats.Option) []nats.Option {
 	totalWait := 10 * time.Minute
 	reconnectDelay := time.Second
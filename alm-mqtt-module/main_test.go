@@ -0,0 +1,108 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"alm-mqtt-module/pkg/client"
+	"alm-mqtt-module/pkg/schema"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	assert := assert.New(t)
+	deviceID = "device1"
+	start := time.Now().Truncate(time.Second)
+
+	data, err := encodeMessage(&paho.Publish{
+		QoS:    2,
+		Retain: true,
+		Topic:  "sensors/temp",
+		Properties: &paho.PublishProperties{
+			ContentType:     "application/json",
+			CorrelationData: []byte("c1"),
+			User:            paho.UserProperties{{Key: "unit", Value: "celsius"}, {Key: "unit", Value: "kelvin"}},
+		},
+		Payload: []byte(`{"value":21}`),
+	})
+	assert.Nil(err)
+	msg, err := client.ParseMessage(data)
+	assert.Nil(err)
+	assert.Equal("device1", msg.Device)
+	assert.False(msg.AcqTime.Before(start))
+	assert.Equal("sensors/temp", msg.Topic)
+	assert.Equal([]byte(`{"value":21}`), msg.Payload)
+	assert.Equal(byte(2), msg.QoS)
+	assert.True(msg.Retained)
+	assert.Equal("application/json", msg.ContentType)
+	assert.Equal([]byte("c1"), msg.CorrelationData)
+	assert.Equal([]schema.UserProperty{{Key: "unit", Value: "celsius"}, {Key: "unit", Value: "kelvin"}}, msg.UserProperties)
+
+	// MQTT 3.1.1 messages have no properties
+	data, err = encodeMessage(&paho.Publish{Topic: "sensors/temp", Payload: []byte("21")})
+	assert.Nil(err)
+	msg, err = client.ParseMessage(data)
+	assert.Nil(err)
+	assert.Equal("sensors/temp", msg.Topic)
+	assert.Equal([]byte("21"), msg.Payload)
+	assert.Equal(byte(0), msg.QoS)
+	assert.False(msg.Retained)
+	assert.Equal("", msg.ContentType)
+	assert.Empty(msg.CorrelationData)
+	assert.Nil(msg.UserProperties)
+}
+
+// fakeSubscriber records the subscribed options and fails while err is set
+type fakeSubscriber struct {
+	subscribed []paho.SubscribeOptions
+	err        error
+}
+
+func (s *fakeSubscriber) Subscribe(subscriptions map[string]paho.SubscribeOptions) error {
+	if s.err != nil {
+		return s.err
+	}
+	for _, options := range subscriptions {
+		s.subscribed = append(s.subscribed, options)
+	}
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	subscribed = map[string]paho.SubscribeOptions{}
+	s := &fakeSubscriber{}
+
+	subscribe(s, "sensors/#", paho.SubscribeOptions{QoS: 1})
+	// unchanged options are not subscribed again
+	subscribe(s, "sensors/#", paho.SubscribeOptions{QoS: 1})
+	subscribe(s, "sensors/#", paho.SubscribeOptions{QoS: 2})
+	// lowered options are subscribed again
+	subscribe(s, "sensors/#", paho.SubscribeOptions{QoS: 1})
+	assert.Equal([]paho.SubscribeOptions{{QoS: 1}, {QoS: 2}, {QoS: 1}}, s.subscribed)
+
+	// a failed subscribe is retried with the same options
+	s.err = errors.New("not connected")
+	subscribe(s, "sensors/#", paho.SubscribeOptions{QoS: 2})
+	s.err = nil
+	subscribe(s, "sensors/#", paho.SubscribeOptions{QoS: 1})
+	assert.Equal([]paho.SubscribeOptions{{QoS: 1}, {QoS: 2}, {QoS: 1}, {QoS: 1}}, s.subscribed)
+}
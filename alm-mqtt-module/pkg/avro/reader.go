@@ -18,6 +18,7 @@ package avro
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/linkedin/goavro"
 )
@@ -80,7 +81,14 @@ func (a *Reader) Map() (map[string]interface{}, error) {
 			if err != nil {
 				return nil, err
 			}
-			a.data = datum.(map[string]interface{})
+			data, ok := datum.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("data is not an avro record")
+			}
+			a.data = data
+		}
+		if err := a.ocfr.Err(); err != nil {
+			return nil, err
 		}
 	}
 	return a.data, nil
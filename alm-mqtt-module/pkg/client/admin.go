@@ -0,0 +1,98 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"alm-mqtt-module/pkg/avro"
+	"alm-mqtt-module/pkg/schema"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ListRegistrations returns all active registrations of the module with their delivery counters
+func (c *Client) ListRegistrations() (schema.AdminRegistrationsResponseType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.ListRegistrationsCtx(ctx)
+}
+
+// ListRegistrationsCtx is like `ListRegistrations` but honours the deadline and cancellation of ctx.
+func (c *Client) ListRegistrationsCtx(ctx context.Context) (schema.AdminRegistrationsResponseType, error) {
+	res := schema.AdminRegistrationsResponseType{}
+	if err := c.admin(ctx, "admin.registrations", &res); err != nil {
+		return schema.AdminRegistrationsResponseType{}, err
+	}
+	if res.Error != "" {
+		return schema.AdminRegistrationsResponseType{}, fmt.Errorf("%s", res.Error)
+	}
+	return res, nil
+}
+
+// ListTopics returns the MQTT topic filters subscribed by the module for registrations and pending requests
+// and the request-reply correlations waiting for responses
+func (c *Client) ListTopics() (schema.AdminTopicsResponseType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.ListTopicsCtx(ctx)
+}
+
+// ListTopicsCtx is like `ListTopics` but honours the deadline and cancellation of ctx.
+func (c *Client) ListTopicsCtx(ctx context.Context) (schema.AdminTopicsResponseType, error) {
+	res := schema.AdminTopicsResponseType{}
+	if err := c.admin(ctx, "admin.topics", &res); err != nil {
+		return schema.AdminTopicsResponseType{}, err
+	}
+	if res.Error != "" {
+		return schema.AdminTopicsResponseType{}, fmt.Errorf("%s", res.Error)
+	}
+	return res, nil
+}
+
+// Health returns whether the module is live and ready, the state of its connections and the time since
+// it processed the last MQTT message
+func (c *Client) Health() (schema.HealthType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.HealthCtx(ctx)
+}
+
+// HealthCtx is like `Health` but honours the deadline and cancellation of ctx.
+func (c *Client) HealthCtx(ctx context.Context) (schema.HealthType, error) {
+	res := schema.HealthType{}
+	if err := c.admin(ctx, "health", &res); err != nil {
+		return schema.HealthType{}, err
+	}
+	return res, nil
+}
+
+// admin sends an admin request without data and decodes the response into res
+func (c *Client) admin(ctx context.Context, subject string, res interface{}) error {
+	response, err := c.request(ctx, subject, nil)
+	if err != nil {
+		return err
+	}
+	reader, err := avro.NewReader(response.Data)
+	if err != nil {
+		return err
+	}
+	j, err := reader.ByteString()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, res)
+}
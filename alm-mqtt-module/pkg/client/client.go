@@ -19,17 +19,32 @@ package client
 import (
 	"alm-mqtt-module/pkg/avro"
 	"alm-mqtt-module/pkg/schema"
+	"context"
 
 	// no need for a name
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/linkedin/goavro"
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	// DefaultLease is the lease requested for subscriptions, registrations with `schema.DeliveryModePublish` and
+	// nats subject registrations. The client renews the lease automatically until the subject is unregistered.
+	DefaultLease = 30 * time.Second
+	// requestTimeout is the timeout of requests to the module made by methods without context
+	requestTimeout = 2 * time.Second
+	// maxReregisterDelay limits the delay between attempts to register a lost registration again
+	maxReregisterDelay = 30 * time.Second
+)
+
 var (
 	//go:embed avro_schemas/dataSchema.avsc
 	dataSchema string
@@ -41,22 +56,154 @@ var (
 type Client struct {
 	nats   *nats.Conn
 	target string
+	// registrations contains the registrations made by the client by their subject or ID
+	registrations      map[string]*registration
+	registrationsMutex sync.Mutex
+	// lifecycleOnce subscribes the lifecycle events of the module with the first registration
+	lifecycleOnce sync.Once
 }
 
 // NewClient creates a new client for talking to `alm-mqtt-module`
 func NewClient(target string, nats *nats.Conn) *Client {
 	return &Client{
-		nats:   nats,
-		target: target,
+		nats:          nats,
+		target:        target,
+		registrations: make(map[string]*registration),
+	}
+}
+
+// RegisterOptions contains the optional settings of a registration
+type RegisterOptions struct {
+	// Lease of the registration. Without lease, the registration is removed as soon as a forwarded message is not
+	// acknowledged in time. `schema.DeliveryModePublish` requires a lease and defaults to `DefaultLease`.
+	Lease time.Duration
+	// Delivery is either `schema.DeliveryModeAck` (default), `schema.DeliveryModePublish` or `schema.DeliveryModeStream`.
+	// With `schema.DeliveryModePublish` subscribers must not respond to the forwarded messages.
+	Delivery string
+	// Stream configures the JetStream stream used with `schema.DeliveryModeStream`
+	Stream StreamOptions
+	// QoS requested for the topic. Defaults to 1, use `QoS` to request another QoS.
+	// The module subscribes each topic with the highest QoS requested by any registration.
+	QoS *byte
+	// NoLocal is the MQTT 5 no local option. It is only applied if all registrations of the topic request it.
+	NoLocal bool
+	// RetainAsPublished is the MQTT 5 retain as published option. It is applied if any registration of the topic requests it.
+	RetainAsPublished bool
+	// RetainHandling is the MQTT 5 retain handling: 0 sends retained messages on registration, 1 only if the
+	// topic is not subscribed by the module yet, 2 never sends retained messages.
+	RetainHandling byte
+	// QueueSize is the number of messages the module queues for the subscriber. 0 selects the default of the module.
+	QueueSize int
+	// Overflow selects which message is dropped if the queue is full: `schema.OverflowDropOldest` (default),
+	// `schema.OverflowDropNewest` or `schema.OverflowDisconnect`, which removes the registration.
+	Overflow string
+}
+
+// QoS returns a pointer to qos to be used in `RegisterOptions`, `NatsRegisterOptions` and `PublishOptions`
+func QoS(qos byte) *byte {
+	return &qos
+}
+
+// qosOrDefault returns the requested QoS or the default QoS 1
+func qosOrDefault(qos *byte) int32 {
+	if qos == nil {
+		return 1
 	}
+	return int32(*qos)
+}
+
+// StreamOptions configures the JetStream stream the MQTT messages are stored in.
+// Consumers read the stream using the JetStream API of nats.go, e.g. to replay from a sequence or time.
+type StreamOptions struct {
+	// Name of the stream. The stream is created if it does not exist.
+	Name string
+	// Subject the messages are stored with. Defaults to `<target>.stream.<Name>`, which can be used by only one
+	// registration of the stream. Subjects starting with `<target>.` are reserved for the module.
+	Subject string
+	// MaxAge, MaxMsgs and MaxBytes limit the stream. 0 is unlimited.
+	MaxAge   time.Duration
+	MaxMsgs  int64
+	MaxBytes int64
+}
+
+// request sends a request to the module on subject <target>.<subject>
+func (c *Client) request(ctx context.Context, subject string, data []byte) (*nats.Msg, error) {
+	response, err := c.nats.RequestWithContext(ctx, fmt.Sprintf("%s.%s", c.target, subject), data)
+	if err != nil {
+		if c.nats.LastError() != nil {
+			return nil, fmt.Errorf("%v for request", c.nats.LastError())
+		}
+		return nil, err
+	}
+	return response, nil
 }
 
 // RegisterMqttTopic is used to let a client register to a specific MQTT topic.
 // This functions returns a nats subject the client can subscribe to in order to read the
-// forwarded message.
+// forwarded message. Each forwarded message has to be acknowledged using `msg.Respond`.
+// The registration has no lease and is removed as soon as a forwarded message is not acknowledged in time.
 func (c *Client) RegisterMqttTopic(topic string) (schema.RegisterSubResponseType, error) {
+	return c.RegisterMqttTopicWithOptions(topic, RegisterOptions{})
+}
+
+// RegisterMqttTopicCtx is like `RegisterMqttTopic` but honours the deadline and cancellation of ctx.
+func (c *Client) RegisterMqttTopicCtx(ctx context.Context, topic string) (schema.RegisterSubResponseType, error) {
+	return c.RegisterMqttTopicWithOptionsCtx(ctx, topic, RegisterOptions{})
+}
+
+// RegisterMqttTopicWithOptions is like `RegisterMqttTopic` but allows to set the delivery mode and lease.
+func (c *Client) RegisterMqttTopicWithOptions(topic string, opts RegisterOptions) (schema.RegisterSubResponseType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.RegisterMqttTopicWithOptionsCtx(ctx, topic, opts)
+}
+
+// RegisterMqttTopicWithOptionsCtx is like `RegisterMqttTopicWithOptions` but honours the deadline and cancellation of ctx.
+func (c *Client) RegisterMqttTopicWithOptionsCtx(ctx context.Context, topic string, opts RegisterOptions) (schema.RegisterSubResponseType, error) {
+	res, err := c.registerMqttTopic(ctx, topic, opts, "")
+	if err != nil {
+		return schema.RegisterSubResponseType{}, err
+	}
+	c.track(res.Subject, false, time.Duration(res.Lease)*time.Millisecond, func(ctx context.Context) (time.Duration, error) {
+		subject := res.Subject
+		if opts.Delivery == schema.DeliveryModeStream {
+			// the subject of stream registrations follows from their options
+			subject = ""
+		}
+		again, err := c.registerMqttTopic(ctx, topic, opts, subject)
+		return time.Duration(again.Lease) * time.Millisecond, err
+	})
+	return res, nil
+}
+
+// registerMqttTopic sends a register request. A non-empty subject registers a lost registration again.
+func (c *Client) registerMqttTopic(ctx context.Context, topic string, opts RegisterOptions, subject string) (schema.RegisterSubResponseType, error) {
+	if opts.Delivery == "" {
+		opts.Delivery = schema.DeliveryModeAck
+	}
+	// without acknowledge, the lease is the only way for the module to detect gone subscribers
+	if opts.Lease == 0 && opts.Delivery == schema.DeliveryModePublish {
+		opts.Lease = DefaultLease
+	}
 	msg := make(map[string]interface{})
 	msg["topic"] = topic
+	msg["lease"] = int32(opts.Lease / time.Millisecond)
+	msg["delivery"] = opts.Delivery
+	msg["stream"] = opts.Stream.Name
+	msg["streamSubject"] = opts.Stream.Subject
+	msg["maxAge"] = int64(opts.Stream.MaxAge / time.Millisecond)
+	msg["maxMsgs"] = opts.Stream.MaxMsgs
+	msg["maxBytes"] = opts.Stream.MaxBytes
+	msg["qos"] = qosOrDefault(opts.QoS)
+	msg["noLocal"] = opts.NoLocal
+	msg["retainAsPublished"] = opts.RetainAsPublished
+	msg["retainHandling"] = int32(opts.RetainHandling)
+	msg["queueSize"] = int32(opts.QueueSize)
+	msg["overflow"] = schema.OverflowDropOldest
+	if opts.Overflow != "" {
+		msg["overflow"] = opts.Overflow
+	}
+	msg["subject"] = subject
 	registerSubRequestCodec, err := goavro.NewCodec(schema.RegisterSubRequest)
 	if err != nil {
 		return schema.RegisterSubResponseType{}, err
@@ -66,11 +213,8 @@ func (c *Client) RegisterMqttTopic(topic string) (schema.RegisterSubResponseType
 		return schema.RegisterSubResponseType{}, err
 	}
 
-	response, err := c.nats.Request(fmt.Sprintf("%s.config.register", c.target), bytes, 2*time.Second)
+	response, err := c.request(ctx, "config.register", bytes)
 	if err != nil {
-		if c.nats.LastError() != nil {
-			return schema.RegisterSubResponseType{}, fmt.Errorf("%v for request", c.nats.LastError())
-		}
 		return schema.RegisterSubResponseType{}, err
 	}
 
@@ -88,9 +232,269 @@ func (c *Client) RegisterMqttTopic(topic string) (schema.RegisterSubResponseType
 	return res, nil
 }
 
+// RenewNatsSubject renews the lease of a subject previously registered using 'RegisterMqttTopic' or of
+// the ID returned by 'RegisterNatsSubject'.
+// This is done automatically by the client and only needed for registrations done otherwise.
+func (c *Client) RenewNatsSubject(subject string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.RenewNatsSubjectCtx(ctx, subject)
+}
+
+// RenewNatsSubjectCtx is like `RenewNatsSubject` but honours the deadline and cancellation of ctx.
+func (c *Client) RenewNatsSubjectCtx(ctx context.Context, subject string) (time.Duration, error) {
+	res, err := c.renew(ctx, subject)
+	if err != nil {
+		return 0, err
+	}
+	if res.Error != "" {
+		return 0, fmt.Errorf("%s", res.Error)
+	}
+	return time.Duration(res.Lease) * time.Millisecond, nil
+}
+
+func (c *Client) renew(ctx context.Context, subject string) (schema.RenewSubResponseType, error) {
+	msg := make(map[string]interface{})
+	msg["subject"] = subject
+	bytes, err := avro.Writer(msg, schema.RenewSubRequestCodec)
+	if err != nil {
+		return schema.RenewSubResponseType{}, err
+	}
+
+	response, err := c.request(ctx, "config.renew", bytes)
+	if err != nil {
+		return schema.RenewSubResponseType{}, err
+	}
+
+	avro, err := avro.NewReader(response.Data)
+	if err != nil {
+		return schema.RenewSubResponseType{}, err
+	}
+	j, err := avro.ByteString()
+	if err != nil {
+		return schema.RenewSubResponseType{}, err
+	}
+
+	res := schema.RenewSubResponseType{}
+	err = json.Unmarshal(j, &res)
+	if err != nil {
+		return schema.RenewSubResponseType{}, err
+	}
+	return res, nil
+}
+
+// registration is a registration made by the client. If the module lost it, e.g. because the module restarted
+// without keeping its registrations, it is registered again under the same subject or ID.
+type registration struct {
+	// register registers again under the same subject or ID and returns the granted lease
+	register func(ctx context.Context) (time.Duration, error)
+	// natsSubject is set for registrations forwarding nats subjects, which are identified by ID
+	natsSubject bool
+	leased      bool
+	stop        chan struct{}
+	// now triggers an immediate renewal
+	now chan struct{}
+	// registering is set while a registration without lease is registered again. Guarded by registrationsMutex.
+	registering bool
+}
+
+// track remembers a registration identified by key and renews its lease in the background
+func (c *Client) track(key string, natsSubject bool, lease time.Duration, register func(ctx context.Context) (time.Duration, error)) {
+	c.lifecycleOnce.Do(c.watchLifecycle)
+
+	r := &registration{
+		register:    register,
+		natsSubject: natsSubject,
+		leased:      lease > 0,
+		stop:        make(chan struct{}),
+		now:         make(chan struct{}, 1),
+	}
+	c.registrationsMutex.Lock()
+	c.registrations[key] = r
+	c.registrationsMutex.Unlock()
+	if r.leased {
+		go c.renewLoop(key, r, lease)
+	}
+}
+
+// untrack forgets a registration and stops renewing its lease
+func (c *Client) untrack(key string) {
+	c.registrationsMutex.Lock()
+	defer c.registrationsMutex.Unlock()
+	if r, ok := c.registrations[key]; ok {
+		close(r.stop)
+		delete(c.registrations, key)
+	}
+}
+
+// renewLoop renews the lease of a registration until it is unregistered. If renewing reports that the
+// registration is gone, it is registered again.
+func (c *Client) renewLoop(key string, r *registration, lease time.Duration) {
+	// renew early enough to survive a lost renewal
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		case <-r.now:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		res, err := c.renew(ctx, key)
+		cancel()
+		if err != nil || res.Error == "" {
+			// on errors try again on next tick
+			continue
+		}
+		lease, ok := c.reregister(key, r)
+		if !ok {
+			return
+		}
+		if lease > 0 {
+			ticker.Reset(lease / 3)
+		}
+	}
+}
+
+// reregister registers a lost registration again until it succeeds or the registration is unregistered.
+// It returns the granted lease and false if the registration was unregistered meanwhile.
+func (c *Client) reregister(key string, r *registration) (time.Duration, bool) {
+	log.Printf("Registration '%s' lost, registering again", key)
+	delay := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		lease, err := r.register(ctx)
+		cancel()
+		if err == nil {
+			select {
+			case <-r.stop:
+				// unregistered while registering again
+				c.unregisterLost(key, r)
+				return 0, false
+			default:
+				return lease, true
+			}
+		}
+		log.Printf("Failed to register '%s' again: %s", key, err)
+		select {
+		case <-r.stop:
+			return 0, false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReregisterDelay {
+			delay = maxReregisterDelay
+		}
+	}
+}
+
+// unregisterLost removes a registration that was registered again after it was unregistered
+func (c *Client) unregisterLost(key string, r *registration) {
+	var err error
+	if r.natsSubject {
+		err = c.UnregisterMqttTopic(key)
+	} else {
+		err = c.UnregisterNatsSubject(key)
+	}
+	if err != nil {
+		log.Printf("Failed to unregister '%s': %s", key, err)
+	}
+}
+
+// checkRegistrations checks all registrations after the module started. Leases are renewed right away,
+// registrations without lease the module does not list anymore are registered again.
+func (c *Client) checkRegistrations() {
+	unleased := make(map[string]*registration)
+	c.registrationsMutex.Lock()
+	for key, r := range c.registrations {
+		if r.leased {
+			select {
+			case r.now <- struct{}{}:
+			default:
+			}
+		} else if !r.registering {
+			unleased[key] = r
+		}
+	}
+	c.registrationsMutex.Unlock()
+	if len(unleased) == 0 {
+		return
+	}
+
+	list, err := c.ListRegistrations()
+	if err != nil {
+		log.Printf("Failed to check registrations: %s", err)
+		return
+	}
+	for _, info := range list.Registrations {
+		delete(unleased, info.Subject)
+	}
+	for _, info := range list.NatsRegistrations {
+		delete(unleased, info.ID)
+	}
+	for key, r := range unleased {
+		c.registrationsMutex.Lock()
+		if r.registering {
+			c.registrationsMutex.Unlock()
+			continue
+		}
+		r.registering = true
+		c.registrationsMutex.Unlock()
+
+		go func(key string, r *registration) {
+			c.reregister(key, r)
+			c.registrationsMutex.Lock()
+			r.registering = false
+			c.registrationsMutex.Unlock()
+		}(key, r)
+	}
+}
+
+// watchLifecycle checks all registrations when the module announces its start, so that registrations lost
+// by the restart are registered again right away.
+func (c *Client) watchLifecycle() {
+	_, err := c.nats.Subscribe(fmt.Sprintf("%s.lifecycle", c.target), func(msg *nats.Msg) {
+		event, err := parseLifecycle(msg.Data)
+		if err != nil {
+			log.Printf("Invalid lifecycle event: %s", err)
+			return
+		}
+		if event.Event == schema.LifecycleEventStarted {
+			go c.checkRegistrations()
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to subscribe lifecycle events: %s", err)
+	}
+}
+
+// parseLifecycle decodes a lifecycle event
+func parseLifecycle(data []byte) (schema.LifecycleType, error) {
+	reader, err := avro.NewReader(data)
+	if err != nil {
+		return schema.LifecycleType{}, err
+	}
+	j, err := reader.ByteString()
+	if err != nil {
+		return schema.LifecycleType{}, err
+	}
+	event := schema.LifecycleType{}
+	err = json.Unmarshal(j, &event)
+	return event, err
+}
+
 // UnregisterNatsSubject is used to unregister a client from a specific nats subject
 // previously registered using 'RegisterMqttTopic'.
 func (c *Client) UnregisterNatsSubject(subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.UnregisterNatsSubjectCtx(ctx, subject)
+}
+
+// UnregisterNatsSubjectCtx is like `UnregisterNatsSubject` but honours the deadline and cancellation of ctx.
+func (c *Client) UnregisterNatsSubjectCtx(ctx context.Context, subject string) error {
+	c.untrack(subject)
+
 	msg := make(map[string]interface{})
 	msg["subject"] = subject
 	unregisterSubRequestCodec, err := goavro.NewCodec(schema.UnregisterSubRequest)
@@ -102,11 +506,8 @@ func (c *Client) UnregisterNatsSubject(subject string) error {
 		return err
 	}
 
-	response, err := c.nats.Request(fmt.Sprintf("%s.config.unregister", c.target), bytes, 2*time.Second)
+	response, err := c.request(ctx, "config.unregister", bytes)
 	if err != nil {
-		if c.nats.LastError() != nil {
-			return fmt.Errorf("%v for request", c.nats.LastError())
-		}
 		return err
 	}
 
@@ -124,32 +525,126 @@ func (c *Client) UnregisterNatsSubject(subject string) error {
 	return nil
 }
 
-// PublishOnMqttTopic is used to to send to a specific MQTT topic.
-func (c *Client) PublishOnMqttTopic(topic string, payload []byte) error {
+// NatsRegisterOptions contains the settings of a nats subject registration
+type NatsRegisterOptions struct {
+	// QoS used to publish the messages on MQTT. Defaults to 1, use `QoS` to select another QoS.
+	QoS *byte
+	// Retain sets the retain flag of the published messages
+	Retain bool
+	// Lease of the registration. Defaults to `DefaultLease`.
+	Lease time.Duration
+}
+
+// RegisterNatsSubject is used to let the module forward all messages published on a nats subject to MQTT.
+// subject may contain wildcards. topic is a template of the MQTT topic, which may contain the placeholders
+// `{subject}` (the whole subject with '.' replaced by '/'), `{1}`, `{2}`, ... (single tokens of the subject)
+// and `{rest}` (the tokens matched by a trailing '>'). If topic is empty, `{subject}` is used.
+// Messages are published with QoS 1. The registration is held by a lease of `DefaultLease` that is
+// renewed in the background until `UnregisterMqttTopic` is called with the returned ID.
+func (c *Client) RegisterNatsSubject(subject string, topic string) (schema.RegisterNatsResponseType, error) {
+	return c.RegisterNatsSubjectWithOptions(subject, topic, NatsRegisterOptions{})
+}
+
+// RegisterNatsSubjectCtx is like `RegisterNatsSubject` but honours the deadline and cancellation of ctx.
+func (c *Client) RegisterNatsSubjectCtx(ctx context.Context, subject string, topic string) (schema.RegisterNatsResponseType, error) {
+	return c.RegisterNatsSubjectWithOptionsCtx(ctx, subject, topic, NatsRegisterOptions{})
+}
+
+// RegisterNatsSubjectWithOptions is like `RegisterNatsSubject` but allows to set QoS, retain and lease.
+func (c *Client) RegisterNatsSubjectWithOptions(subject string, topic string, opts NatsRegisterOptions) (schema.RegisterNatsResponseType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.RegisterNatsSubjectWithOptionsCtx(ctx, subject, topic, opts)
+}
+
+// RegisterNatsSubjectWithOptionsCtx is like `RegisterNatsSubjectWithOptions` but honours the deadline and cancellation of ctx.
+func (c *Client) RegisterNatsSubjectWithOptionsCtx(ctx context.Context, subject string, topic string, opts NatsRegisterOptions) (schema.RegisterNatsResponseType, error) {
+	res, err := c.registerNatsSubject(ctx, subject, topic, opts, "")
+	if err != nil {
+		return schema.RegisterNatsResponseType{}, err
+	}
+	c.track(res.ID, true, time.Duration(res.Lease)*time.Millisecond, func(ctx context.Context) (time.Duration, error) {
+		again, err := c.registerNatsSubject(ctx, subject, topic, opts, res.ID)
+		return time.Duration(again.Lease) * time.Millisecond, err
+	})
+	return res, nil
+}
+
+// registerNatsSubject sends a register nats request. A non-empty id registers a lost registration again.
+func (c *Client) registerNatsSubject(ctx context.Context, subject string, topic string, opts NatsRegisterOptions, id string) (schema.RegisterNatsResponseType, error) {
+	if opts.Lease == 0 {
+		opts.Lease = DefaultLease
+	}
 	msg := make(map[string]interface{})
+	msg["subject"] = subject
 	msg["topic"] = topic
-	msg["payload"] = payload
-	pubRequestCodec, err := goavro.NewCodec(schema.PubRequest)
+	msg["qos"] = qosOrDefault(opts.QoS)
+	msg["retain"] = opts.Retain
+	msg["lease"] = int32(opts.Lease / time.Millisecond)
+	msg["id"] = id
+	bytes, err := avro.Writer(msg, schema.RegisterNatsRequestCodec)
 	if err != nil {
-		return err
+		return schema.RegisterNatsResponseType{}, err
 	}
 
-	bytes, err := avro.Writer(msg, pubRequestCodec)
+	response, err := c.request(ctx, "config.register-nats", bytes)
+	if err != nil {
+		return schema.RegisterNatsResponseType{}, err
+	}
+
+	avro, err := avro.NewReader(response.Data)
+	if err != nil {
+		return schema.RegisterNatsResponseType{}, err
+	}
+	j, err := avro.ByteString()
+	if err != nil {
+		return schema.RegisterNatsResponseType{}, err
+	}
+
+	res := schema.RegisterNatsResponseType{}
+	err = json.Unmarshal(j, &res)
+	if err != nil {
+		return schema.RegisterNatsResponseType{}, err
+	}
+	if len(res.Error) > 0 {
+		return schema.RegisterNatsResponseType{}, fmt.Errorf("%s", res.Error)
+	}
+	return res, nil
+}
+
+// UnregisterMqttTopic stops forwarding a nats subject previously registered using 'RegisterNatsSubject'.
+func (c *Client) UnregisterMqttTopic(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.UnregisterMqttTopicCtx(ctx, id)
+}
+
+// UnregisterMqttTopicCtx is like `UnregisterMqttTopic` but honours the deadline and cancellation of ctx.
+func (c *Client) UnregisterMqttTopicCtx(ctx context.Context, id string) error {
+	c.untrack(id)
+
+	msg := make(map[string]interface{})
+	msg["id"] = id
+	bytes, err := avro.Writer(msg, schema.UnregisterNatsRequestCodec)
 	if err != nil {
 		return err
 	}
-	response, err := c.nats.Request(fmt.Sprintf("%s.publish", c.target), bytes, 2*time.Second)
+
+	response, err := c.request(ctx, "config.unregister-nats", bytes)
 	if err != nil {
-		if c.nats.LastError() != nil {
-			return fmt.Errorf("%v for request", c.nats.LastError())
-		}
 		return err
 	}
 
-	avro, _ := avro.NewReader(response.Data)
-	j, _ := avro.ByteString()
+	avro, err := avro.NewReader(response.Data)
+	if err != nil {
+		return err
+	}
+	j, err := avro.ByteString()
+	if err != nil {
+		return err
+	}
 
-	res := schema.PubResponseType{}
+	res := schema.UnregisterNatsResponseType{}
 	err = json.Unmarshal(j, &res)
 	if err != nil {
 		return err
@@ -160,47 +655,322 @@ func (c *Client) PublishOnMqttTopic(topic string, payload []byte) error {
 	return nil
 }
 
-// RequestReply is used to to send to a specific MQTT topic.
-func (c *Client) RequestReply(topic string, payload []byte, timeout int32) ([]byte, error) {
+// PublishOptions contains the settings of a published MQTT message
+type PublishOptions struct {
+	// QoS of the message. Defaults to 1, use `QoS` to select another QoS.
+	QoS *byte
+	// Retain sets the retain flag of the message
+	Retain bool
+	// ContentType is the MQTT 5 content type of the payload
+	ContentType string
+	// MessageExpiry is the MQTT 5 message expiry interval with a resolution of seconds. 0 disables the expiry.
+	MessageExpiry time.Duration
+	// UserProperties are the MQTT 5 user properties of the message
+	UserProperties []schema.UserProperty
+}
+
+// PublishOnMqttTopic is used to to send to a specific MQTT topic.
+// The message is published with QoS 1 and without retain flag.
+func (c *Client) PublishOnMqttTopic(topic string, payload []byte) error {
+	return c.PublishOnMqttTopicWithOptions(topic, payload, PublishOptions{})
+}
+
+// PublishOnMqttTopicCtx is like `PublishOnMqttTopic` but honours the deadline and cancellation of ctx.
+func (c *Client) PublishOnMqttTopicCtx(ctx context.Context, topic string, payload []byte) error {
+	return c.PublishOnMqttTopicWithOptionsCtx(ctx, topic, payload, PublishOptions{})
+}
+
+// PublishOnMqttTopicWithOptions is like `PublishOnMqttTopic` but allows to set QoS, retain flag and MQTT 5 properties.
+func (c *Client) PublishOnMqttTopicWithOptions(topic string, payload []byte, opts PublishOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.PublishOnMqttTopicWithOptionsCtx(ctx, topic, payload, opts)
+}
+
+// PublishOnMqttTopicWithOptionsCtx is like `PublishOnMqttTopicWithOptions` but honours the deadline and cancellation of ctx.
+func (c *Client) PublishOnMqttTopicWithOptionsCtx(ctx context.Context, topic string, payload []byte, opts PublishOptions) error {
+	_, err := c.PublishOnMqttTopicWithResponseCtx(ctx, topic, payload, opts)
+	return err
+}
+
+// PublishOnMqttTopicWithResponseCtx is like `PublishOnMqttTopicWithOptionsCtx` but also returns the response of the module.
+// It tells whether the message was spooled because the broker is not reachable and the state of the spool.
+func (c *Client) PublishOnMqttTopicWithResponseCtx(ctx context.Context, topic string, payload []byte, opts PublishOptions) (schema.PubResponseType, error) {
+	userProperties := make([]interface{}, 0, len(opts.UserProperties))
+	for _, p := range opts.UserProperties {
+		userProperties = append(userProperties, map[string]interface{}{"key": p.Key, "value": p.Value})
+	}
 	msg := make(map[string]interface{})
 	msg["topic"] = topic
 	msg["payload"] = payload
-	msg["timeout"] = timeout
-	codec, err := goavro.NewCodec(schema.ReqResRequest)
+	msg["qos"] = qosOrDefault(opts.QoS)
+	msg["retain"] = opts.Retain
+	msg["contentType"] = opts.ContentType
+	msg["messageExpiry"] = int64(opts.MessageExpiry / time.Second)
+	msg["userProperties"] = userProperties
+	res := schema.PubResponseType{}
+	pubRequestCodec, err := goavro.NewCodec(schema.PubRequest)
 	if err != nil {
-		return []byte{}, err
+		return res, err
 	}
 
-	bytes, err := avro.Writer(msg, codec)
+	bytes, err := avro.Writer(msg, pubRequestCodec)
+	if err != nil {
+		return res, err
+	}
+	response, err := c.request(ctx, "publish", bytes)
+	if err != nil {
+		return res, err
+	}
+
+	avro, _ := avro.NewReader(response.Data)
+	j, _ := avro.ByteString()
+
+	err = json.Unmarshal(j, &res)
+	if err != nil {
+		return res, err
+	}
+	if res.Error != "" {
+		return res, fmt.Errorf("%s", res.Error)
+	}
+	return res, nil
+}
+
+// RequestOptions selects how request and response are correlated
+type RequestOptions struct {
+	// Mode is one of schema.RequestModeProperties (MQTT 5 response topic and correlation data),
+	// schema.RequestModeTopic (request on <topic>/req/<id>, response on <topic>/res/<id>) or
+	// schema.RequestModeEnvelope (id in a field of a JSON object payload). Empty selects schema.RequestModeProperties.
+	Mode string
+	// ResponseTopic is the topic the response is expected on in envelope mode. Defaults to <topic>/res.
+	ResponseTopic string
+	// CorrelationField is the JSON field carrying the id in envelope mode. Defaults to correlationId.
+	CorrelationField string
+}
+
+// RequestReply is used to to send to a specific MQTT topic.
+// Request and response are correlated by the MQTT 5 response topic and correlation data.
+func (c *Client) RequestReply(topic string, payload []byte, timeout int32) ([]byte, error) {
+	return c.RequestReplyWithOptions(topic, payload, timeout, RequestOptions{})
+}
+
+// RequestReplyWithOptions is like `RequestReply` but allows to correlate request and response by topic or
+// by a JSON envelope field for devices without MQTT 5 response topic support.
+func (c *Client) RequestReplyWithOptions(topic string, payload []byte, timeout int32, opts RequestOptions) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), (time.Duration(timeout)*time.Millisecond)+(5*time.Second))
+	defer cancel()
+	return c.requestReply(ctx, topic, payload, timeout, opts)
+}
+
+// RequestReplyCtx is like `RequestReply` but waits for the response until ctx is done. If the caller gives up,
+// the module stops waiting for the response as well. Without deadline the module waits until ctx is cancelled,
+// at most one hour.
+func (c *Client) RequestReplyCtx(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	return c.RequestReplyWithOptionsCtx(ctx, topic, payload, RequestOptions{})
+}
+
+// RequestReplyWithOptionsCtx is like `RequestReplyWithOptions` but waits for the response until ctx is done.
+func (c *Client) RequestReplyWithOptionsCtx(ctx context.Context, topic string, payload []byte, opts RequestOptions) ([]byte, error) {
+	return c.requestReply(ctx, topic, payload, contextTimeout(ctx), opts)
+}
+
+func (c *Client) requestReply(ctx context.Context, topic string, payload []byte, timeout int32, opts RequestOptions) ([]byte, error) {
+	id := uuid.New().String()
+	bytes, err := requestReplyRequest(topic, payload, timeout, id, "", "", opts)
 	if err != nil {
 		return []byte{}, err
 	}
-	response, err := c.nats.Request(fmt.Sprintf("%s.request-response", c.target), bytes, (time.Duration(timeout)*time.Millisecond)+(5*time.Second))
+	response, err := c.request(ctx, "request-response", bytes)
 	if err != nil {
-		if c.nats.LastError() != nil {
-			return []byte{}, fmt.Errorf("%v for request", c.nats.LastError())
+		if ctx.Err() != nil {
+			c.cancelRequest(id)
 		}
 		return []byte{}, err
 	}
 
-	avro, err := avro.NewReader(response.Data)
+	res, err := parseRequestReplyResponse(response.Data)
 	if err != nil {
 		return []byte{}, err
 	}
 
+	if res.Error != "" {
+		return []byte{}, fmt.Errorf(res.Error)
+	}
+
+	return res.Payload, nil
+}
+
+// Response is a single response to a request sent with `RequestStream`
+type Response struct {
+	Payload []byte
+	// Err is set if the request failed or no response arrived within the timeout
+	Err error
+}
+
+// RequestStream sends a request to a MQTT device and returns all its responses, e.g. progress updates or chunks.
+// timeout is the time to wait for each response: the returned channel is closed after the response matching
+// endMarker or if no further response arrives within the timeout. A response ends the stream if its payload
+// equals endMarker, in envelope mode if its JSON object has the field named by endMarker set to true. An empty
+// endMarker relays responses until the timeout. The channel must be read until it is closed.
+func (c *Client) RequestStream(topic string, payload []byte, timeout int32, endMarker string, opts RequestOptions) (<-chan Response, error) {
+	return c.RequestStreamCtx(context.Background(), topic, payload, timeout, endMarker, opts)
+}
+
+// RequestStreamCtx is like `RequestStream` but ends the stream when ctx is done. The last response then carries
+// the error of ctx, if the caller is still reading, and the module stops relaying responses. Callers that stop
+// reading before the channel is closed must cancel ctx.
+func (c *Client) RequestStreamCtx(ctx context.Context, topic string, payload []byte, timeout int32, endMarker string, opts RequestOptions) (<-chan Response, error) {
+	id := uuid.New().String()
+	inbox := nats.NewInbox()
+	bytes, err := requestReplyRequest(topic, payload, timeout, id, inbox, endMarker, opts)
+	if err != nil {
+		return nil, err
+	}
+	// responses wait in the pending messages of the subscription, which are limited by the defaults of nats.go
+	sub, err := c.nats.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	response, err := c.request(requestCtx, "request-response", bytes)
+	cancel()
+	if err == nil {
+		var res schema.ReqResResponsetType
+		if res, err = parseRequestReplyResponse(response.Data); err == nil && res.Error != "" {
+			err = fmt.Errorf(res.Error)
+		}
+	}
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	// the last response fits into the buffer, so that it does not block if the caller stopped reading
+	responses := make(chan Response, 1)
+	go func() {
+		defer close(responses)
+		defer func() { _ = sub.Unsubscribe() }()
+		send := func(r Response) bool {
+			select {
+			case responses <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			// the module ends the stream itself if no response arrives within the timeout
+			waitCtx, cancel := context.WithTimeout(ctx, (time.Duration(timeout)*time.Millisecond)+(5*time.Second))
+			msg, err := sub.NextMsgWithContext(waitCtx)
+			cancel()
+			if err == nil {
+				res, err := parseRequestReplyResponse(msg.Data)
+				if err != nil {
+					send(Response{Err: err})
+					return
+				}
+				if res.Error != "" {
+					send(Response{Err: fmt.Errorf(res.Error)})
+					return
+				}
+				// the module ends a stream without end marker by an empty last response
+				if !res.End || len(res.Payload) > 0 {
+					if !send(Response{Payload: res.Payload}) {
+						// ctx is done, the request is cancelled on the next iteration
+						continue
+					}
+				}
+				if res.End {
+					return
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				c.cancelRequest(id)
+				select {
+				case responses <- Response{Err: ctx.Err()}:
+				default:
+				}
+				return
+			}
+			// the module did not end the stream
+			send(Response{Err: fmt.Errorf("timeout expired")})
+			return
+		}
+	}()
+	return responses, nil
+}
+
+// cancelRequest lets the module stop waiting for the responses of a request. Errors are ignored, the request
+// may have been completed in the meantime.
+func (c *Client) cancelRequest(id string) {
+	msg := make(map[string]interface{})
+	msg["id"] = id
+	bytes, err := avro.Writer(msg, schema.ReqResCancelRequestCodec)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, _ = c.request(ctx, "request-response.cancel", bytes)
+}
+
+// contextTimeout returns the time left until the deadline of ctx in milliseconds
+func contextTimeout(ctx context.Context) int32 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return math.MaxInt32
+	}
+	timeout := time.Until(deadline) / time.Millisecond
+	if timeout < 1 {
+		return 1
+	}
+	if timeout > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(timeout)
+}
+
+// requestReplyRequest encodes a request response request
+func requestReplyRequest(topic string, payload []byte, timeout int32, id string, inbox string, endMarker string, opts RequestOptions) ([]byte, error) {
+	if opts.Mode == "" {
+		opts.Mode = schema.RequestModeProperties
+	}
+	msg := make(map[string]interface{})
+	msg["topic"] = topic
+	msg["payload"] = payload
+	msg["timeout"] = timeout
+	msg["mode"] = opts.Mode
+	msg["responseTopic"] = opts.ResponseTopic
+	msg["correlationField"] = opts.CorrelationField
+	msg["id"] = id
+	msg["inbox"] = inbox
+	msg["endMarker"] = endMarker
+	codec, err := goavro.NewCodec(schema.ReqResRequest)
+	if err != nil {
+		return nil, err
+	}
+	return avro.Writer(msg, codec)
+}
+
+// parseRequestReplyResponse decodes a request response response
+func parseRequestReplyResponse(data []byte) (schema.ReqResResponsetType, error) {
+	avro, err := avro.NewReader(data)
+	if err != nil {
+		return schema.ReqResResponsetType{}, err
+	}
+
 	m, err := avro.Map()
 	if err != nil {
-		return []byte{}, err
+		return schema.ReqResResponsetType{}, err
 	}
 
 	res := schema.ReqResResponsetType{
 		Payload: m["payload"].([]byte),
 		Error:   m["error"].(string),
 	}
-
-	if res.Error != "" {
-		return []byte{}, fmt.Errorf(res.Error)
+	if end, ok := m["end"].(bool); ok {
+		res.End = end
 	}
-
-	return res.Payload, nil
+	return res, nil
 }
@@ -0,0 +1,433 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"alm-mqtt-module/internal/config"
+	"alm-mqtt-module/internal/mqtt"
+	"alm-mqtt-module/pkg/avro"
+	"alm-mqtt-module/pkg/schema"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestModule runs a nats server and the request handlers of the module. Messages of publish and
+// request-reply requests are sent to the returned channel.
+func startTestModule(t *testing.T) (*config.Config, *nats.Conn, chan paho.Publish, func()) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	s := natsserver.RunServer(&opts)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		s.Shutdown()
+		t.Fatal(err)
+	}
+	pubChan := make(chan paho.Publish, 100)
+	c := config.NewConfig("module1", nc, make(chan string, 100), make(chan string, 100), pubChan)
+	c.HandleConfigRequests()
+	c.HandlePublishRequests()
+	c.HandleRequestResponse()
+	c.HandleAdminRequests()
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return c, nc, pubChan, func() {
+		nc.Close()
+		s.Shutdown()
+	}
+}
+
+// unregister removes the registration of subject in the module without telling the client
+func unregister(assert *assert.Assertions, nc *nats.Conn, subject string) {
+	data, err := avro.Writer(map[string]interface{}{"subject": subject}, schema.UnregisterSubRequestCodec)
+	assert.Nil(err)
+	_, err = nc.Request("module1.config.unregister", data, 2*time.Second)
+	assert.Nil(err)
+}
+
+func TestPublishSpoolState(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, pubChan, cleanup := startTestModule(t)
+	defer cleanup()
+
+	var published []string
+	var qos []byte
+	state := mqtt.SpoolState{}
+	c.SetPublisher(func(pub *paho.Publish) (bool, error) {
+		if state.Messages >= 2 {
+			return false, mqtt.ErrSpoolFull
+		}
+		published = append(published, pub.Topic)
+		qos = append(qos, pub.QoS)
+		state.Messages++
+		state.Bytes += int64(len(pub.Payload))
+		return true, nil
+	}, func() mqtt.SpoolState { return state })
+
+	cl := NewClient("module1", nc)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := cl.PublishOnMqttTopicWithResponseCtx(ctx, "state/valve", []byte("open"), PublishOptions{})
+	assert.Nil(err)
+	assert.True(res.Spooled)
+	assert.Equal(int32(1), res.SpoolMessages)
+	assert.Equal(int64(4), res.SpoolBytes)
+
+	assert.Nil(cl.PublishOnMqttTopicWithOptions("state/valve", []byte("closed"), PublishOptions{QoS: QoS(0)}))
+	res, err = cl.PublishOnMqttTopicWithResponseCtx(ctx, "state/valve", []byte("open"), PublishOptions{})
+	assert.Equal(mqtt.ErrSpoolFull.Error(), err.Error())
+	assert.False(res.Spooled)
+	assert.Equal(int32(2), res.SpoolMessages)
+	assert.Equal([]string{"state/valve", "state/valve"}, published)
+	// the QoS defaults to 1
+	assert.Equal([]byte{1, 0}, qos)
+	assert.Len(pubChan, 0)
+}
+
+func TestContextMethods(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, pubChan, cleanup := startTestModule(t)
+	defer cleanup()
+	cl := NewClient("module1", nc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := cl.RegisterMqttTopicCtx(ctx, "sensors/#")
+	assert.Nil(err)
+	assert.Equal([]string{res.Subject}, c.GetRegistrations("sensors/#"))
+	assert.Nil(cl.PublishOnMqttTopicCtx(ctx, "state/valve", []byte("open")))
+	pub := <-pubChan
+	assert.Equal("state/valve", pub.Topic)
+	assert.Equal(byte(1), pub.QoS)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cl.RegisterMqttTopicCtx(cancelled, "plant/#")
+	assert.NotNil(err)
+	assert.NotNil(cl.PublishOnMqttTopicCtx(cancelled, "state/valve", []byte("open")))
+	assert.Len(c.GetRegistrations("plant/#"), 0)
+	assert.Nil(cl.UnregisterNatsSubjectCtx(ctx, res.Subject))
+}
+
+func TestClientSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, _, cleanup := startTestModule(t)
+	defer cleanup()
+
+	cl := NewClient("module1", nc)
+	received := make(chan Message, 10)
+	s, err := cl.SubscribeWithOptions("sensors/#", RegisterOptions{Lease: 300 * time.Millisecond}, func(msg Message) {
+		received <- msg
+	})
+	assert.Nil(err)
+	subject := s.Subject()
+	assert.Contains(c.GetRegistrations("sensors/#"), subject)
+
+	deliver := func() {
+		data, err := avro.Writer(map[string]interface{}{
+			"device":         "dev1",
+			"acqTime":        int32(1000),
+			"payload":        []byte("21.5"),
+			"topic":          "sensors/temp",
+			"qos":            int32(1),
+			"userProperties": []interface{}{map[string]interface{}{"key": "unit", "value": "C"}},
+		}, DataCodec)
+		assert.Nil(err)
+		c.Dispatch("sensors/temp", false, data)
+	}
+	deliver()
+	select {
+	case msg := <-received:
+		assert.Equal("dev1", msg.Device)
+		assert.Equal(time.Unix(1000, 0), msg.AcqTime)
+		assert.Equal([]byte("21.5"), msg.Payload)
+		assert.Equal("sensors/temp", msg.Topic)
+		assert.Equal(byte(1), msg.QoS)
+		assert.Equal([]schema.UserProperty{{Key: "unit", Value: "C"}}, msg.UserProperties)
+	case <-time.After(time.Second):
+		assert.Fail("message not received")
+	}
+
+	// a lost registration is registered again under the same subject
+	unregister(assert, nc, subject)
+	assert.Eventually(func() bool {
+		return len(c.GetRegistrations("sensors/#")) == 1
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal(subject, s.Subject())
+	assert.Contains(c.GetRegistrations("sensors/#"), subject)
+	deliver()
+	select {
+	case msg := <-received:
+		assert.Equal([]byte("21.5"), msg.Payload)
+	case <-time.After(time.Second):
+		assert.Fail("message not received after registering again")
+	}
+
+	assert.Nil(s.Unsubscribe())
+	assert.Len(c.GetRegistrations("sensors/#"), 0)
+	assert.NotNil(s.Unsubscribe())
+}
+
+func TestClientRegistersAgainAfterStart(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, _, cleanup := startTestModule(t)
+	defer cleanup()
+
+	cl := NewClient("module1", nc)
+	s, err := cl.Subscribe("sensors/#", func(msg Message) {})
+	assert.Nil(err)
+	plain, err := cl.RegisterMqttTopic("plant/#")
+	assert.Nil(err)
+	natsRegistration, err := cl.RegisterNatsSubject("cmd.>", "")
+	assert.Nil(err)
+
+	// registrations kept by the module are kept by the client as well
+	c.AnnounceStart()
+	time.Sleep(200 * time.Millisecond)
+	registrations, err := cl.ListRegistrations()
+	assert.Nil(err)
+	assert.Len(registrations.Registrations, 2)
+	assert.Len(registrations.NatsRegistrations, 1)
+
+	// lost registrations are registered again under the same subject or ID without waiting for the lease
+	unregister(assert, nc, s.Subject())
+	unregister(assert, nc, plain.Subject)
+	data, err := avro.Writer(map[string]interface{}{"id": natsRegistration.ID}, schema.UnregisterNatsRequestCodec)
+	assert.Nil(err)
+	_, err = nc.Request("module1.config.unregister-nats", data, 2*time.Second)
+	assert.Nil(err)
+	c.AnnounceStart()
+	assert.Eventually(func() bool {
+		return len(c.GetRegistrations("sensors/#")) == 1 && len(c.GetRegistrations("plant/#")) == 1
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal([]string{s.Subject()}, c.GetRegistrations("sensors/#"))
+	assert.Equal([]string{plain.Subject}, c.GetRegistrations("plant/#"))
+	assert.Eventually(func() bool {
+		registrations, err = cl.ListRegistrations()
+		return err == nil && len(registrations.NatsRegistrations) == 1
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal(natsRegistration.ID, registrations.NatsRegistrations[0].ID)
+
+	assert.Nil(s.Unsubscribe())
+	assert.Nil(cl.UnregisterNatsSubject(plain.Subject))
+	assert.Nil(cl.UnregisterMqttTopic(natsRegistration.ID))
+	assert.Len(c.GetTopics(), 0)
+}
+
+func TestSubscribeSurvivesNatsReconnect(t *testing.T) {
+	assert := assert.New(t)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	s := natsserver.RunServer(&opts)
+	opts.Port = s.Addr().(*net.TCPAddr).Port
+	defer func() { s.Shutdown() }()
+	connect := func() *nats.Conn {
+		nc, err := nats.Connect(s.ClientURL(), nats.MaxReconnects(-1), nats.ReconnectWait(50*time.Millisecond))
+		assert.Nil(err)
+		return nc
+	}
+	nc := connect()
+	defer nc.Close()
+	c := config.NewConfig("module1", nc, make(chan string, 100), make(chan string, 100), make(chan paho.Publish, 100))
+	c.HandleConfigRequests()
+	c.HandleAdminRequests()
+	assert.Nil(nc.Flush())
+
+	clientConn := connect()
+	defer clientConn.Close()
+	cl := NewClient("module1", clientConn)
+	received := make(chan Message, 10)
+	sub, err := cl.SubscribeWithOptions("sensors/#", RegisterOptions{Lease: 300 * time.Millisecond}, func(msg Message) {
+		received <- msg
+	})
+	assert.Nil(err)
+	subject := sub.Subject()
+
+	// the lease expires while the nats server is down
+	s.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	assert.Len(c.GetRegistrations("sensors/#"), 0)
+	s = natsserver.RunServer(&opts)
+
+	assert.Eventually(func() bool {
+		return clientConn.IsConnected() && len(c.GetRegistrations("sensors/#")) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal([]string{subject}, c.GetRegistrations("sensors/#"))
+	data, err := avro.Writer(map[string]interface{}{"device": "dev1", "acqTime": int32(0), "payload": []byte("1")}, DataCodec)
+	assert.Nil(err)
+	c.Dispatch("sensors/temp", false, data)
+	select {
+	case msg := <-received:
+		assert.Equal([]byte("1"), msg.Payload)
+	case <-time.After(2 * time.Second):
+		assert.Fail("message not received after reconnect")
+	}
+	assert.Nil(sub.Unsubscribe())
+}
+
+func TestRequestStream(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, pubChan, cleanup := startTestModule(t)
+	defer cleanup()
+	cl := NewClient("module1", nc)
+	// respond sends responses to the request published last
+	respond := func(payloads ...string) {
+		req := <-pubChan
+		responseTopic := strings.Replace(req.Topic, "/req/", "/res/", 1)
+		for _, payload := range payloads {
+			assert.True(c.HandleResponse(&paho.Publish{Topic: responseTopic, Payload: []byte(payload)}))
+		}
+	}
+
+	responses, err := cl.RequestStream("dev/1/update", []byte("start"), 1000, "done", RequestOptions{Mode: schema.RequestModeTopic})
+	assert.Nil(err)
+	respond("10%", "done")
+	var received []string
+	for r := range responses {
+		assert.Nil(r.Err)
+		received = append(received, string(r.Payload))
+	}
+	assert.Equal([]string{"10%", "done"}, received)
+
+	// a caller that stops reading and cancels ctx does not leak the subscription of the inbox
+	subscriptions := nc.NumSubscriptions()
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = cl.RequestStreamCtx(ctx, "dev/1/update", []byte("start"), 60000, "done", RequestOptions{Mode: schema.RequestModeTopic})
+	assert.Nil(err)
+	respond("10%", "20%", "30%")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.Eventually(func() bool {
+		topics, err := cl.ListTopics()
+		return err == nil && len(topics.PendingRequests) == 0 && nc.NumSubscriptions() == subscriptions
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestSlowSubscriberDoesNotBlockDispatch(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, _, cleanup := startTestModule(t)
+	defer cleanup()
+	cl := NewClient("module1", nc)
+
+	// subscribers that never acknowledge
+	slow, err := cl.RegisterMqttTopicWithOptions("sensors/#", RegisterOptions{Lease: time.Minute, QueueSize: 2, Overflow: schema.OverflowDropNewest})
+	assert.Nil(err)
+	disconnect, err := cl.RegisterMqttTopicWithOptions("sensors/#", RegisterOptions{Lease: time.Minute, QueueSize: 1, Overflow: schema.OverflowDisconnect})
+	assert.Nil(err)
+	for _, subject := range []string{slow.Subject, disconnect.Subject} {
+		_, err = nc.Subscribe(subject, func(msg *nats.Msg) {})
+		assert.Nil(err)
+	}
+	assert.Nil(nc.Flush())
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			c.Dispatch("sensors/1", false, []byte{byte(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("dispatch blocked")
+	}
+
+	// the registration with overflow policy disconnect is removed
+	assert.Eventually(func() bool {
+		return len(c.GetRegistrations("sensors/#")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	registrations, err := cl.ListRegistrations()
+	assert.Nil(err)
+	assert.Len(registrations.Registrations, 1)
+	r := registrations.Registrations[0]
+	assert.Equal(slow.Subject, r.Subject)
+	assert.Equal(int32(2), r.QueueSize)
+	assert.Equal(schema.OverflowDropNewest, r.Overflow)
+	assert.True(r.Queued <= 2)
+	assert.True(r.Dropped >= 7)
+
+	_, err = cl.RegisterMqttTopicWithOptions("sensors/#", RegisterOptions{Overflow: "block"})
+	assert.NotNil(err)
+}
+
+func TestAdminRequests(t *testing.T) {
+	assert := assert.New(t)
+	c, nc, pubChan, cleanup := startTestModule(t)
+	defer cleanup()
+	cl := NewClient("module1", nc)
+
+	received := make(chan Message, 1)
+	s, err := cl.Subscribe("sensors/#", func(msg Message) { received <- msg })
+	assert.Nil(err)
+	data, err := avro.Writer(map[string]interface{}{"device": "dev1", "acqTime": int32(0), "payload": []byte("1")}, DataCodec)
+	assert.Nil(err)
+	c.Dispatch("sensors/temp", false, data)
+	<-received
+
+	natsRegistration, err := cl.RegisterNatsSubject("cmd.>", "")
+	assert.Nil(err)
+
+	go func() {
+		req, err := requestReplyRequest("dev/1/cmd", []byte("ping"), 60000, "r1", "", "", RequestOptions{Mode: schema.RequestModeTopic})
+		assert.Nil(err)
+		_, _ = nc.Request("module1.request-response", req, 2*time.Second)
+	}()
+	<-pubChan
+
+	// the delivery is counted after the acknowledge arrived
+	var registrations schema.AdminRegistrationsResponseType
+	assert.Eventually(func() bool {
+		registrations, err = cl.ListRegistrations()
+		return err == nil && len(registrations.Registrations) == 1 && registrations.Registrations[0].Delivered == 1
+	}, time.Second, 20*time.Millisecond)
+	r := registrations.Registrations[0]
+	assert.Equal(s.Subject(), r.Subject)
+	assert.Equal("sensors/#", r.Topic)
+	assert.Equal(schema.DeliveryModeAck, r.Delivery)
+	assert.Equal(int32(DefaultLease/time.Millisecond), r.Lease)
+	assert.Equal(int32(1), r.QoS)
+	assert.Equal(int64(0), r.Failed)
+	assert.NotZero(r.LastDelivery)
+	assert.Len(registrations.NatsRegistrations, 1)
+	assert.Equal(natsRegistration.ID, registrations.NatsRegistrations[0].ID)
+	assert.Equal("cmd.>", registrations.NatsRegistrations[0].Subject)
+
+	topics, err := cl.ListTopics()
+	assert.Nil(err)
+	assert.Equal([]schema.TopicInfoType{
+		{Topic: "dev/1/cmd/res/r1", QoS: 2, Subjects: []string{}},
+		{Topic: "sensors/#", QoS: 1, Subjects: []string{s.Subject()}},
+	}, topics.Topics)
+	assert.Len(topics.PendingRequests, 1)
+	assert.Equal("r1", topics.PendingRequests[0].ID)
+	assert.Equal("dev/1/cmd/req/r1", topics.PendingRequests[0].Topic)
+	assert.Equal(schema.RequestModeTopic, topics.PendingRequests[0].Mode)
+
+	assert.Nil(s.Unsubscribe())
+	assert.Nil(cl.UnregisterMqttTopic(natsRegistration.ID))
+}
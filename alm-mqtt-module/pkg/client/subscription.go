@@ -0,0 +1,180 @@
+/*
+Copyright © 2021 Ci4Rail GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"alm-mqtt-module/pkg/avro"
+	"alm-mqtt-module/pkg/schema"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Message is a MQTT message forwarded by the module
+type Message struct {
+	// Device is the id of the device running the module
+	Device string
+	// AcqTime is the time the module received the message
+	AcqTime time.Time
+	Payload []byte
+	// Topic is the topic the message was published on
+	Topic string
+	// QoS is the QoS the message was received with
+	QoS byte
+	// Retained is set if the message was retained by the broker
+	Retained bool
+	// ContentType, CorrelationData and UserProperties are the MQTT 5 properties of the message
+	ContentType     string
+	CorrelationData []byte
+	UserProperties  []schema.UserProperty
+}
+
+// MessageHandler is called for each message of a subscription
+type MessageHandler func(msg Message)
+
+// Subscription is a MQTT topic registered using `Subscribe`
+type Subscription struct {
+	client       *Client
+	topic        string
+	subject      string
+	subscription *nats.Subscription
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+// Subscribe registers a MQTT topic and calls handler for each forwarded message. Messages are acknowledged
+// after handler returned. If the registration is lost, e.g. because the module restarted, the client registers
+// the topic again under the same subject. Subscriptions survive nats reconnects. The registration is held
+// by a lease of `DefaultLease` that is renewed until `Unsubscribe` is called.
+func (c *Client) Subscribe(topic string, handler MessageHandler) (*Subscription, error) {
+	return c.SubscribeWithOptions(topic, RegisterOptions{}, handler)
+}
+
+// SubscribeWithOptions is like `Subscribe` but allows to set the options of the registration. A lease of 0
+// selects `DefaultLease`, subscriptions are always leased to detect lost registrations.
+// `schema.DeliveryModeStream` is not supported, read the stream using the JetStream API instead.
+func (c *Client) SubscribeWithOptions(topic string, opts RegisterOptions, handler MessageHandler) (*Subscription, error) {
+	if opts.Delivery == schema.DeliveryModeStream {
+		return nil, fmt.Errorf("delivery mode '%s' is not supported by subscriptions", opts.Delivery)
+	}
+	if opts.Lease == 0 {
+		opts.Lease = DefaultLease
+	}
+	res, err := c.RegisterMqttTopicWithOptions(topic, opts)
+	if err != nil {
+		return nil, err
+	}
+	subscription, err := c.nats.Subscribe(res.Subject, func(msg *nats.Msg) {
+		handle(msg, handler)
+	})
+	if err != nil {
+		if err := c.UnregisterNatsSubject(res.Subject); err != nil {
+			log.Printf("Failed to unregister '%s': %s", res.Subject, err)
+		}
+		return nil, err
+	}
+	return &Subscription{
+		client:       c,
+		topic:        topic,
+		subject:      res.Subject,
+		subscription: subscription,
+	}, nil
+}
+
+// Topic returns the MQTT topic of the subscription
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Subject returns the nats subject the messages are forwarded to
+func (s *Subscription) Subject() string {
+	return s.subject
+}
+
+// Unsubscribe stops the subscription and removes its registration
+func (s *Subscription) Unsubscribe() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("subscription of '%s' already unsubscribed", s.topic)
+	}
+	s.closed = true
+	if err := s.subscription.Unsubscribe(); err != nil {
+		log.Printf("Failed to unsubscribe '%s': %s", s.subject, err)
+	}
+	return s.client.UnregisterNatsSubject(s.subject)
+}
+
+// handle passes a forwarded message to the handler and acknowledges it
+func handle(msg *nats.Msg, handler MessageHandler) {
+	m, err := ParseMessage(msg.Data)
+	if err != nil {
+		log.Printf("Invalid message on '%s': %s", msg.Subject, err)
+	} else {
+		handler(m)
+	}
+	if msg.Reply != "" {
+		if err := msg.Respond([]byte{}); err != nil {
+			log.Printf("Failed to acknowledge message on '%s': %s", msg.Subject, err)
+		}
+	}
+}
+
+// ParseMessage decodes a MQTT message forwarded by the module
+func ParseMessage(data []byte) (Message, error) {
+	reader, err := avro.NewReader(data)
+	if err != nil {
+		return Message{}, err
+	}
+	m, err := reader.Map()
+	if err != nil {
+		return Message{}, err
+	}
+	if m == nil {
+		return Message{}, fmt.Errorf("no data")
+	}
+
+	// fields added later are missing in messages of older modules
+	msg := Message{}
+	msg.Device, _ = m["device"].(string)
+	if acqTime, ok := m["acqTime"].(int32); ok {
+		msg.AcqTime = time.Unix(int64(acqTime), 0)
+	}
+	msg.Payload, _ = m["payload"].([]byte)
+	msg.Topic, _ = m["topic"].(string)
+	if qos, ok := m["qos"].(int32); ok {
+		msg.QoS = byte(qos)
+	}
+	msg.Retained, _ = m["retained"].(bool)
+	msg.ContentType, _ = m["contentType"].(string)
+	msg.CorrelationData, _ = m["correlationData"].([]byte)
+	userProperties, _ := m["userProperties"].([]interface{})
+	for _, p := range userProperties {
+		property, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key, _ := property["key"].(string)
+		value, _ := property["value"].(string)
+		msg.UserProperties = append(msg.UserProperties, schema.UserProperty{Key: key, Value: value})
+	}
+	return msg, nil
+}
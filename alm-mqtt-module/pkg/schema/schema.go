@@ -23,14 +23,87 @@ import (
 	_ "embed"
 )
 
+const (
+	// DeliveryModeAck forwards each MQTT message as nats request that has to be acknowledged by the subscriber
+	DeliveryModeAck = "ack"
+	// DeliveryModePublish forwards MQTT messages as plain nats publish without acknowledge
+	DeliveryModePublish = "publish"
+	// DeliveryModeStream stores MQTT messages in a JetStream stream
+	DeliveryModeStream = "stream"
+	// OverflowDropOldest drops the oldest queued message if the queue of a registration is full
+	OverflowDropOldest = "dropOldest"
+	// OverflowDropNewest drops the arriving message if the queue of a registration is full
+	OverflowDropNewest = "dropNewest"
+	// OverflowDisconnect removes a registration whose queue is full
+	OverflowDisconnect = "disconnect"
+)
+
+const (
+	// RequestModeProperties correlates requests and responses using the MQTT 5 response topic and correlation data
+	RequestModeProperties = "properties"
+	// RequestModeTopic embeds the correlation id in the topic for MQTT 3.1.1 devices. Requests are
+	// published on `<topic>/req/<id>`, responses are expected on `<topic>/res/<id>`.
+	RequestModeTopic = "topic"
+	// RequestModeEnvelope embeds the correlation id in a field of JSON object payloads for MQTT 3.1.1 devices
+	RequestModeEnvelope = "envelope"
+)
+
+const (
+	// LifecycleEventStarted is announced when the module (re)started
+	LifecycleEventStarted = "started"
+)
+
+// HealthType is the struct for a health response
+type HealthType struct {
+	Live          bool `json:"live"`
+	Ready         bool `json:"ready"`
+	NatsConnected bool `json:"natsConnected"`
+	MqttConnected bool `json:"mqttConnected"`
+	// SinceLastMessage in milliseconds, -1 if no message was processed yet
+	SinceLastMessage int64 `json:"sinceLastMessage"`
+}
+
+// LifecycleType is the struct for a lifecycle event
+type LifecycleType struct {
+	// Event is `LifecycleEventStarted`
+	Event string `json:"event"`
+	// Instance is the id of the running module instance
+	Instance string `json:"instance"`
+	// Time is the unix timestamp of the event in milliseconds
+	Time int64 `json:"time"`
+}
+
 // RegisterSubRequestType is the struct used for a Register Subscription request
 type RegisterSubRequestType struct {
 	Topic string `json:"topic"`
+	// Lease in milliseconds. 0 registers without lease.
+	Lease int32 `json:"lease"`
+	// Delivery is one of `DeliveryModeAck`, `DeliveryModePublish` or `DeliveryModeStream`
+	Delivery string `json:"delivery"`
+	// Stream is the JetStream stream used with `DeliveryModeStream`
+	Stream        string `json:"stream"`
+	StreamSubject string `json:"streamSubject"`
+	// MaxAge in milliseconds, MaxMsgs and MaxBytes limit the stream. 0 is unlimited.
+	MaxAge   int64 `json:"maxAge"`
+	MaxMsgs  int64 `json:"maxMsgs"`
+	MaxBytes int64 `json:"maxBytes"`
+	// QoS, NoLocal, RetainAsPublished and RetainHandling are the requested MQTT subscription options
+	QoS               int32 `json:"qos"`
+	NoLocal           bool  `json:"noLocal"`
+	RetainAsPublished bool  `json:"retainAsPublished"`
+	RetainHandling    int32 `json:"retainHandling"`
+	// QueueSize is the number of messages queued for the subscriber, 0 selects the default
+	QueueSize int32 `json:"queueSize"`
+	// Overflow is one of `OverflowDropOldest`, `OverflowDropNewest` or `OverflowDisconnect`
+	Overflow string `json:"overflow"`
+	// Subject requests the subject of a lost registration again. Empty selects a new subject.
+	Subject string `json:"subject"`
 }
 
 // RegisterSubResponseType is the struct for a Register Subscription response
 type RegisterSubResponseType struct {
 	Subject string `json:"subject"`
+	Lease   int32  `json:"lease"`
 	Error   string `json:"error"`
 }
 
@@ -44,15 +117,74 @@ type UnregisterSubResponseType struct {
 	Error string `json:"error"`
 }
 
+// RenewSubRequestType is the struct for a Renew Subscription request
+type RenewSubRequestType struct {
+	Subject string `json:"subject"`
+}
+
+// RenewSubResponseType is the struct for a Renew Subscription response
+type RenewSubResponseType struct {
+	Lease int32  `json:"lease"`
+	Error string `json:"error"`
+}
+
+// RegisterNatsRequestType is the struct for a Register Nats Subject request
+type RegisterNatsRequestType struct {
+	// Subject to forward to MQTT, may contain wildcards
+	Subject string `json:"subject"`
+	// Topic is the template of the MQTT topic. Placeholders: {subject}, {1}, {2}, ... and {rest}
+	Topic  string `json:"topic"`
+	QoS    int32  `json:"qos"`
+	Retain bool   `json:"retain"`
+	// Lease in milliseconds. 0 registers without lease.
+	Lease int32 `json:"lease"`
+	// ID requests the ID of a lost registration again. Empty selects a new ID.
+	ID string `json:"id"`
+}
+
+// RegisterNatsResponseType is the struct for a Register Nats Subject response
+type RegisterNatsResponseType struct {
+	ID    string `json:"id"`
+	Lease int32  `json:"lease"`
+	Error string `json:"error"`
+}
+
+// UnregisterNatsRequestType is the struct for an Unregister Nats Subject request
+type UnregisterNatsRequestType struct {
+	ID string `json:"id"`
+}
+
+// UnregisterNatsResponseType is the struct for an Unregister Nats Subject response
+type UnregisterNatsResponseType struct {
+	Error string `json:"error"`
+}
+
+// UserProperty is a MQTT 5 user property
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
 // PubRequestType is the struct for an Publish request
 type PubRequestType struct {
 	Topic   string `json:"topic"`
 	Payload []byte `json:"payload"`
+	QoS     int32  `json:"qos"`
+	Retain  bool   `json:"retain"`
+	// ContentType, MessageExpiry in seconds and UserProperties are MQTT 5 properties of the message
+	ContentType    string         `json:"contentType"`
+	MessageExpiry  int64          `json:"messageExpiry"`
+	UserProperties []UserProperty `json:"userProperties"`
 }
 
 // PubResponseType is the struct for an Publish response
 type PubResponseType struct {
 	Error string `json:"error"`
+	// Spooled is set if the message was spooled because the broker is not reachable
+	Spooled       bool  `json:"spooled"`
+	SpoolMessages int32 `json:"spoolMessages"`
+	SpoolBytes    int64 `json:"spoolBytes"`
+	SpoolDropped  int64 `json:"spoolDropped"`
 }
 
 // ReqResRequestType is the struct for an `request respsonse` request
@@ -60,12 +192,103 @@ type ReqResRequestType struct {
 	Topic   string `json:"topic"`
 	Payload []byte `json:"payload"`
 	Timeout int32  `json:"timeout"`
+	// Mode is one of `RequestModeProperties`, `RequestModeTopic` or `RequestModeEnvelope`
+	Mode string `json:"mode"`
+	// ResponseTopic is the topic the response is expected on with `RequestModeEnvelope`
+	ResponseTopic string `json:"responseTopic"`
+	// CorrelationField is the field carrying the correlation id with `RequestModeEnvelope`
+	CorrelationField string `json:"correlationField"`
+	// ID is the correlation id used to cancel the request. Generated if empty.
+	ID string `json:"id"`
+	// Inbox is the nats subject all responses are relayed to. Empty waits for a single response.
+	Inbox string `json:"inbox"`
+	// EndMarker ends relaying responses to Inbox
+	EndMarker string `json:"endMarker"`
 }
 
 // ReqResResponsetType is the struct for an `request respsonse` response
 type ReqResResponsetType struct {
 	Payload []byte `json:"payload"`
 	Error   string `json:"error"`
+	// End is set on the last response relayed to an inbox
+	End bool `json:"end"`
+}
+
+// ReqResCancelRequestType is the struct for a cancel `request respsonse` request
+type ReqResCancelRequestType struct {
+	ID string `json:"id"`
+}
+
+// ReqResCancelResponseType is the struct for a cancel `request respsonse` response
+type ReqResCancelResponseType struct {
+	Error string `json:"error"`
+}
+
+// RegistrationInfoType describes an active registration forwarding a MQTT topic to a nats subject
+type RegistrationInfoType struct {
+	Subject  string `json:"subject"`
+	Topic    string `json:"topic"`
+	Delivery string `json:"delivery"`
+	// Lease in milliseconds, 0 without lease
+	Lease int32 `json:"lease"`
+	QoS   int32 `json:"qos"`
+	// Delivered is the number of messages forwarded successfully
+	Delivered int64 `json:"delivered"`
+	// Failed is the number of messages not acknowledged or failed to forward
+	Failed int64 `json:"failed"`
+	// LastDelivery is the unix timestamp of the last successful delivery in milliseconds, 0 if none
+	LastDelivery int64 `json:"lastDelivery"`
+	// QueueSize, Overflow, Queued and Dropped describe the queue of the registration
+	QueueSize int32  `json:"queueSize"`
+	Overflow  string `json:"overflow"`
+	Queued    int32  `json:"queued"`
+	Dropped   int64  `json:"dropped"`
+}
+
+// NatsRegistrationInfoType describes an active registration forwarding a nats subject to MQTT
+type NatsRegistrationInfoType struct {
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	// Topic is the template of the MQTT topic
+	Topic        string `json:"topic"`
+	Lease        int32  `json:"lease"`
+	QoS          int32  `json:"qos"`
+	Delivered    int64  `json:"delivered"`
+	Failed       int64  `json:"failed"`
+	LastDelivery int64  `json:"lastDelivery"`
+}
+
+// AdminRegistrationsResponseType is the struct for an `admin registrations` response
+type AdminRegistrationsResponseType struct {
+	Registrations     []RegistrationInfoType     `json:"registrations"`
+	NatsRegistrations []NatsRegistrationInfoType `json:"natsRegistrations"`
+	Error             string                     `json:"error"`
+}
+
+// TopicInfoType describes a subscribed MQTT topic filter
+type TopicInfoType struct {
+	Topic string `json:"topic"`
+	// QoS the filter is subscribed with
+	QoS int32 `json:"qos"`
+	// Subjects of the registrations of the filter
+	Subjects []string `json:"subjects"`
+}
+
+// PendingRequestInfoType describes a request-reply correlation waiting for responses
+type PendingRequestInfoType struct {
+	ID            string `json:"id"`
+	Topic         string `json:"topic"`
+	Mode          string `json:"mode"`
+	ResponseTopic string `json:"responseTopic"`
+	// Started is the unix timestamp the request was published in milliseconds
+	Started int64 `json:"started"`
+}
+
+// AdminTopicsResponseType is the struct for an `admin topics` response
+type AdminTopicsResponseType struct {
+	Topics          []TopicInfoType          `json:"topics"`
+	PendingRequests []PendingRequestInfoType `json:"pendingRequests"`
+	Error           string                   `json:"error"`
 }
 
 // RegisterSubRequest is the text file loaded schema for RegisterSubRequests
@@ -96,6 +319,48 @@ var UnregisterSubResponse string
 // UnregisterSubResponseCodec is the prepared avro codec for UnregisterSubResponses
 var UnregisterSubResponseCodec = avro.CreateSchema(UnregisterSubResponse)
 
+// RenewSubRequest is the text file loaded schema for RenewSubRequests
+//go:embed avro_schemas/renewSubRequest.avsc
+var RenewSubRequest string
+
+// RenewSubRequestCodec is the prepared avro codec for RenewSubRequests
+var RenewSubRequestCodec = avro.CreateSchema(RenewSubRequest)
+
+// RenewSubResponse is the text file loaded schema for RenewSubResponses
+//go:embed avro_schemas/renewSubResponse.avsc
+var RenewSubResponse string
+
+// RenewSubResponseCodec is the prepared avro codec for RenewSubResponses
+var RenewSubResponseCodec = avro.CreateSchema(RenewSubResponse)
+
+// RegisterNatsRequest is the text file loaded schema for RegisterNatsRequests
+//go:embed avro_schemas/registerNatsRequest.avsc
+var RegisterNatsRequest string
+
+// RegisterNatsRequestCodec is the prepared avro codec for RegisterNatsRequests
+var RegisterNatsRequestCodec = avro.CreateSchema(RegisterNatsRequest)
+
+// RegisterNatsResponse is the text file loaded schema for RegisterNatsResponses
+//go:embed avro_schemas/registerNatsResponse.avsc
+var RegisterNatsResponse string
+
+// RegisterNatsResponseCodec is the prepared avro codec for RegisterNatsResponses
+var RegisterNatsResponseCodec = avro.CreateSchema(RegisterNatsResponse)
+
+// UnregisterNatsRequest is the text file loaded schema for UnregisterNatsRequests
+//go:embed avro_schemas/unregisterNatsRequest.avsc
+var UnregisterNatsRequest string
+
+// UnregisterNatsRequestCodec is the prepared avro codec for UnregisterNatsRequests
+var UnregisterNatsRequestCodec = avro.CreateSchema(UnregisterNatsRequest)
+
+// UnregisterNatsResponse is the text file loaded schema for UnregisterNatsResponses
+//go:embed avro_schemas/unregisterNatsResponse.avsc
+var UnregisterNatsResponse string
+
+// UnregisterNatsResponseCodec is the prepared avro codec for UnregisterNatsResponses
+var UnregisterNatsResponseCodec = avro.CreateSchema(UnregisterNatsResponse)
+
 // PubRequest is the text file loaded schema for PublishRequests
 //go:embed avro_schemas/pubRequest.avsc
 var PubRequest string
@@ -123,3 +388,45 @@ var ReqResResponse string
 
 // ReqResResponseCodec is the prepared avro codec for Request Response Resposes
 var ReqResResponseCodec = avro.CreateSchema(ReqResResponse)
+
+// ReqResCancelRequest is the text file loaded schema for Request Response Cancel Requests
+//go:embed avro_schemas/reqResCancelRequest.avsc
+var ReqResCancelRequest string
+
+// ReqResCancelRequestCodec is the prepared avro codec for Request Response Cancel Requests
+var ReqResCancelRequestCodec = avro.CreateSchema(ReqResCancelRequest)
+
+// ReqResCancelResponse is the text file loaded schema for Request Response Cancel Responses
+//go:embed avro_schemas/reqResCancelResponse.avsc
+var ReqResCancelResponse string
+
+// ReqResCancelResponseCodec is the prepared avro codec for Request Response Cancel Responses
+var ReqResCancelResponseCodec = avro.CreateSchema(ReqResCancelResponse)
+
+// Health is the text file loaded schema for health responses
+//go:embed avro_schemas/health.avsc
+var Health string
+
+// HealthCodec is the prepared avro codec for health responses
+var HealthCodec = avro.CreateSchema(Health)
+
+// Lifecycle is the text file loaded schema for lifecycle events
+//go:embed avro_schemas/lifecycle.avsc
+var Lifecycle string
+
+// LifecycleCodec is the prepared avro codec for lifecycle events
+var LifecycleCodec = avro.CreateSchema(Lifecycle)
+
+// AdminRegistrationsResponse is the text file loaded schema for admin registrations responses
+//go:embed avro_schemas/adminRegistrationsResponse.avsc
+var AdminRegistrationsResponse string
+
+// AdminRegistrationsResponseCodec is the prepared avro codec for admin registrations responses
+var AdminRegistrationsResponseCodec = avro.CreateSchema(AdminRegistrationsResponse)
+
+// AdminTopicsResponse is the text file loaded schema for admin topics responses
+//go:embed avro_schemas/adminTopicsResponse.avsc
+var AdminTopicsResponse string
+
+// AdminTopicsResponseCodec is the prepared avro codec for admin topics responses
+var AdminTopicsResponseCodec = avro.CreateSchema(AdminTopicsResponse)